@@ -41,6 +41,17 @@ var (
 		This command updates a dockerfile based on build inputs.
 		It expects to be run inside of a container.`)
 
+	localBuildLong = templates.LongDesc(`
+		Run a docker or Source-to-Image build locally
+
+		This command runs a build from a Build in a YAML or JSON file, without a cluster.  It
+		fetches the build's source, or uses the source given with --source, prepares its
+		Dockerfile, extracts content from images, builds the image, and pushes it if the
+		build has an output, all in one process.  Updates to the build's status are written
+		to standard output, or to the file given with --status-file, as lines of JSON.
+		Directories holding the contents of the secrets, config maps and volumes that the
+		build uses have to be given with --secret, --config-map and --volume.`)
+
 	extractImageContentLong = templates.LongDesc(`
 		Extracts files from existing images.
 
@@ -179,3 +190,50 @@ func NewCommandExtractImageContent(name string) *cobra.Command {
 	cmd.AddCommand(NewCmdVersion(name, version.Get(), version.BuildahVersion(), os.Stdout))
 	return cmd
 }
+
+// NewCommandLocalBuild provides a CLI handler which runs a build outside of a
+// cluster.
+func NewCommandLocalBuild(name string) *cobra.Command {
+	var options cmd.LocalBuildOptions
+
+	defaultConfig, err := config.NewConfig("")
+	kcmdutil.CheckErr(err)
+
+	cmd := &cobra.Command{
+		Use:   name + " BUILD_FILE",
+		Short: "Run a build locally, without a cluster",
+		Long:  localBuildLong,
+		Args:  cobra.ExactArgs(1),
+		Run: func(c *cobra.Command, args []string) {
+			var err error
+			options.BuildPath = args[0]
+			if options.Isolation == "" {
+				options.Isolation, err = builderDefaultIsolation()
+				kcmdutil.CheckErr(err)
+			}
+			if options.StorageDriver == "" {
+				options.StorageDriver, options.StorageOptions, err = builderDefaultStorage()
+				kcmdutil.CheckErr(err)
+			}
+			err = cmd.RunLocalBuild(c.OutOrStderr(), options)
+			kcmdutil.CheckErr(err)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&options.Source, "source", "", "directory, or git repository URL, to use as the build's source in place of the one in the build")
+	flags.StringVar(&options.SourceSecretDir, "source-secret", "", "directory holding the build's source secret")
+	flags.StringVar(&options.PullSecretDir, "pull-secret", "", "directory holding the docker configuration used to pull images")
+	flags.StringVar(&options.PushSecretDir, "push-secret", "", "directory holding the docker configuration used to push the built image")
+	flags.StringToStringVar(&options.Secrets, "secret", nil, "`name=directory` holding the contents of one of the build's secrets, may be repeated")
+	flags.StringToStringVar(&options.ConfigMaps, "config-map", nil, "`name=directory` holding the contents of one of the build's config maps, may be repeated")
+	flags.StringToStringVar(&options.Volumes, "volume", nil, "`name=directory` holding the contents of one of the build's volumes, may be repeated")
+	flags.StringVar(&options.StatusPath, "status-file", "-", "file to write status updates to, or \"-\" for standard output")
+	flags.StringVar(&options.Isolation, "isolation", options.Isolation, "type of process `isolation` to use for RUN instructions")
+	flags.StringVar(&options.OCIRuntime, "oci-runtime", defaultConfig.Engine.OCIRuntime, "runtime to invoke for OCI isolation")
+	flags.StringVar(&options.StorageDriver, "storage-driver", options.StorageDriver, "storage driver to use for storing layers, images, and working containers")
+	flags.StringVar(&options.StorageOptions, "storage-options", options.StorageOptions, "storage options to use when storing layers, images, and working containers")
+
+	cmd.AddCommand(NewCmdVersion(name, version.Get(), version.BuildahVersion(), os.Stdout))
+	return cmd
+}
@@ -51,58 +51,91 @@ func builderCanUseOverlayFUSE() error {
 	return nil
 }
 
-// Try various storage setups until we find one that works with the privileges
-// that we currently have.
-func builderDefaultStorage() (string, string, error) {
-	for _, candidate := range []struct {
-		driver, options string
-		also            func() error
-	}{
-		{"overlay", `["mountopt=metacopy=on"]`, nil},
-		{"overlay", ``, nil},
-		{"overlay", `["mount_program=/usr/bin/fuse-overlayfs"]`, builderCanUseOverlayFUSE},
-		{"vfs", "", nil},
-	} {
-		var options []string
-		// Is there an additional test?
-		if candidate.also != nil {
-			if why := candidate.also(); why != nil {
-				klog.V(2).Info(why.Error())
-				continue
-			}
+// storageCandidate is a storage setup which we try to use.
+type storageCandidate struct {
+	driver, options string
+	// also, if set, checks for anything else that the setup needs.
+	also func() error
+}
+
+// storageCandidates are the storage setups which we try to use, in the order
+// that we prefer them.
+var storageCandidates = []storageCandidate{
+	{"overlay", `["mountopt=metacopy=on"]`, nil},
+	{"overlay", ``, nil},
+	{"overlay", `["mount_program=/usr/bin/fuse-overlayfs"]`, builderCanUseOverlayFUSE},
+	{"vfs", "", nil},
+}
+
+// tryStorageCandidate initializes storage using the candidate's setup, and
+// returns the options which it used if it succeeded.
+func tryStorageCandidate(candidate storageCandidate) ([]string, error) {
+	var options []string
+	// Is there an additional test?
+	if candidate.also != nil {
+		if why := candidate.also(); why != nil {
+			return nil, why
 		}
-		// Are there options for this case?
-		if candidate.options != "" {
-			err := json.Unmarshal([]byte(candidate.options), &options)
-			if err != nil {
-				klog.Errorf("internal error parsing options %q: %v", candidate.options, err)
-				continue
-			}
+	}
+	// Are there options for this case?
+	if candidate.options != "" {
+		err := json.Unmarshal([]byte(candidate.options), &options)
+		if err != nil {
+			return nil, fmt.Errorf("internal error parsing options %q: %v", candidate.options, err)
 		}
-		// Precreate some things.
-		if _, err := os.Stat(fmt.Sprintf("/var/lib/shared/%s-layers/layers.lock", candidate.driver)); err == nil {
-			if _, err := os.Stat(fmt.Sprintf("/var/lib/shared/%s-images/images.lock", candidate.driver)); err == nil {
-				if _, err := os.Stat(fmt.Sprintf("/var/lib/shared/%s-containers/containers.lock", candidate.driver)); err == nil {
-					options = append(options, fmt.Sprintf("%s.imagestore=/var/lib/shared", candidate.driver))
-				}
+	}
+	// Precreate some things.
+	if _, err := os.Stat(fmt.Sprintf("/var/lib/shared/%s-layers/layers.lock", candidate.driver)); err == nil {
+		if _, err := os.Stat(fmt.Sprintf("/var/lib/shared/%s-images/images.lock", candidate.driver)); err == nil {
+			if _, err := os.Stat(fmt.Sprintf("/var/lib/shared/%s-containers/containers.lock", candidate.driver)); err == nil {
+				options = append(options, fmt.Sprintf("%s.imagestore=/var/lib/shared", candidate.driver))
 			}
 		}
-		// Clear out the directory we're about to use.
-		os.RemoveAll("/var/lib/containers/storage/tmp")
-		os.RemoveAll("/run/containers/storage/tmp")
-		// Try to initialize storage.
-		store, err := storage.GetStore(storage.StoreOptions{
-			GraphRoot:          "/var/lib/containers/storage/tmp",
-			RunRoot:            "/run/containers/storage/tmp",
-			GraphDriverName:    candidate.driver,
-			GraphDriverOptions: options,
-		})
+	}
+	// Try to initialize storage in throwaway directories, next to where
+	// builds keep theirs if we can, so that they're on the same filesystem.
+	graphRoot, err := os.MkdirTemp(storageProbeParent("/var/lib/containers/storage"), "storage-probe-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a directory to try storage %q in: %v", candidate.driver, err)
+	}
+	defer os.RemoveAll(graphRoot)
+	runRoot, err := os.MkdirTemp(storageProbeParent("/run/containers/storage"), "storage-probe-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a directory to try storage %q in: %v", candidate.driver, err)
+	}
+	defer os.RemoveAll(runRoot)
+	store, err := storage.GetStore(storage.StoreOptions{
+		GraphRoot:          graphRoot,
+		RunRoot:            runRoot,
+		GraphDriverName:    candidate.driver,
+		GraphDriverOptions: options,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize storage %q with options %v: %v", candidate.driver, options, err)
+	}
+	// Shut down the storage that we were able to initialize.
+	store.Shutdown(true)
+	return options, nil
+}
+
+// storageProbeParent returns dir, if it's a directory, or "" so that
+// os.MkdirTemp uses the default directory for temporary files.
+func storageProbeParent(dir string) string {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return dir
+	}
+	return ""
+}
+
+// Try various storage setups until we find one that works with the privileges
+// that we currently have.
+func builderDefaultStorage() (string, string, error) {
+	for _, candidate := range storageCandidates {
+		options, err := tryStorageCandidate(candidate)
 		if err != nil {
-			klog.V(2).Infof("Unable to initialize storage %q with options %v: %v\n", candidate.driver, options, err)
+			klog.V(2).Info(err.Error())
 			continue
 		}
-		// Shut down the storage that we were able to initialize.
-		_, err = store.Shutdown(true)
 		// Re-encode the options before returning them.
 		reencodedOptions, err := json.Marshal(options)
 		if err != nil {
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containers/buildah/define"
+	"github.com/containers/common/pkg/config"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage/pkg/unshare"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/spf13/cobra"
+	"github.com/syndtr/gocapability/capability"
+
+	kcmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	"github.com/openshift/builder/pkg/build/builder"
+	"github.com/openshift/builder/pkg/version"
+)
+
+var doctorLong = templates.LongDesc(`
+	Check whether builds can run here
+
+	This command checks the storage drivers, isolation modes, user namespace mappings,
+	cgroup limits, and CA and registry configuration that builds use, and reports
+	whether each of them passed, or whether it would make builds fail or fall back
+	to something else.  It expects to be run inside of a build container.`)
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+
+	// seccompProfilePath is the seccomp profile which builds give to
+	// the containers that they run.
+	seccompProfilePath = "/usr/share/containers/seccomp.json"
+)
+
+// doctorResult is the outcome of one of the doctor's checks.
+type doctorResult struct {
+	// Check is the group of checks that the result is from, like
+	// "storage".
+	Check string `json:"check"`
+	// Name is what was checked, like the storage driver that was tried.
+	Name string `json:"name"`
+	// Status is "pass", "warn" or "fail".
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// doctorReport is the outcome of all of the doctor's checks.  Its Status is
+// the worst of its Results' statuses.
+type doctorReport struct {
+	Status  string         `json:"status"`
+	Results []doctorResult `json:"results"`
+}
+
+// NewCommandDoctor provides a CLI handler which checks whether builds can run
+// in the container that it's run in.
+func NewCommandDoctor(name string) *cobra.Command {
+	var output, ociRuntime string
+
+	defaultConfig, err := config.NewConfig("")
+	kcmdutil.CheckErr(err)
+
+	cmd := &cobra.Command{
+		Use:   name,
+		Short: "Check whether builds can run here",
+		Long:  doctorLong,
+		Run: func(c *cobra.Command, args []string) {
+			report := runDoctorChecks(defaultConfig, ociRuntime)
+			kcmdutil.CheckErr(writeDoctorReport(c.OutOrStdout(), report, output))
+			if report.Status == doctorFail {
+				os.Exit(1)
+			}
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&output, "output", "o", "text", "format of the report, \"text\" or \"json\"")
+	flags.StringVar(&ociRuntime, "oci-runtime", defaultConfig.Engine.OCIRuntime, "runtime to check for OCI isolation")
+
+	cmd.AddCommand(NewCmdVersion(name, version.Get(), version.BuildahVersion(), os.Stdout))
+	return cmd
+}
+
+// runDoctorChecks runs every check, and returns what they found.
+func runDoctorChecks(defaultConfig *config.Config, ociRuntime string) doctorReport {
+	var results []doctorResult
+	results = append(results, checkStorageCandidates()...)
+	results = append(results, checkIsolation(defaultConfig, ociRuntime)...)
+	results = append(results, checkUserNamespace()...)
+	results = append(results, checkCGroups()...)
+	results = append(results, checkConfigPaths()...)
+	return newDoctorReport(results)
+}
+
+// newDoctorReport returns a report of the results.
+func newDoctorReport(results []doctorResult) doctorReport {
+	report := doctorReport{Status: doctorPass, Results: results}
+	for _, result := range results {
+		switch {
+		case result.Status == doctorFail:
+			report.Status = doctorFail
+		case result.Status == doctorWarn && report.Status == doctorPass:
+			report.Status = doctorWarn
+		}
+	}
+	return report
+}
+
+// writeDoctorReport writes the report to out as a table, or as JSON.
+func writeDoctorReport(out io.Writer, report doctorReport, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "text", "":
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "STATUS\tCHECK\tNAME\tMESSAGE")
+		for _, result := range report.Results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", strings.ToUpper(result.Status), result.Check, result.Name, result.Message)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(out, "\nOverall: %s\n", strings.ToUpper(report.Status))
+		return err
+	}
+	return fmt.Errorf("unsupported output format %q, expected \"text\" or \"json\"", format)
+}
+
+// checkStorageCandidates tries each of the storage setups that builds try to
+// use, and reports which of them builds would use.
+func checkStorageCandidates() []doctorResult {
+	var results []doctorResult
+	chosen := ""
+	for _, candidate := range storageCandidates {
+		name := candidate.driver
+		if candidate.options != "" {
+			name += " " + candidate.options
+		}
+		options, err := tryStorageCandidate(candidate)
+		if err != nil {
+			results = append(results, doctorResult{Check: "storage", Name: name, Status: doctorWarn, Message: err.Error()})
+			continue
+		}
+		message := fmt.Sprintf("initialized with options %v", options)
+		if chosen == "" {
+			chosen = candidate.driver
+			message += ", builds will use this"
+		}
+		results = append(results, doctorResult{Check: "storage", Name: name, Status: doctorPass, Message: message})
+	}
+	switch chosen {
+	case "":
+		results = append(results, doctorResult{Check: "storage", Name: "default", Status: doctorFail, Message: "none of the storage drivers could be initialized"})
+	case "vfs":
+		results = append(results, doctorResult{Check: "storage", Name: "default", Status: doctorWarn, Message: "only the vfs driver could be initialized, builds will be slow and use much more space"})
+	default:
+		results = append(results, doctorResult{Check: "storage", Name: "default", Status: doctorPass, Message: fmt.Sprintf("builds will use the %s driver", chosen)})
+	}
+	return results
+}
+
+// checkIsolation checks whether the capabilities, runtime and seccomp profile
+// that each isolation mode needs are available.
+func checkIsolation(defaultConfig *config.Config, ociRuntime string) []doctorResult {
+	var results []doctorResult
+	isolation, err := builderDefaultIsolation()
+	// modes which builds won't use by default only need to work if a
+	// build asks for them
+	unusable := func(mode string) string {
+		if mode == isolation {
+			return doctorFail
+		}
+		return doctorWarn
+	}
+	if err != nil {
+		results = append(results, doctorResult{Check: "isolation", Name: "default", Status: doctorFail, Message: err.Error()})
+	} else {
+		results = append(results, doctorResult{Check: "isolation", Name: "default", Status: doctorPass, Message: fmt.Sprintf("builds will use %s isolation", isolation)})
+	}
+
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		results = append(results, doctorResult{Check: "isolation", Name: "capabilities", Status: doctorFail, Message: fmt.Sprintf("error checking our capabilities: %v", err)})
+		return results
+	}
+	var missing []string
+	for _, c := range []capability.Cap{capability.CAP_SYS_ADMIN, capability.CAP_SYS_CHROOT, capability.CAP_SETUID, capability.CAP_SETGID, capability.CAP_CHOWN, capability.CAP_DAC_OVERRIDE, capability.CAP_FOWNER, capability.CAP_MKNOD, capability.CAP_SETFCAP} {
+		if !effective[c] {
+			missing = append(missing, c.String())
+		}
+	}
+	if len(missing) > 0 {
+		results = append(results, doctorResult{Check: "isolation", Name: "capabilities", Status: doctorWarn, Message: fmt.Sprintf("missing %s, RUN instructions which need them will fail", strings.Join(missing, ", "))})
+	} else {
+		results = append(results, doctorResult{Check: "isolation", Name: "capabilities", Status: doctorPass, Message: "have every capability that builds use"})
+	}
+
+	switch runtimePath, err := findOCIRuntime(defaultConfig, ociRuntime); {
+	case err != nil:
+		results = append(results, doctorResult{Check: "isolation", Name: "oci", Status: unusable("oci"), Message: err.Error()})
+	case !effective[capability.CAP_SYS_ADMIN]:
+		results = append(results, doctorResult{Check: "isolation", Name: "oci", Status: unusable("oci"), Message: "missing CAP_SYS_ADMIN, which is needed to run " + runtimePath})
+	default:
+		results = append(results, doctorResult{Check: "isolation", Name: "oci", Status: doctorPass, Message: "can run " + runtimePath})
+	}
+
+	if effective[capability.CAP_SYS_CHROOT] {
+		results = append(results, doctorResult{Check: "isolation", Name: "chroot", Status: doctorPass, Message: "have CAP_SYS_CHROOT"})
+	} else {
+		results = append(results, doctorResult{Check: "isolation", Name: "chroot", Status: unusable("chroot"), Message: "missing CAP_SYS_CHROOT"})
+	}
+
+	switch info, err := os.Stat(seccompProfilePath); {
+	case err != nil:
+		results = append(results, doctorResult{Check: "isolation", Name: "seccomp", Status: doctorWarn, Message: fmt.Sprintf("%v, RUN instructions will use the runtime's default profile", err)})
+	case info.IsDir():
+		results = append(results, doctorResult{Check: "isolation", Name: "seccomp", Status: doctorFail, Message: seccompProfilePath + " is a directory"})
+	default:
+		data, err := os.ReadFile(seccompProfilePath)
+		if err == nil && !json.Valid(data) {
+			err = fmt.Errorf("%s is not valid JSON", seccompProfilePath)
+		}
+		if err != nil {
+			results = append(results, doctorResult{Check: "isolation", Name: "seccomp", Status: doctorFail, Message: err.Error()})
+		} else {
+			results = append(results, doctorResult{Check: "isolation", Name: "seccomp", Status: doctorPass, Message: "using " + seccompProfilePath})
+		}
+	}
+	return results
+}
+
+// effectiveCapabilities returns which capabilities we have.
+func effectiveCapabilities() (map[capability.Cap]bool, error) {
+	pid, err := capability.NewPid2(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := pid.Load(); err != nil {
+		return nil, err
+	}
+	effective := make(map[capability.Cap]bool)
+	for _, c := range capability.List() {
+		effective[c] = pid.Get(capability.EFFECTIVE, c)
+	}
+	return effective, nil
+}
+
+// findOCIRuntime returns the path of the OCI runtime named name, or of
+// buildah's default runtime if name is empty, looking in the places that the
+// containers configuration lists for it, and then in $PATH.
+func findOCIRuntime(defaultConfig *config.Config, name string) (string, error) {
+	if name == "" {
+		name = define.DefaultRuntime
+	}
+	for _, runtimePath := range defaultConfig.Engine.OCIRuntimes[name] {
+		if info, err := os.Stat(runtimePath); err == nil && !info.IsDir() {
+			return runtimePath, nil
+		}
+	}
+	runtimePath, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to find OCI runtime %q: %v", name, err)
+	}
+	return runtimePath, nil
+}
+
+// checkUserNamespace reports the user namespace mappings that we're running
+// with, and whether we can set up a user namespace of our own if we need one.
+func checkUserNamespace() []doctorResult {
+	var results []doctorResult
+	UIDs, GIDs, err := unshare.GetHostIDMappings("")
+	if err != nil {
+		return append(results, doctorResult{Check: "userns", Name: "mappings", Status: doctorFail, Message: fmt.Sprintf("error reading current ID mappings: %v", err)})
+	}
+	if isNodeDefaultMapping(UIDs) && isNodeDefaultMapping(GIDs) {
+		results = append(results, doctorResult{Check: "userns", Name: "mappings", Status: doctorPass, Message: fmt.Sprintf("running in the node's user namespace as %d:%d", os.Getuid(), os.Getgid())})
+	} else {
+		results = append(results, doctorResult{Check: "userns", Name: "mappings", Status: doctorPass, Message: fmt.Sprintf("running as %d:%d with UID map %s and GID map %s", os.Getuid(), os.Getgid(), formatIDMappings(UIDs), formatIDMappings(GIDs))})
+	}
+
+	if os.Geteuid() == 0 {
+		return results
+	}
+	// builds which don't run as root set up a user namespace using
+	// subordinate IDs and the newuidmap and newgidmap helpers
+	uid := fmt.Sprintf("%d", os.Geteuid())
+	subUIDs, subGIDs, err := unshare.GetSubIDMappings(uid, uid)
+	switch {
+	case err != nil:
+		results = append(results, doctorResult{Check: "userns", Name: "subids", Status: doctorFail, Message: fmt.Sprintf("error reading subordinate ID mappings for %s: %v", uid, err)})
+	case len(subUIDs) == 0 || len(subGIDs) == 0:
+		results = append(results, doctorResult{Check: "userns", Name: "subids", Status: doctorFail, Message: fmt.Sprintf("no subordinate UIDs or GIDs are assigned to %s in /etc/subuid and /etc/subgid", uid)})
+	default:
+		results = append(results, doctorResult{Check: "userns", Name: "subids", Status: doctorPass, Message: fmt.Sprintf("UID map %s and GID map %s", formatIDMappings(subUIDs), formatIDMappings(subGIDs))})
+	}
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if helperPath, err := exec.LookPath(helper); err != nil {
+			results = append(results, doctorResult{Check: "userns", Name: helper, Status: doctorFail, Message: err.Error()})
+		} else {
+			results = append(results, doctorResult{Check: "userns", Name: helper, Status: doctorPass, Message: "found " + helperPath})
+		}
+	}
+	return results
+}
+
+// checkCGroups reports the cgroup layout, and the limits which builds read
+// from it.
+func checkCGroups() []doctorResult {
+	var results []doctorResult
+	if cgroups.IsCgroup2UnifiedMode() {
+		data, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+		if err != nil {
+			results = append(results, doctorResult{Check: "cgroups", Name: "layout", Status: doctorWarn, Message: fmt.Sprintf("cgroup v2, but unable to read its controllers: %v", err)})
+		} else {
+			controllers := strings.Fields(string(data))
+			var missing []string
+			for _, controller := range []string{"cpu", "memory", "pids"} {
+				if !containsString(controllers, controller) {
+					missing = append(missing, controller)
+				}
+			}
+			if len(missing) > 0 {
+				results = append(results, doctorResult{Check: "cgroups", Name: "layout", Status: doctorWarn, Message: fmt.Sprintf("cgroup v2, without the %s controllers, so limits can't be read or applied", strings.Join(missing, ", "))})
+			} else {
+				results = append(results, doctorResult{Check: "cgroups", Name: "layout", Status: doctorPass, Message: "cgroup v2 with controllers " + strings.Join(controllers, ", ")})
+			}
+		}
+	} else {
+		results = append(results, doctorResult{Check: "cgroups", Name: "layout", Status: doctorPass, Message: "cgroup v1"})
+	}
+
+	limits, err := builder.GetCGroupLimits()
+	if err != nil {
+		return append(results, doctorResult{Check: "cgroups", Name: "limits", Status: doctorFail, Message: fmt.Sprintf("failed to retrieve cgroup limits: %v", err)})
+	}
+	return append(results, doctorResult{Check: "cgroups", Name: "limits", Status: doctorPass, Message: fmt.Sprintf("memory %d bytes, memory+swap %d bytes, cpu shares %d, cpu quota %d per %d", limits.MemoryLimitBytes, limits.MemorySwap, limits.CPUShares, limits.CPUQuota, limits.CPUPeriod)})
+}
+
+// containsString returns true if values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigPaths checks the CA certificates and registry configuration that
+// builds read, which are optional, but which can't be used if they're broken.
+func checkConfigPaths() []doctorResult {
+	var results []doctorResult
+	for _, path := range []string{
+		builder.SecretCertsMountPath + "/ca.crt",
+		builder.ConfigMapCertsMountPath + "/certs.d",
+		"/etc/pki/tls/certs",
+		"/etc/docker/certs.d",
+		"/etc/containers/registries.conf",
+		"/etc/containers/registries.d",
+		"/etc/containers/policy.json",
+	} {
+		results = append(results, checkConfigPath(path))
+	}
+
+	sysregistriesv2.InvalidateCache()
+	if _, err := sysregistriesv2.GetRegistries(&types.SystemContext{}); err != nil {
+		results = append(results, doctorResult{Check: "config", Name: "registries", Status: doctorFail, Message: fmt.Sprintf("error parsing the registries configuration: %v", err)})
+	} else {
+		results = append(results, doctorResult{Check: "config", Name: "registries", Status: doctorPass, Message: "parsed the registries configuration"})
+	}
+	return results
+}
+
+// checkConfigPath checks that path is readable, if it exists.  It's fine for
+// it not to exist, since all of them are optional.
+func checkConfigPath(path string) doctorResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return doctorResult{Check: "config", Name: path, Status: doctorPass, Message: "not present"}
+		}
+		return doctorResult{Check: "config", Name: path, Status: doctorFail, Message: err.Error()}
+	}
+	if info.IsDir() {
+		if _, err := os.ReadDir(path); err != nil {
+			return doctorResult{Check: "config", Name: path, Status: doctorFail, Message: err.Error()}
+		}
+		return doctorResult{Check: "config", Name: path, Status: doctorPass, Message: "readable directory"}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return doctorResult{Check: "config", Name: path, Status: doctorFail, Message: err.Error()}
+	}
+	f.Close()
+	return doctorResult{Check: "config", Name: path, Status: doctorPass, Message: "readable"}
+}
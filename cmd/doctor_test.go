@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDoctorReport(t *testing.T) {
+	cases := []struct {
+		description string
+		statuses    []string
+		expected    string
+	}{
+		{"no results", nil, doctorPass},
+		{"all passed", []string{doctorPass, doctorPass}, doctorPass},
+		{"warning", []string{doctorPass, doctorWarn, doctorPass}, doctorWarn},
+		{"failure after a warning", []string{doctorWarn, doctorFail, doctorWarn}, doctorFail},
+	}
+	for i := range cases {
+		t.Run(cases[i].description, func(t *testing.T) {
+			var results []doctorResult
+			for _, status := range cases[i].statuses {
+				results = append(results, doctorResult{Check: "test", Name: "test", Status: status})
+			}
+			assert.Equal(t, cases[i].expected, newDoctorReport(results).Status)
+		})
+	}
+}
+
+func TestWriteDoctorReport(t *testing.T) {
+	report := newDoctorReport([]doctorResult{
+		{Check: "storage", Name: "overlay", Status: doctorPass, Message: "initialized with options []"},
+		{Check: "isolation", Name: "chroot", Status: doctorWarn, Message: "missing CAP_SYS_CHROOT"},
+	})
+
+	var text bytes.Buffer
+	assert.NoError(t, writeDoctorReport(&text, report, "text"))
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	assert.Len(t, lines, 5)
+	assert.Equal(t, []string{"STATUS", "CHECK", "NAME", "MESSAGE"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"WARN", "isolation", "chroot", "missing", "CAP_SYS_CHROOT"}, strings.Fields(lines[2]))
+	assert.Equal(t, "Overall: WARN", lines[4])
+
+	var out bytes.Buffer
+	assert.NoError(t, writeDoctorReport(&out, report, "json"))
+	var decoded doctorReport
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, report, decoded)
+
+	assert.Error(t, writeDoctorReport(&out, report, "yaml"))
+}
+
+func TestCheckConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(file, []byte("certificate"), 0o644))
+
+	assert.Equal(t, doctorPass, checkConfigPath(dir).Status)
+	assert.Equal(t, doctorPass, checkConfigPath(file).Status)
+	assert.Equal(t, doctorResult{Check: "config", Name: filepath.Join(dir, "missing"), Status: doctorPass, Message: "not present"}, checkConfigPath(filepath.Join(dir, "missing")))
+}
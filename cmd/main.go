@@ -30,14 +30,6 @@ func main() {
 		return
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		fmt.Println("Error: received unexpected terminate signal")
-		os.Exit(1)
-	}()
-
 	defer serviceability.BehaviorOnPanic(os.Getenv("OPENSHIFT_ON_PANIC"), version.Get())()
 	defer serviceability.Profile(os.Getenv("OPENSHIFT_PROFILE")).Stop()
 
@@ -75,6 +67,18 @@ func main() {
 	basename := filepath.Base(os.Args[0])
 	command := CommandFor(basename)
 
+	// Builds watch for SIGTERM themselves, so that they can stop what they're
+	// doing and clean up after themselves.  Everything else just exits.
+	if !watchesForTermination(basename) {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			fmt.Println("Error: received unexpected terminate signal")
+			os.Exit(1)
+		}()
+	}
+
 	flags := flag.NewFlagSet(basename, flag.ExitOnError)
 	klog.InitFlags(flags)
 	pflags := command.Flags()
@@ -98,6 +102,18 @@ func main() {
 			installCAcerts()
 			logUserNamespaceIDMappings()
 			maybeReexecUsingUserNamespace(uidmap, useNewuidmap, gidmap, useNewgidmap)
+		case "openshift-local-build":
+			// There are no cluster CA certificates to install, so
+			// builds trust the same certificates that we do.
+			storeOptions, err := storage.DefaultStoreOptions()
+			kcmdutil.CheckErr(err)
+			os.MkdirAll(storeOptions.GraphRoot, 0775)
+			os.MkdirAll(storeOptions.RunRoot, 0775)
+			logUserNamespaceIDMappings()
+			maybeReexecUsingUserNamespace(uidmap, useNewuidmap, gidmap, useNewgidmap)
+		case "openshift-builder-doctor":
+			// Report on the CA certificates and ID mappings that we
+			// were started with, rather than setting them up first.
 		default:
 			if !strings.HasSuffix(basename, "-in-a-user-namespace") {
 				installCAcerts()
@@ -111,6 +127,16 @@ func main() {
 	os.Exit(code)
 }
 
+// watchesForTermination returns whether the command for this base name stops
+// gracefully when it receives SIGTERM.
+func watchesForTermination(basename string) bool {
+	switch strings.TrimSuffix(basename, "-in-a-user-namespace") {
+	case "openshift-sti-build", "openshift-docker-build", "openshift-git-clone", "openshift-extract-image-content", "openshift-local-build":
+		return true
+	}
+	return false
+}
+
 // CommandFor returns the appropriate command for this base name,
 // or the OpenShift CLI command.
 func CommandFor(basename string) *cobra.Command {
@@ -127,6 +153,10 @@ func CommandFor(basename string) *cobra.Command {
 		cmd = NewCommandManageDockerfile(basename)
 	case "openshift-extract-image-content", "openshift-extract-image-content-in-a-user-namespace":
 		cmd = NewCommandExtractImageContent(basename)
+	case "openshift-local-build", "openshift-local-build-in-a-user-namespace":
+		cmd = NewCommandLocalBuild(basename)
+	case "openshift-builder-doctor":
+		cmd = NewCommandDoctor(basename)
 	default:
 		fmt.Printf("unknown command name: %s\n", basename)
 		os.Exit(1)
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
@@ -93,6 +94,16 @@ func isNodeDefaultMapping(m []specs.LinuxIDMapping) bool {
 	return len(m) == 1 && m[0].ContainerID == 0 && m[0].HostID == 0 && m[0].Size == 0xffffffff
 }
 
+// formatIDMappings returns the ID map as a list of (container:host:size)
+// ranges.
+func formatIDMappings(m []specs.LinuxIDMapping) string {
+	ranges := make([]string, 0, len(m))
+	for _, entry := range m {
+		ranges = append(ranges, fmt.Sprintf("(%d:%d:%d)", entry.ContainerID, entry.HostID, entry.Size))
+	}
+	return "[" + strings.Join(ranges, ", ") + "]"
+}
+
 func logUserNamespaceIDMappings() {
 	// If we've already done all of this, there's no need to do it again.
 	if inOurUserNamespace() {
@@ -105,22 +116,7 @@ func logUserNamespaceIDMappings() {
 		klog.Fatalf("Error reading current ID mappings: %v\n", err)
 	}
 	if !isNodeDefaultMapping(UIDs) || !isNodeDefaultMapping(GIDs) {
-		uidMap, gidMap := "[", "["
-		for i, entry := range UIDs {
-			if i > 0 {
-				uidMap += ", "
-			}
-			uidMap += fmt.Sprintf("(%d:%d:%d)", entry.ContainerID, entry.HostID, entry.Size)
-		}
-		for i, entry := range GIDs {
-			if i > 0 {
-				gidMap += ", "
-			}
-			gidMap += fmt.Sprintf("(%d:%d:%d)", entry.ContainerID, entry.HostID, entry.Size)
-		}
-		uidMap += "]"
-		gidMap += "]"
-		klog.V(2).Infof("Started in kernel user namespace as %d:%d with UID map %s and GID map %s.", os.Getuid(), os.Getgid(), uidMap, gidMap)
+		klog.V(2).Infof("Started in kernel user namespace as %d:%d with UID map %s and GID map %s.", os.Getuid(), os.Getgid(), formatIDMappings(UIDs), formatIDMappings(GIDs))
 	} else {
 		klog.V(2).Infof("Started in node (default) kernel user namespace as %d:%d.", os.Getuid(), os.Getgid())
 	}
@@ -160,6 +156,21 @@ func maybeReexecUsingUserNamespace(uidmap string, useNewuidmap bool, gidmap stri
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+
+	// Pass along signals telling us to stop, so that the child can cancel
+	// the build and clean up after itself before we exit along with it.
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, syscall.SIGINT, syscall.SIGTERM)
+	cmd.Hook = func(int) error {
+		go func() {
+			for sig := range interrupted {
+				if err := cmd.Cmd.Process.Signal(sig); err != nil {
+					klog.Warningf("Failed to pass signal %v to the build: %v", sig, err)
+				}
+			}
+		}()
+		return nil
+	}
 	unshare.ExecRunnable(cmd, nil)
 	klog.Fatalf("Internal error: should not have gotten back from ExecRunnable().\n")
 }
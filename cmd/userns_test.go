@@ -50,3 +50,11 @@ func TestIsNodeDefaultMapping(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatIDMappings(t *testing.T) {
+	assert.Equal(t, "[]", formatIDMappings(nil))
+	assert.Equal(t, "[(0:1001:1), (1:100100:65536)]", formatIDMappings([]specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1001, Size: 1},
+		{ContainerID: 1, HostID: 100100, Size: 65536},
+	}))
+}
@@ -0,0 +1,490 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/buildah/pkg/blobcache"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// blobCacheLockFile is the name of the lock file which builds sharing
+	// a blob cache directory use to coordinate with each other.
+	blobCacheLockFile = "blobcache.lock"
+	// blobCacheGateFile is the name of the lock file which builds hold
+	// briefly while they take a shared lock on the cache, and which a
+	// build that's waiting to trim the cache holds so that no more builds
+	// can take shared locks until it's done.
+	blobCacheGateFile = "blobcache-gate.lock"
+)
+
+// BlobCache manages a directory in which copies of blobs are kept between
+// builds, which may be shared by several builder pods.  Pulls, pushes, and
+// builds which use the directory hold a shared lock on it while they run, and
+// once the directory grows past its maximum size, the least recently used
+// blobs are removed from it while holding an exclusive lock.  A nil BlobCache
+// is valid, and disables caching.
+type BlobCache struct {
+	directory string
+	maxSize   int64
+	lock      *lockfile.LockFile
+	gate      *lockfile.LockFile
+
+	statsLock sync.Mutex
+	hits      int
+	misses    int
+}
+
+// NewBlobCache returns a BlobCache for directory, creating the directory if
+// it doesn't exist.  If directory is empty, it returns nil, which disables
+// caching.  A maxSize of 0 or less leaves the size of the cache unbounded.
+func NewBlobCache(directory string, maxSize int64) (*BlobCache, error) {
+	if directory == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("error creating blob cache directory %q: %v", directory, err)
+	}
+	lock, err := lockfile.GetLockFile(filepath.Join(directory, blobCacheLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock for blob cache directory %q: %v", directory, err)
+	}
+	gate, err := lockfile.GetLockFile(filepath.Join(directory, blobCacheGateFile))
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock for blob cache directory %q: %v", directory, err)
+	}
+	return &BlobCache{
+		directory: directory,
+		maxSize:   maxSize,
+		lock:      lock,
+		gate:      gate,
+	}, nil
+}
+
+// Directory returns the location of the cache, or "" if caching is disabled.
+func (c *BlobCache) Directory() string {
+	if c == nil {
+		return ""
+	}
+	return c.directory
+}
+
+// Stats returns the number of layers which were and weren't found in the
+// cache by all of the operations which have used it so far.
+func (c *BlobCache) Stats() (hits, misses int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.hits, c.misses
+}
+
+// Use runs action while holding a shared lock on the cache, so that blobs
+// aren't evicted while it's reading or writing them.  The action returns the
+// IDs of the images in store whose layers it read or wrote, which we use to
+// count the layers that were already cached, and to mark them as recently
+// used.  Once the action completes, the cache is trimmed to its maximum size
+// if no other build is using it; otherwise that's left to Trim.
+func (c *BlobCache) Use(store storage.Store, operation string, action func() ([]string, error)) error {
+	if c == nil {
+		_, err := action()
+		return err
+	}
+
+	c.gate.RLock()
+	c.lock.RLock()
+	c.gate.Unlock()
+	before, err := c.entries()
+	if err != nil {
+		log.V(4).Infof("Error reading blob cache %q: %v", c.directory, err)
+	}
+	imageIDs, err := action()
+	if layers := imageLayerDigests(store, imageIDs); err == nil && before != nil && len(layers) > 0 {
+		hits, misses := c.account(layers, before)
+		log.V(0).Infof("Blob cache: %s found %d layers in the cache, %d were not cached.", operation, hits, misses)
+	}
+	c.lock.Unlock()
+
+	if err == nil {
+		c.evict()
+	}
+	return err
+}
+
+// blobCacheEntry is a blob in the cache, along with any files which hold
+// notes about it.
+type blobCacheEntry struct {
+	files    []string
+	size     int64
+	modTime  time.Time
+	haveBlob bool
+}
+
+// entries reads the cache directory, and groups the files in it by the
+// digest of the blob which they store or describe.  Files which aren't named
+// after a blob, like our lock file and temporary files which blobs are
+// written to before being renamed into place, are skipped.
+func (c *BlobCache) entries() (map[digest.Digest]*blobCacheEntry, error) {
+	dirEntries, err := os.ReadDir(c.directory)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[digest.Digest]*blobCacheEntry)
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() {
+			continue
+		}
+		name := dirEntry.Name()
+		d := digest.Digest(strings.SplitN(name, ".", 2)[0])
+		if d.Validate() != nil {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entry, ok := entries[d]
+		if !ok {
+			entry = &blobCacheEntry{}
+			entries[d] = entry
+		}
+		entry.files = append(entry.files, filepath.Join(c.directory, name))
+		entry.size += info.Size()
+		// Notes can be rewritten without the blob being used, so
+		// prefer the time from the blob itself when there is one.
+		if name == d.String() {
+			entry.modTime = info.ModTime()
+			entry.haveBlob = true
+		} else if !entry.haveBlob && info.ModTime().After(entry.modTime) {
+			entry.modTime = info.ModTime()
+		}
+	}
+	return entries, nil
+}
+
+// account counts the layers, each described by its possible digests, which
+// had at least one copy in the cache before an operation started as hits,
+// and the rest as misses.  Cached copies of layers which were hits, including
+// differently-compressed copies that the cache noted, are marked as recently
+// used.
+func (c *BlobCache) account(layers [][]digest.Digest, before map[digest.Digest]*blobCacheEntry) (hits, misses int) {
+	now := time.Now()
+	for _, digests := range layers {
+		hit := false
+		for _, d := range digests {
+			entry, ok := before[d]
+			if !ok {
+				continue
+			}
+			hit = true
+			related := []*blobCacheEntry{entry}
+			for _, file := range entry.files {
+				if !strings.HasSuffix(file, ".compressed") && !strings.HasSuffix(file, ".decompressed") {
+					continue
+				}
+				if note, err := os.ReadFile(file); err == nil {
+					if alternate, ok := before[digest.Digest(strings.TrimSpace(string(note)))]; ok {
+						related = append(related, alternate)
+					}
+				}
+			}
+			for _, entry := range related {
+				for _, file := range entry.files {
+					if err := os.Chtimes(file, now, now); err != nil && !os.IsNotExist(err) {
+						log.V(4).Infof("Error updating blob cache entry %q: %v", file, err)
+					}
+				}
+			}
+		}
+		if hit {
+			hits++
+		} else {
+			misses++
+		}
+	}
+
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	c.hits += hits
+	c.misses += misses
+	return hits, misses
+}
+
+// evict trims the cache to its maximum size if no other build is using it.
+// If another build is, we leave it alone, and try again after our next
+// operation, or when Trim is called at the end of the build.
+func (c *BlobCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	if err := c.lock.TryLock(); err != nil {
+		log.V(4).Infof("Blob cache %q is in use, not checking its size: %v", c.directory, err)
+		return
+	}
+	defer c.lock.Unlock()
+	c.trim()
+}
+
+// Trim trims the cache to its maximum size, waiting for other builds which
+// are using it to finish what they're doing first.  Builds which start using
+// the cache while we're waiting are held back until we're done, so that a
+// cache which some build is always using still gets trimmed.
+func (c *BlobCache) Trim() {
+	if c == nil || c.maxSize <= 0 {
+		return
+	}
+	if size, err := c.size(); err == nil && size <= c.maxSize {
+		return
+	}
+	c.gate.Lock()
+	defer c.gate.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.trim()
+}
+
+// size returns the total size of the blobs in the cache.
+func (c *BlobCache) size() (int64, error) {
+	entries, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+	return total, nil
+}
+
+// trim removes the least recently used blobs from the cache until it's no
+// larger than its maximum size.  The caller must hold an exclusive lock on
+// the cache.
+func (c *BlobCache) trim() {
+	entries, err := c.entries()
+	if err != nil {
+		log.V(0).Infof("Warning: error reading blob cache %q: %v", c.directory, err)
+		return
+	}
+	var total int64
+	sorted := make([]*blobCacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		total += entry.size
+		sorted = append(sorted, entry)
+	}
+	if total <= c.maxSize {
+		return
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].modTime.Before(sorted[j].modTime)
+	})
+	removed := 0
+	for _, entry := range sorted {
+		if total <= c.maxSize {
+			break
+		}
+		for _, file := range entry.files {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.V(0).Infof("Warning: error removing %q from blob cache: %v", file, err)
+			}
+		}
+		total -= entry.size
+		removed++
+	}
+	log.V(0).Infof("Blob cache: removed %d least recently used blobs, %d bytes remain cached.", removed, total)
+}
+
+// imageLayerDigests returns the digests which each of the layers of the
+// listed images could be stored under in the cache, both compressed and
+// uncompressed.  Images which can't be found are skipped.
+func imageLayerDigests(store storage.Store, imageIDs []string) [][]digest.Digest {
+	var layers [][]digest.Digest
+	seen := make(map[string]bool)
+	for _, imageID := range imageIDs {
+		image, err := store.Image(imageID)
+		if err != nil {
+			log.V(4).Infof("Error looking up image %q: %v", imageID, err)
+			continue
+		}
+		for layerID := image.TopLayer; layerID != "" && !seen[layerID]; {
+			seen[layerID] = true
+			layer, err := store.Layer(layerID)
+			if err != nil {
+				log.V(4).Infof("Error looking up layer %q: %v", layerID, err)
+				break
+			}
+			var digests []digest.Digest
+			for _, d := range []digest.Digest{layer.CompressedDigest, layer.UncompressedDigest} {
+				if d != "" {
+					digests = append(digests, d)
+				}
+			}
+			layers = append(layers, digests)
+			layerID = layer.Parent
+		}
+	}
+	return layers
+}
+
+// cachedCompressedCopies returns the digests of the cached copies of layers
+// which were compressed using algorithm, keyed by the digests of the layers
+// when they're uncompressed.  The cache notes only one compressed copy of
+// each uncompressed layer, which is replaced when a copy that was compressed
+// some other way is cached, but it never replaces the note which says what a
+// compressed copy decompresses to, so we use those notes, and check how each
+// copy was compressed ourselves.
+func cachedCompressedCopies(directory string, algorithm compression.Algorithm) map[digest.Digest]digest.Digest {
+	copies := make(map[digest.Digest]digest.Digest)
+	notes, err := filepath.Glob(filepath.Join(directory, "*.decompressed"))
+	if err != nil {
+		return copies
+	}
+	for _, note := range notes {
+		compressed := digest.Digest(strings.TrimSuffix(filepath.Base(note), ".decompressed"))
+		if compressed.Validate() != nil {
+			continue
+		}
+		contents, err := os.ReadFile(note)
+		if err != nil {
+			continue
+		}
+		uncompressed := digest.Digest(strings.TrimSpace(string(contents)))
+		if uncompressed.Validate() != nil {
+			continue
+		}
+		if _, ok := copies[uncompressed]; ok {
+			continue
+		}
+		f, err := os.Open(filepath.Join(directory, compressed.String()))
+		if err != nil {
+			continue
+		}
+		detected, _, _, err := compression.DetectCompressionFormat(f)
+		f.Close()
+		if err != nil || detected.Name() != algorithm.BaseVariantName() {
+			continue
+		}
+		copies[uncompressed] = compressed
+	}
+	return copies
+}
+
+// blobCacheSourceLookup returns a function which wraps the images that we push
+// in the blob cache in directory, so that cached copies of their layers which
+// were compressed using compressionFormat, or gzip if it's nil, are pushed in
+// place of compressing the layers again.  zstd:chunked copies need metadata
+// which the cache doesn't keep, so their layers are always compressed again.
+func blobCacheSourceLookup(directory string, compressionFormat *compression.Algorithm) func(types.ImageReference) (types.ImageReference, error) {
+	algorithm := compression.Gzip
+	if compressionFormat != nil {
+		algorithm = *compressionFormat
+	}
+	return func(ref types.ImageReference) (types.ImageReference, error) {
+		if directory == "" {
+			return ref, nil
+		}
+		// Ask the cache to leave the layers alone, since it can
+		// only substitute the one compressed copy that it noted.
+		cached, err := blobcache.NewBlobCache(ref, directory, types.PreserveOriginal)
+		if err != nil {
+			return nil, fmt.Errorf("error using blob cache %q: %v", directory, err)
+		}
+		if algorithm.Name() != compression.Gzip.Name() && algorithm.Name() != compression.Zstd.Name() {
+			return cached, nil
+		}
+		return &compressedBlobCacheReference{BlobCache: cached, directory: directory, algorithm: algorithm}, nil
+	}
+}
+
+// compressedBlobCacheReference is an image in the blob cache whose layers are
+// read from cached copies that were compressed using algorithm, when there
+// are any.
+type compressedBlobCacheReference struct {
+	blobcache.BlobCache
+	directory string
+	algorithm compression.Algorithm
+}
+
+func (r *compressedBlobCacheReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.BlobCache.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedBlobCacheSource{
+		ImageSource: src,
+		algorithm:   r.algorithm,
+		directory:   r.directory,
+		copies:      cachedCompressedCopies(r.directory, r.algorithm),
+	}, nil
+}
+
+// compressedBlobCacheSource substitutes cached compressed copies of layers
+// for the uncompressed layers of an image.  The cache reads the copies when
+// they're asked for.
+type compressedBlobCacheSource struct {
+	types.ImageSource
+	algorithm compression.Algorithm
+	directory string
+	copies    map[digest.Digest]digest.Digest
+}
+
+func (s *compressedBlobCacheSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	infos, err := s.ImageSource.LayerInfosForCopy(ctx, instanceDigest)
+	if err != nil || len(s.copies) == 0 {
+		return infos, err
+	}
+	replaced := make([]types.BlobInfo, 0, len(infos))
+	for _, info := range infos {
+		replaced = append(replaced, s.layerInfoForCopy(info))
+	}
+	return replaced, nil
+}
+
+// layerInfoForCopy returns info for a cached compressed copy of the layer
+// described by info, or info itself if there isn't one.
+func (s *compressedBlobCacheSource) layerInfoForCopy(info types.BlobInfo) types.BlobInfo {
+	compressed, ok := s.copies[info.Digest]
+	if !ok {
+		return info
+	}
+	var mediaType string
+	switch info.MediaType {
+	case imgspecv1.MediaTypeImageLayer:
+		mediaType = imgspecv1.MediaTypeImageLayerGzip
+		if s.algorithm.Name() == compression.Zstd.Name() {
+			mediaType = imgspecv1.MediaTypeImageLayerZstd
+		}
+	case manifest.DockerV2SchemaLayerMediaTypeUncompressed:
+		// docker manifests can only describe gzip-compressed layers
+		if s.algorithm.Name() != compression.Gzip.Name() {
+			return info
+		}
+		mediaType = manifest.DockerV2Schema2LayerMediaType
+	default:
+		return info
+	}
+	fileInfo, err := os.Stat(filepath.Join(s.directory, compressed.String()))
+	if err != nil {
+		return info
+	}
+	algorithm := s.algorithm
+	info.Digest = compressed
+	info.Size = fileInfo.Size()
+	info.MediaType = mediaType
+	info.CompressionOperation = types.Compress
+	info.CompressionAlgorithm = &algorithm
+	return info
+}
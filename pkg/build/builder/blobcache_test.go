@@ -0,0 +1,266 @@
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func writeCachedBlob(t *testing.T, dir, content string, age time.Duration) digest.Digest {
+	d := digest.FromString(content)
+	path := filepath.Join(dir, d.String())
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestBlobCacheDisabled(t *testing.T) {
+	cache, err := NewBlobCache("", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache != nil {
+		t.Fatalf("expected no cache when no directory is set, got %#v", cache)
+	}
+	if dir := cache.Directory(); dir != "" {
+		t.Errorf("expected no directory, got %q", dir)
+	}
+	called := false
+	expected := errors.New("failed")
+	err = cache.Use(nil, "pull", func() ([]string, error) {
+		called = true
+		return nil, expected
+	})
+	if !called {
+		t.Errorf("expected the action to be run")
+	}
+	if err != expected {
+		t.Errorf("expected error %v, got %v", expected, err)
+	}
+}
+
+func TestBlobCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldest := writeCachedBlob(t, dir, "oldest-blob", 3*time.Hour)
+	// notes about a blob are evicted along with it
+	if err := os.WriteFile(filepath.Join(dir, oldest.String()+".compressed"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	older := writeCachedBlob(t, dir, "older-blob", 2*time.Hour)
+	newer := writeCachedBlob(t, dir, "newer-blob", time.Hour)
+	newest := writeCachedBlob(t, dir, "newest-blob", 0)
+
+	cache.evict()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+	expected := []string{blobCacheLockFile, newer.String(), newest.String()}
+	for _, name := range expected {
+		found := false
+		for _, r := range remaining {
+			found = found || r == name
+		}
+		if !found {
+			t.Errorf("expected %q to remain in the cache, have %v", name, remaining)
+		}
+	}
+	for _, d := range []digest.Digest{oldest, older} {
+		for _, r := range remaining {
+			if strings.HasPrefix(r, d.String()) {
+				t.Errorf("expected %q to have been evicted, have %v", r, remaining)
+			}
+		}
+	}
+}
+
+func TestBlobCacheTrim(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir, int64(len("newest-blob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := writeCachedBlob(t, dir, "older-blob", time.Hour)
+	newest := writeCachedBlob(t, dir, "newest-blob", 0)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	used := make(chan error)
+	go func() {
+		used <- cache.Use(nil, "pull", func() ([]string, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+	}()
+	<-started
+
+	// another build is using the cache, so it's left alone
+	cache.evict()
+	if _, err := os.Stat(filepath.Join(dir, older.String())); err != nil {
+		t.Fatalf("expected the older blob to remain while the cache is in use: %v", err)
+	}
+
+	// but Trim waits for the other build to finish, then trims it
+	trimmed := make(chan struct{})
+	go func() {
+		cache.Trim()
+		close(trimmed)
+	}()
+	select {
+	case <-trimmed:
+		t.Fatalf("expected Trim to wait while the cache is in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-used; err != nil {
+		t.Fatal(err)
+	}
+	<-trimmed
+	if _, err := os.Stat(filepath.Join(dir, older.String())); !os.IsNotExist(err) {
+		t.Errorf("expected the older blob to have been evicted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, newest.String())); err != nil {
+		t.Errorf("expected the newest blob to remain: %v", err)
+	}
+}
+
+func TestBlobCacheAccount(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := writeCachedBlob(t, dir, "compressed-layer", time.Hour)
+	uncompressed := writeCachedBlob(t, dir, "uncompressed-layer", time.Hour)
+	note := filepath.Join(dir, uncompressed.String()+".compressed")
+	if err := os.WriteFile(note, []byte(compressed.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unused := writeCachedBlob(t, dir, "unused-layer", time.Hour)
+
+	before, err := cache.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 3 {
+		t.Fatalf("expected 3 cached blobs, got %d", len(before))
+	}
+
+	layers := [][]digest.Digest{
+		{uncompressed},
+		{digest.FromString("missing-compressed"), digest.FromString("missing-uncompressed")},
+	}
+	hits, misses := cache.account(layers, before)
+	if hits != 1 || misses != 1 {
+		t.Errorf("expected 1 hit and 1 miss, got %d hits and %d misses", hits, misses)
+	}
+	if totalHits, totalMisses := cache.Stats(); totalHits != 1 || totalMisses != 1 {
+		t.Errorf("expected totals of 1 hit and 1 miss, got %d hits and %d misses", totalHits, totalMisses)
+	}
+
+	recently := time.Now().Add(-time.Minute)
+	for _, d := range []digest.Digest{compressed, uncompressed} {
+		info, err := os.Stat(filepath.Join(dir, d.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ModTime().Before(recently) {
+			t.Errorf("expected %s to have been marked as recently used", d)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, unused.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().After(recently) {
+		t.Errorf("expected %s to not have been marked as recently used", unused)
+	}
+}
+
+// writeCompressedCopy caches a copy of content compressed using algorithm, and
+// notes what it decompresses to, the way the blob cache does.
+func writeCompressedCopy(t *testing.T, dir, content string, algorithm compression.Algorithm) digest.Digest {
+	var buf bytes.Buffer
+	w, err := compression.CompressStream(&buf, algorithm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d := digest.FromBytes(buf.Bytes())
+	if err := os.WriteFile(filepath.Join(dir, d.String()), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, d.String()+".decompressed"), []byte(digest.FromString(content).String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCachedCompressedCopies(t *testing.T) {
+	dir := t.TempDir()
+	uncompressed := writeCachedBlob(t, dir, "layer", time.Hour)
+	gzipped := writeCompressedCopy(t, dir, "layer", compression.Gzip)
+	zstdCompressed := writeCompressedCopy(t, dir, "layer", compression.Zstd)
+	// the cache only notes the copy which it saw last
+	if err := os.WriteFile(filepath.Join(dir, uncompressed.String()+".compressed"), []byte(zstdCompressed.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		algorithm compression.Algorithm
+		expected  digest.Digest
+		mediaType string
+	}{
+		{algorithm: compression.Gzip, expected: gzipped, mediaType: imgspecv1.MediaTypeImageLayerGzip},
+		{algorithm: compression.Zstd, expected: zstdCompressed, mediaType: imgspecv1.MediaTypeImageLayerZstd},
+	} {
+		copies := cachedCompressedCopies(dir, test.algorithm)
+		if len(copies) != 1 || copies[uncompressed] != test.expected {
+			t.Errorf("%s: expected %s to be the copy of %s, got %v", test.algorithm.Name(), test.expected, uncompressed, copies)
+		}
+		src := &compressedBlobCacheSource{algorithm: test.algorithm, directory: dir, copies: copies}
+		info := src.layerInfoForCopy(types.BlobInfo{Digest: uncompressed, Size: 5, MediaType: imgspecv1.MediaTypeImageLayer})
+		if info.Digest != test.expected || info.MediaType != test.mediaType || info.CompressionAlgorithm == nil || info.CompressionAlgorithm.Name() != test.algorithm.Name() {
+			t.Errorf("%s: unexpected layer info %#v", test.algorithm.Name(), info)
+		}
+		docker := src.layerInfoForCopy(types.BlobInfo{Digest: uncompressed, Size: 5, MediaType: manifest.DockerV2SchemaLayerMediaTypeUncompressed})
+		if substituted := docker.Digest != uncompressed; substituted != (test.algorithm.Name() == compression.Gzip.Name()) {
+			t.Errorf("%s: unexpected docker layer info %#v", test.algorithm.Name(), docker)
+		}
+	}
+	if copies := cachedCompressedCopies(dir, compression.Xz); len(copies) != 0 {
+		t.Errorf("expected no xz copies, got %v", copies)
+	}
+}
@@ -6,14 +6,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
+	"syscall"
 
 	istorage "github.com/containers/image/v5/storage"
 	"github.com/containers/image/v5/types"
 	"github.com/containers/storage"
 	"github.com/syndtr/gocapability/capability"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	restclient "k8s.io/client-go/rest"
@@ -49,7 +52,7 @@ func init() {
 }
 
 type builder interface {
-	Build(dockerClient bld.DockerClient, sock string, buildsClient buildclientv1.BuildInterface, build *buildapiv1.Build, cgLimits *s2iapi.CGroupLimits) error
+	Build(ctx context.Context, dockerClient bld.DockerClient, sock string, buildsClient buildclientv1.BuildInterface, build *buildapiv1.Build, cgLimits *s2iapi.CGroupLimits) error
 	Basename() string
 }
 
@@ -62,10 +65,13 @@ type builderConfig struct {
 	buildsClient    buildclientv1.BuildInterface
 	cleanup         func()
 	store           storage.Store
-	blobCache       string
+	blobCache       *bld.BlobCache
 }
 
-func newBuilderConfigFromEnvironment(out io.Writer, needsDocker bool, isolation, ociRuntime, storageDriver, storageOptions string) (*builderConfig, error) {
+// newBuilderConfigFromEnvironment returns the configuration for the build in
+// $BUILD.  Its status is updated using buildsClient, or, if that's nil, using
+// a client for the cluster that the build is running in.
+func newBuilderConfigFromEnvironment(out io.Writer, needsDocker bool, isolation, ociRuntime, storageDriver, storageOptions string, buildsClient buildclientv1.BuildInterface) (*builderConfig, error) {
 	cfg := &builderConfig{}
 	var err error
 
@@ -132,19 +138,37 @@ func newBuilderConfigFromEnvironment(out io.Writer, needsDocker bool, isolation,
 		if err != nil {
 			return nil, err
 		}
-		cfg.cleanup = func() {
-			if _, err := store.Shutdown(false); err != nil {
-				log.V(0).Infof("Error shutting down storage: %v", err)
-			}
-		}
 		istorage.Transport.SetStore(store)
 
 		// Default to using /var/cache/blobs as a blob cache, but allow its location
 		// to be changed by setting $BUILD_BLOBCACHE_DIR.  Setting the location to an
-		// empty value disables the cache.
-		cfg.blobCache = "/var/cache/blobs"
-		if blobCacheDir, isSet := os.LookupEnv("BUILD_BLOBCACHE_DIR"); isSet {
-			cfg.blobCache = blobCacheDir
+		// empty value disables the cache.  Its size is unbounded unless a limit is
+		// set using $BUILD_BLOBCACHE_MAX_SIZE.
+		blobCacheDir := "/var/cache/blobs"
+		if dir, isSet := os.LookupEnv("BUILD_BLOBCACHE_DIR"); isSet {
+			blobCacheDir = dir
+		}
+		var blobCacheMaxSize int64
+		if maxSize, ok := os.LookupEnv("BUILD_BLOBCACHE_MAX_SIZE"); ok && len(maxSize) > 0 {
+			quantity, err := resource.ParseQuantity(maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing BUILD_BLOBCACHE_MAX_SIZE %q: %v", maxSize, err)
+			}
+			blobCacheMaxSize = quantity.Value()
+		}
+		cfg.blobCache, err = bld.NewBlobCache(blobCacheDir, blobCacheMaxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.cleanup = func() {
+			if cfg.blobCache != nil {
+				hits, misses := cfg.blobCache.Stats()
+				log.V(0).Infof("Blob cache: %d layers were found in the cache, %d were not cached.", hits, misses)
+			}
+			if _, err := store.Shutdown(false); err != nil {
+				log.V(0).Infof("Error shutting down storage: %v", err)
+			}
 		}
 
 		imageOptimizationPolicy := buildapiv1.ImageOptimizationNone
@@ -172,16 +196,21 @@ func newBuilderConfigFromEnvironment(out io.Writer, needsDocker bool, isolation,
 		cfg.dockerEndpoint = "n/a"
 	}
 
+	if buildsClient != nil {
+		cfg.buildsClient = buildsClient
+		return cfg, nil
+	}
+
 	// buildsClient (KUBERNETES_SERVICE_HOST, KUBERNETES_SERVICE_PORT)
 	clientConfig, err := restclient.InClusterConfig()
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to the server: %v", err)
 	}
-	buildsClient, err := buildclientv1.NewForConfig(clientConfig)
+	clusterBuildsClient, err := buildclientv1.NewForConfig(clientConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get client: %v", err)
 	}
-	cfg.buildsClient = buildsClient.Builds(cfg.build.Namespace)
+	cfg.buildsClient = clusterBuildsClient.Builds(cfg.build.Namespace)
 
 	return cfg, nil
 }
@@ -265,8 +294,8 @@ func (c *builderConfig) addGitConfig(gitClient git.Repository, gitConfigFile str
 }
 
 // clone is responsible for cloning the source referenced in the buildconfig
-func (c *builderConfig) clone() error {
-	ctx := timing.NewContext(context.Background())
+func (c *builderConfig) clone(ctx context.Context) error {
+	ctx = timing.NewContext(ctx)
 	var sourceRev *buildapiv1.SourceRevision
 	defer func() {
 		c.build.Status.Stages = timing.GetStages(ctx)
@@ -286,9 +315,7 @@ func (c *builderConfig) clone() error {
 	buildDir := bld.InputContentPath
 	sourceInfo, err := bld.GitClone(ctx, gitClient, c.build.Spec.Source.Git, c.build.Spec.Revision, buildDir)
 	if err != nil {
-		c.build.Status.Phase = buildapiv1.BuildPhaseFailed
-		c.build.Status.Reason = buildapiv1.StatusReasonFetchSourceFailed
-		c.build.Status.Message = builderutil.StatusMessageFetchSourceFailed
+		bld.SetFailedStatus(ctx, c.build, buildapiv1.StatusReasonFetchSourceFailed, builderutil.StatusMessageFetchSourceFailed)
 		return err
 	}
 
@@ -304,6 +331,12 @@ func (c *builderConfig) clone() error {
 		return err
 	}
 
+	return c.checkContextDir(buildDir)
+}
+
+// checkContextDir returns an error, and marks the build as failed, if the
+// build's context directory isn't in the source in buildDir.
+func (c *builderConfig) checkContextDir(buildDir string) error {
 	if len(c.build.Spec.Source.ContextDir) > 0 {
 		if _, err := os.Stat(filepath.Join(buildDir, c.build.Spec.Source.ContextDir)); os.IsNotExist(err) {
 			err = fmt.Errorf("provided context directory does not exist: %s", c.build.Spec.Source.ContextDir)
@@ -313,36 +346,42 @@ func (c *builderConfig) clone() error {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (c *builderConfig) extractImageContent() error {
-	ctx := timing.NewContext(context.Background())
+func (c *builderConfig) extractImageContent(ctx context.Context) error {
+	ctx = timing.NewContext(ctx)
 	defer func() {
 		c.build.Status.Stages = timing.GetStages(ctx)
 		bld.HandleBuildStatusUpdate(c.build, c.buildsClient, nil)
 	}()
 
+	if err := bld.CheckSourceImagePolicy(c.build); err != nil {
+		c.build.Status.Phase = buildapiv1.BuildPhaseFailed
+		c.build.Status.Reason = builderutil.StatusReasonBaseImagePolicyViolation
+		c.build.Status.Message = builderutil.StatusMessageBaseImagePolicyViolation
+		return err
+	}
+
 	buildDir := bld.InputContentPath
 	err := bld.ExtractImageContent(ctx, c.dockerClient, c.store, buildDir, c.build, c.blobCache)
 	if err != nil {
-		c.build.Status.Phase = buildapiv1.BuildPhaseFailed
-		c.build.Status.Reason = buildapiv1.StatusReasonFetchImageContentFailed
-		c.build.Status.Message = builderutil.StatusMessageFetchImageContentFailed
+		bld.SetFailedStatus(ctx, c.build, buildapiv1.StatusReasonFetchImageContentFailed, builderutil.StatusMessageFetchImageContentFailed)
 	}
 	return err
 }
 
 // execute is responsible for running a build
-func (c *builderConfig) execute(b builder) error {
+func (c *builderConfig) execute(ctx context.Context, b builder) error {
 	cgLimits, err := bld.GetCGroupLimits()
 	if err != nil {
 		return fmt.Errorf("failed to retrieve cgroup limits: %v", err)
 	}
 	log.V(4).Infof("Running build with cgroup limits: %#v", *cgLimits)
 
-	if err := b.Build(c.dockerClient, c.dockerEndpoint, c.buildsClient, c.build, cgLimits); err != nil {
+	defer bld.ReportStorageUse(c.dockerClient)
+	defer c.blobCache.Trim()
+	if err := b.Build(ctx, c.dockerClient, c.dockerEndpoint, c.buildsClient, c.build, cgLimits); err != nil {
 		return fmt.Errorf("build error: %v", err)
 	}
 
@@ -356,30 +395,53 @@ func (c *builderConfig) execute(b builder) error {
 type dockerBuilder struct{}
 
 // Build starts a Docker build.
-func (dockerBuilder) Build(dockerClient bld.DockerClient, sock string, buildsClient buildclientv1.BuildInterface, build *buildapiv1.Build, cgLimits *s2iapi.CGroupLimits) error {
-	return bld.NewDockerBuilder(dockerClient, buildsClient, build, cgLimits).Build()
+func (dockerBuilder) Build(ctx context.Context, dockerClient bld.DockerClient, sock string, buildsClient buildclientv1.BuildInterface, build *buildapiv1.Build, cgLimits *s2iapi.CGroupLimits) error {
+	return bld.NewDockerBuilder(dockerClient, buildsClient, build, cgLimits).Build(ctx)
 }
 func (dockerBuilder) Basename() string { return "openshift-docker-builder" }
 
 type s2iBuilder struct{}
 
 // Build starts an S2I build.
-func (s2iBuilder) Build(dockerClient bld.DockerClient, sock string, buildsClient buildclientv1.BuildInterface, build *buildapiv1.Build, cgLimits *s2iapi.CGroupLimits) error {
-	return bld.NewS2IBuilder(dockerClient, sock, buildsClient, build, cgLimits).Build()
+func (s2iBuilder) Build(ctx context.Context, dockerClient bld.DockerClient, sock string, buildsClient buildclientv1.BuildInterface, build *buildapiv1.Build, cgLimits *s2iapi.CGroupLimits) error {
+	return bld.NewS2IBuilder(dockerClient, sock, buildsClient, build, cgLimits).Build(ctx)
 }
 
 func (s2iBuilder) Basename() string { return "openshift-sti-builder" }
 
+// newCancelContext returns a context which is cancelled when the build is
+// told to stop, either because it was cancelled or because it ran out of
+// time, and a function which stops watching for that.
+func newCancelContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// handleCancellation records that the build was cancelled if ctx was cancelled
+// before the step which returned err could finish, and returns the error that
+// the step should report.
+func (c *builderConfig) handleCancellation(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	c.build.Status.Phase = buildapiv1.BuildPhaseCancelled
+	c.build.Status.Reason = buildapiv1.StatusReasonCancelledBuild
+	c.build.Status.Message = builderutil.StatusMessageCancelledBuild
+	bld.HandleBuildStatusUpdate(c.build, c.buildsClient, nil)
+	return fmt.Errorf("build cancelled: %v", err)
+}
+
 func runBuild(out io.Writer, builder builder, isolation, ociRuntime, storageDriver, storageOptions string) error {
+	ctx, stop := newCancelContext()
+	defer stop()
 	logVersion(builder.Basename())
-	cfg, err := newBuilderConfigFromEnvironment(out, true, isolation, ociRuntime, storageDriver, storageOptions)
+	cfg, err := newBuilderConfigFromEnvironment(out, true, isolation, ociRuntime, storageDriver, storageOptions, nil)
 	if err != nil {
 		return err
 	}
 	if cfg.cleanup != nil {
 		defer cfg.cleanup()
 	}
-	return cfg.execute(builder)
+	return cfg.handleCancellation(ctx, cfg.execute(ctx, builder))
 }
 
 // RunDockerBuild creates a docker builder and runs its build
@@ -397,15 +459,17 @@ func RunS2IBuild(out io.Writer, isolation, ociRuntime, storageDriver, storageOpt
 // RunGitClone performs a git clone using the build defined in the environment
 func RunGitClone(out io.Writer) error {
 	serviceability.InitLogrusFromKlog()
+	ctx, stop := newCancelContext()
+	defer stop()
 	logVersion("openshift-git-clone")
-	cfg, err := newBuilderConfigFromEnvironment(out, false, "", "", "", "")
+	cfg, err := newBuilderConfigFromEnvironment(out, false, "", "", "", "", nil)
 	if err != nil {
 		return err
 	}
 	if cfg.cleanup != nil {
 		defer cfg.cleanup()
 	}
-	return cfg.clone()
+	return cfg.handleCancellation(ctx, cfg.clone(ctx))
 }
 
 // RunManageDockerfile manipulates the dockerfile for docker builds.
@@ -418,29 +482,31 @@ func RunGitClone(out io.Writer) error {
 func RunManageDockerfile(out io.Writer) error {
 	serviceability.InitLogrusFromKlog()
 	logVersion("openshift-manage-dockerfile")
-	cfg, err := newBuilderConfigFromEnvironment(out, false, "", "", "", "")
+	cfg, err := newBuilderConfigFromEnvironment(out, false, "", "", "", "", nil)
 	if err != nil {
 		return err
 	}
 	if cfg.cleanup != nil {
 		defer cfg.cleanup()
 	}
-	return bld.ManageDockerfile(bld.InputContentPath, cfg.build)
+	return bld.ManageDockerfile(bld.InputContentPath, cfg.build, cfg.buildsClient)
 }
 
 // RunExtractImageContent extracts files from existing images
 // into the build working directory.
 func RunExtractImageContent(out io.Writer) error {
 	serviceability.InitLogrusFromKlog()
+	ctx, stop := newCancelContext()
+	defer stop()
 	logVersion("openshift-extract-image-content")
-	cfg, err := newBuilderConfigFromEnvironment(out, true, "", "", "", "")
+	cfg, err := newBuilderConfigFromEnvironment(out, true, "", "", "", "", nil)
 	if err != nil {
 		return err
 	}
 	if cfg.cleanup != nil {
 		defer cfg.cleanup()
 	}
-	return cfg.extractImageContent()
+	return cfg.handleCancellation(ctx, cfg.extractImageContent(ctx))
 }
 
 // logVersion logs the version of openshift-builder.
@@ -0,0 +1,444 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	buildapiv1 "github.com/openshift/api/build/v1"
+	buildclientv1 "github.com/openshift/client-go/build/clientset/versioned/typed/build/v1"
+	"github.com/openshift/library-go/pkg/serviceability"
+	s2ifs "github.com/openshift/source-to-image/pkg/util/fs"
+
+	bld "github.com/openshift/builder/pkg/build/builder"
+	"github.com/openshift/builder/pkg/build/builder/cmd/dockercfg"
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// LocalBuildOptions describe a build which is run outside of a cluster.
+type LocalBuildOptions struct {
+	// BuildPath is the path of a file which contains the Build, in YAML
+	// or JSON.
+	BuildPath string
+	// Source is a directory which contains the build's source, or the URL
+	// of a git repository to clone it from, in place of the Build's
+	// source.  If it's empty, the Build's git source is used.
+	Source string
+	// SourceSecretDir, PullSecretDir and PushSecretDir are directories
+	// which hold the secrets that a build pod would have mounted: the
+	// source secret, and docker configurations for pulling and pushing
+	// images.
+	SourceSecretDir string
+	PullSecretDir   string
+	PushSecretDir   string
+	// Secrets, ConfigMaps and Volumes map the names of the build's
+	// secrets, config maps and volumes to directories which hold their
+	// contents, which the build finds where a build pod would have them
+	// mounted.
+	Secrets    map[string]string
+	ConfigMaps map[string]string
+	Volumes    map[string]string
+	// StatusPath is the file which status updates are written to, or "-"
+	// or "" for standard output.
+	StatusPath string
+
+	Isolation      string
+	OCIRuntime     string
+	StorageDriver  string
+	StorageOptions string
+}
+
+// localStatusUpdate is written each time the status of a local build is
+// updated.
+type localStatusUpdate struct {
+	Time     metav1.Time                `json:"time"`
+	Revision *buildapiv1.SourceRevision `json:"revision,omitempty"`
+	Status   buildapiv1.BuildStatus     `json:"status"`
+}
+
+// localBuildsClient is a BuildInterface for a build which isn't running in a
+// cluster.  It keeps the build to itself, and writes each update to its
+// status to out as a line of JSON.  Only Get and UpdateDetails, which are
+// used to update a build's status, can be called.
+type localBuildsClient struct {
+	buildclientv1.BuildInterface
+
+	lock  sync.Mutex
+	build *buildapiv1.Build
+	out   io.Writer
+}
+
+// newLocalBuildsClient returns a localBuildsClient for the build.
+func newLocalBuildsClient(build *buildapiv1.Build, out io.Writer) *localBuildsClient {
+	return &localBuildsClient{build: build.DeepCopy(), out: out}
+}
+
+func (c *localBuildsClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*buildapiv1.Build, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if name != c.build.Name {
+		return nil, fmt.Errorf("no build named %q, only %q", name, c.build.Name)
+	}
+	return c.build.DeepCopy(), nil
+}
+
+func (c *localBuildsClient) UpdateDetails(ctx context.Context, buildName string, build *buildapiv1.Build, opts metav1.UpdateOptions) (*buildapiv1.Build, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if buildName != c.build.Name {
+		return nil, fmt.Errorf("no build named %q, only %q", buildName, c.build.Name)
+	}
+	update := localStatusUpdate{
+		Time:     metav1.Now(),
+		Revision: build.Spec.Revision,
+		Status:   build.Status,
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(c.out, "%s\n", data); err != nil {
+		return nil, err
+	}
+	c.build = build.DeepCopy()
+	return c.build.DeepCopy(), nil
+}
+
+// readBuildFile reads a Build from a YAML or JSON file.  The file doesn't
+// need to give its apiVersion and kind.
+func readBuildFile(buildPath string) (*buildapiv1.Build, error) {
+	data, err := os.ReadFile(buildPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading build %q: %v", buildPath, err)
+	}
+	build := &buildapiv1.Build{}
+	obj, _, err := buildCodecFactory.UniversalDeserializer().Decode(data, nil, build)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing build %q: %v", buildPath, err)
+	}
+	if _, ok := obj.(*buildapiv1.Build); !ok {
+		return nil, fmt.Errorf("%q does not contain a build", buildPath)
+	}
+	if build.Name == "" {
+		build.Name = "local"
+	}
+	return build, nil
+}
+
+// setLocalSource replaces the build's source with a git repository, or, if
+// source is a directory, removes it, so that the directory can be used in
+// its place.  It returns true if source is a directory.
+func setLocalSource(build *buildapiv1.Build, source string) (bool, error) {
+	if source == "" {
+		if build.Spec.Source.Binary != nil {
+			return false, fmt.Errorf("the build's source is binary, a source directory is needed to run it locally")
+		}
+		return false, nil
+	}
+	build.Spec.Source.Binary = nil
+	if info, err := os.Stat(source); err == nil {
+		if !info.IsDir() {
+			return false, fmt.Errorf("source %q is not a directory or a git repository URL", source)
+		}
+		build.Spec.Source.Git = nil
+		build.Spec.Source.Type = buildapiv1.BuildSourceNone
+		return true, nil
+	}
+	gitSource := &buildapiv1.GitBuildSource{URI: source}
+	if build.Spec.Source.Git != nil {
+		// keep the ref and proxies that the build asked for
+		gitSource = build.Spec.Source.Git.DeepCopy()
+		gitSource.URI = source
+	}
+	build.Spec.Source.Git = gitSource
+	build.Spec.Source.Type = buildapiv1.BuildSourceGit
+	return false, nil
+}
+
+// localBuildVolumes returns the volumes that the build's strategy uses.
+func localBuildVolumes(build *buildapiv1.Build) []buildapiv1.BuildVolume {
+	switch {
+	case build.Spec.Strategy.DockerStrategy != nil:
+		return build.Spec.Strategy.DockerStrategy.Volumes
+	case build.Spec.Strategy.SourceStrategy != nil:
+		return build.Spec.Strategy.SourceStrategy.Volumes
+	}
+	return nil
+}
+
+// checkLocalInputs returns an error if the build needs secrets, config maps
+// or volumes, which a cluster would mount into its pod, and which the options
+// don't give directories for.
+func checkLocalInputs(build *buildapiv1.Build, options LocalBuildOptions) error {
+	var missing []string
+	for _, s := range build.Spec.Source.Secrets {
+		if _, ok := options.Secrets[s.Secret.Name]; !ok {
+			missing = append(missing, fmt.Sprintf("secret %q", s.Secret.Name))
+		}
+	}
+	for _, c := range build.Spec.Source.ConfigMaps {
+		if _, ok := options.ConfigMaps[c.ConfigMap.Name]; !ok {
+			missing = append(missing, fmt.Sprintf("config map %q", c.ConfigMap.Name))
+		}
+	}
+	for _, bv := range localBuildVolumes(build) {
+		if _, ok := options.Volumes[bv.Name]; !ok {
+			missing = append(missing, fmt.Sprintf("volume %q", bv.Name))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the build uses %s, which need directories to be given for them to run it locally", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// mountLocalInputs puts the directories given for the build's secrets and
+// config maps where the build expects them to be mounted, copying them so
+// that the build can read them the way it would read the files that the
+// kubelet mounts.  Volumes, which are mounted read-only into the build's
+// containers, are linked instead of being copied.
+func mountLocalInputs(build *buildapiv1.Build, options LocalBuildOptions) error {
+	copyInput := func(kind, name, src, dest string) error {
+		if info, err := os.Stat(src); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s %q: %q is not a directory", kind, name, src)
+		}
+		if err := os.MkdirAll(dest, 0700); err != nil {
+			return err
+		}
+		if overlap, err := pathsOverlap(src, dest); err != nil || overlap {
+			return fmt.Errorf("%s %q: %q can't contain, or be inside of, the build's working directory", kind, name, src)
+		}
+		if err := s2ifs.NewFileSystem().CopyContents(src, dest, func(path string) bool { return false }); err != nil {
+			return fmt.Errorf("error copying %s %q from %s: %v", kind, name, src, err)
+		}
+		return nil
+	}
+	for _, s := range build.Spec.Source.Secrets {
+		if err := copyInput("secret", s.Secret.Name, options.Secrets[s.Secret.Name], bld.PathForSecretBuildSource(s.Secret.Name)); err != nil {
+			return err
+		}
+	}
+	for _, c := range build.Spec.Source.ConfigMaps {
+		if err := copyInput("config map", c.ConfigMap.Name, options.ConfigMaps[c.ConfigMap.Name], bld.PathForConfigMapBuildSource(c.ConfigMap.Name)); err != nil {
+			return err
+		}
+	}
+	for _, bv := range localBuildVolumes(build) {
+		src, err := filepath.Abs(options.Volumes[bv.Name])
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(src); err != nil || !info.IsDir() {
+			return fmt.Errorf("volume %q: %q is not a directory", bv.Name, src)
+		}
+		dest := bld.PathForBuildVolumeSource(bv)
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		// volumes which use the same secret or config map share a path
+		if err := os.Symlink(src, dest); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("error mounting volume %q from %s: %v", bv.Name, src, err)
+		}
+	}
+	return nil
+}
+
+// pathsOverlap returns true if either of the directories is, or is inside
+// of, the other.
+func pathsOverlap(a, b string) (bool, error) {
+	var resolved []string
+	for _, path := range []string{a, b} {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return false, err
+		}
+		if path, err = filepath.EvalSymlinks(path); err != nil {
+			return false, err
+		}
+		resolved = append(resolved, path)
+	}
+	within := func(parent, child string) bool {
+		rel, err := filepath.Rel(parent, child)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return within(resolved[0], resolved[1]) || within(resolved[1], resolved[0]), nil
+}
+
+// localBuilder returns the builder for the build's strategy.
+func localBuilder(build *buildapiv1.Build) (builder, error) {
+	switch {
+	case build.Spec.Strategy.DockerStrategy != nil:
+		return dockerBuilder{}, nil
+	case build.Spec.Strategy.SourceStrategy != nil:
+		return s2iBuilder{}, nil
+	}
+	return nil, fmt.Errorf("only docker and source builds can be run locally")
+}
+
+// copySource copies the build's source from a directory, in place of
+// cloning it.
+func (c *builderConfig) copySource(dir string) error {
+	defer bld.HandleBuildStatusUpdate(c.build, c.buildsClient, nil)
+	buildDir := bld.InputContentPath
+	os.RemoveAll(buildDir)
+	os.MkdirAll(buildDir, 0777)
+	if err := s2ifs.NewFileSystem().CopyContents(dir, buildDir, func(path string) bool { return false }); err != nil {
+		c.build.Status.Phase = buildapiv1.BuildPhaseFailed
+		c.build.Status.Reason = buildapiv1.StatusReasonFetchSourceFailed
+		c.build.Status.Message = builderutil.StatusMessageFetchSourceFailed
+		return fmt.Errorf("error copying source from %s: %v", dir, err)
+	}
+	return c.checkContextDir(buildDir)
+}
+
+// runLocal runs each of the steps that a build pod would, one after another,
+// and records whether the build completed, failed, or was cancelled, since
+// there's no build controller to do that.
+func (c *builderConfig) runLocal(ctx context.Context, b builder, sourceDir string) error {
+	c.build.Status.Phase = buildapiv1.BuildPhaseRunning
+	now := metav1.Now()
+	c.build.Status.StartTimestamp = &now
+	bld.HandleBuildStatusUpdate(c.build, c.buildsClient, nil)
+
+	err := c.runLocalSteps(ctx, b, sourceDir)
+	switch {
+	case err == nil:
+		c.build.Status.Phase = buildapiv1.BuildPhaseComplete
+		c.build.Status.Reason = ""
+		c.build.Status.Message = ""
+	case c.build.Status.Phase != buildapiv1.BuildPhaseFailed && c.build.Status.Phase != buildapiv1.BuildPhaseCancelled:
+		c.build.Status.Phase = buildapiv1.BuildPhaseFailed
+		c.build.Status.Reason = buildapiv1.StatusReasonGenericBuildFailed
+		c.build.Status.Message = builderutil.StatusMessageGenericBuildFailed
+	}
+	bld.HandleBuildStatusUpdate(c.build, c.buildsClient, nil)
+	return err
+}
+
+// runLocalSteps fetches the build's source, prepares its Dockerfile, extracts
+// content from images, and then runs the build, which pushes the image that
+// it builds if the build has an output.
+func (c *builderConfig) runLocalSteps(ctx context.Context, b builder, sourceDir string) error {
+	if sourceDir != "" {
+		if err := c.copySource(sourceDir); err != nil {
+			return err
+		}
+	} else if err := c.clone(ctx); err != nil {
+		return err
+	}
+	if err := bld.ManageDockerfile(bld.InputContentPath, c.build, c.buildsClient); err != nil {
+		return err
+	}
+	if len(c.build.Spec.Source.Images) > 0 {
+		if err := c.extractImageContent(ctx); err != nil {
+			return err
+		}
+	}
+	return c.execute(ctx, b)
+}
+
+// setLocalEnv sets the environment variables which a build pod would have,
+// and which the build reads as it runs.
+func setLocalEnv(build *buildapiv1.Build, options LocalBuildOptions) error {
+	data, err := runtime.Encode(buildJSONCodec, build)
+	if err != nil {
+		return fmt.Errorf("error encoding build: %v", err)
+	}
+	env := map[string]string{"BUILD": string(data)}
+	if options.SourceSecretDir != "" {
+		env["SOURCE_SECRET_PATH"] = options.SourceSecretDir
+	}
+	if options.PullSecretDir != "" {
+		env[dockercfg.PullAuthType] = options.PullSecretDir
+	}
+	if options.PushSecretDir != "" {
+		env[dockercfg.PushAuthType] = options.PushSecretDir
+	}
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunLocalBuild runs a docker or S2I build from a Build in a file, without a
+// cluster, fetching its source, preparing its Dockerfile, extracting content
+// from images, building it, and pushing it, in this process.
+func RunLocalBuild(out io.Writer, options LocalBuildOptions) error {
+	serviceability.InitLogrusFromKlog()
+	ctx, stop := newCancelContext()
+	defer stop()
+	logVersion("openshift-local-build")
+
+	build, err := readBuildFile(options.BuildPath)
+	if err != nil {
+		return err
+	}
+	sourceIsDir, err := setLocalSource(build, options.Source)
+	if err != nil {
+		return err
+	}
+	b, err := localBuilder(build)
+	if err != nil {
+		return err
+	}
+	if err := checkLocalInputs(build, options); err != nil {
+		return err
+	}
+	if err := setLocalEnv(build, options); err != nil {
+		return err
+	}
+
+	// build pods get a working directory of their own, so we make one, too
+	workDir, err := os.MkdirTemp("", "openshift-local-build-")
+	if err != nil {
+		return fmt.Errorf("error creating a working directory for the build: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+	if sourceIsDir {
+		overlap, err := pathsOverlap(options.Source, workDir)
+		if err != nil {
+			return fmt.Errorf("error checking source %q: %v", options.Source, err)
+		}
+		if overlap {
+			return fmt.Errorf("source %q can't contain, or be inside of, the build's working directory %q", options.Source, workDir)
+		}
+	}
+	bld.SetBuildWorkDir(workDir)
+	bld.SetBuildInputMountDir(filepath.Join(workDir, "mounts"))
+	if err := mountLocalInputs(build, options); err != nil {
+		return err
+	}
+
+	statusOut := io.Writer(os.Stdout)
+	if options.StatusPath != "" && options.StatusPath != "-" {
+		f, err := os.OpenFile(options.StatusPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening status file: %v", err)
+		}
+		defer f.Close()
+		statusOut = f
+	}
+
+	cfg, err := newBuilderConfigFromEnvironment(out, true, options.Isolation, options.OCIRuntime, options.StorageDriver, options.StorageOptions, newLocalBuildsClient(build, statusOut))
+	if err != nil {
+		return err
+	}
+	if cfg.cleanup != nil {
+		defer cfg.cleanup()
+	}
+	sourceDir := ""
+	if sourceIsDir {
+		sourceDir = options.Source
+	}
+	return cfg.handleCancellation(ctx, cfg.runLocal(ctx, b, sourceDir))
+}
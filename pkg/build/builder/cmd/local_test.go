@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildv1 "github.com/openshift/api/build/v1"
+
+	bld "github.com/openshift/builder/pkg/build/builder"
+)
+
+func TestReadBuildFile(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name         string
+		contents     string
+		expectedName string
+		expectError  bool
+	}{
+		{
+			name: "yaml",
+			contents: `apiVersion: build.openshift.io/v1
+kind: Build
+metadata:
+  name: example
+spec:
+  strategy:
+    dockerStrategy: {}
+`,
+			expectedName: "example",
+		},
+		{
+			name: "no kind",
+			contents: `spec:
+  strategy:
+    sourceStrategy:
+      from:
+        kind: DockerImage
+        name: builder-image
+`,
+			expectedName: "local",
+		},
+		{
+			name:        "not a build",
+			contents:    "apiVersion: v1\nkind: Pod\n",
+			expectError: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "-")+".yaml")
+			if err := os.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			build, err := readBuildFile(path)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if build.Name != tc.expectedName {
+				t.Errorf("expected build %q, got %q", tc.expectedName, build.Name)
+			}
+		})
+	}
+}
+
+func TestSetLocalSource(t *testing.T) {
+	dir := t.TempDir()
+	gitBuild := func() *buildv1.Build {
+		return &buildv1.Build{
+			Spec: buildv1.BuildSpec{
+				CommonSpec: buildv1.CommonSpec{
+					Source: buildv1.BuildSource{
+						Type: buildv1.BuildSourceGit,
+						Git:  &buildv1.GitBuildSource{URI: "https://example.com/app.git", Ref: "v1"},
+					},
+				},
+			},
+		}
+	}
+	binaryBuild := &buildv1.Build{
+		Spec: buildv1.BuildSpec{
+			CommonSpec: buildv1.CommonSpec{
+				Source: buildv1.BuildSource{
+					Type:   buildv1.BuildSourceBinary,
+					Binary: &buildv1.BinaryBuildSource{},
+				},
+			},
+		},
+	}
+
+	build := gitBuild()
+	isDir, err := setLocalSource(build, dir)
+	if err != nil || !isDir {
+		t.Errorf("expected a directory source, got %v, %v", isDir, err)
+	}
+	if build.Spec.Source.Git != nil {
+		t.Errorf("expected the git source to be removed")
+	}
+
+	build = gitBuild()
+	isDir, err = setLocalSource(build, "https://example.com/fork.git")
+	if err != nil || isDir {
+		t.Errorf("expected a git source, got %v, %v", isDir, err)
+	}
+	if build.Spec.Source.Git.URI != "https://example.com/fork.git" || build.Spec.Source.Git.Ref != "v1" {
+		t.Errorf("expected the git URI to be replaced and the ref kept, got %#v", build.Spec.Source.Git)
+	}
+
+	build = gitBuild()
+	if isDir, err := setLocalSource(build, ""); err != nil || isDir {
+		t.Errorf("expected the build's own source to be kept, got %v, %v", isDir, err)
+	}
+
+	if _, err := setLocalSource(binaryBuild.DeepCopy(), ""); err == nil {
+		t.Errorf("expected an error for a binary build without a source directory")
+	}
+	if isDir, err := setLocalSource(binaryBuild.DeepCopy(), dir); err != nil || !isDir {
+		t.Errorf("expected a binary build to use a source directory, got %v, %v", isDir, err)
+	}
+}
+
+func TestCheckLocalInputs(t *testing.T) {
+	build := &buildv1.Build{}
+	build.Spec.Strategy.DockerStrategy = &buildv1.DockerBuildStrategy{}
+	if err := checkLocalInputs(build, LocalBuildOptions{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	withInputs := build.DeepCopy()
+	withInputs.Spec.Source.Secrets = []buildv1.SecretBuildSource{{Secret: corev1.LocalObjectReference{Name: "credentials"}}}
+	withInputs.Spec.Source.ConfigMaps = []buildv1.ConfigMapBuildSource{{ConfigMap: corev1.LocalObjectReference{Name: "settings"}}}
+	withInputs.Spec.Strategy.DockerStrategy.Volumes = []buildv1.BuildVolume{{Name: "cache"}}
+	err := checkLocalInputs(withInputs, LocalBuildOptions{})
+	for _, input := range []string{`secret "credentials"`, `config map "settings"`, `volume "cache"`} {
+		if err == nil || !strings.Contains(err.Error(), input) {
+			t.Errorf("expected an error about %s, got %v", input, err)
+		}
+	}
+
+	err = checkLocalInputs(withInputs, LocalBuildOptions{
+		Secrets:    map[string]string{"credentials": "/credentials"},
+		ConfigMaps: map[string]string{"settings": "/settings"},
+	})
+	if err == nil || strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), "config map") || !strings.Contains(err.Error(), `volume "cache"`) {
+		t.Errorf("expected an error about only the volume, got %v", err)
+	}
+
+	err = checkLocalInputs(withInputs, LocalBuildOptions{
+		Secrets:    map[string]string{"credentials": "/credentials"},
+		ConfigMaps: map[string]string{"settings": "/settings"},
+		Volumes:    map[string]string{"cache": "/cache"},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMountLocalInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, input := range []string{"credentials", "settings", "cache"} {
+		if err := os.MkdirAll(filepath.Join(dir, input), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, input, "key"), []byte(input), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bld.SetBuildInputMountDir(filepath.Join(dir, "mounts"))
+
+	build := &buildv1.Build{}
+	build.Spec.Source.Secrets = []buildv1.SecretBuildSource{{Secret: corev1.LocalObjectReference{Name: "credentials"}}}
+	build.Spec.Source.ConfigMaps = []buildv1.ConfigMapBuildSource{{ConfigMap: corev1.LocalObjectReference{Name: "settings"}}}
+	build.Spec.Strategy.DockerStrategy = &buildv1.DockerBuildStrategy{
+		Volumes: []buildv1.BuildVolume{{Name: "cache", Source: buildv1.BuildVolumeSource{Type: buildv1.BuildVolumeSourceTypeCSI}}},
+	}
+	err := mountLocalInputs(build, LocalBuildOptions{
+		Secrets:    map[string]string{"credentials": filepath.Join(dir, "credentials")},
+		ConfigMaps: map[string]string{"settings": filepath.Join(dir, "settings")},
+		Volumes:    map[string]string{"cache": filepath.Join(dir, "cache")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for input, path := range map[string]string{
+		"credentials": bld.PathForSecretBuildSource("credentials"),
+		"settings":    bld.PathForConfigMapBuildSource("settings"),
+		"cache":       bld.PathForBuildVolumeSource(build.Spec.Strategy.DockerStrategy.Volumes[0]),
+	} {
+		data, err := os.ReadFile(filepath.Join(path, "key"))
+		if err != nil || string(data) != input {
+			t.Errorf("expected %s to be mounted at %s, got %q, %v", input, path, data, err)
+		}
+	}
+
+	err = mountLocalInputs(build, LocalBuildOptions{
+		Secrets: map[string]string{"credentials": filepath.Join(dir, "missing")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("expected an error about a missing directory, got %v", err)
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"a", "a", true},
+		{"a", "a/b", true},
+		{"a/b", "a", true},
+		{"a", "c", false},
+		{"a/b", "c", false},
+	}
+	for _, tc := range cases {
+		overlap, err := pathsOverlap(filepath.Join(dir, tc.a), filepath.Join(dir, tc.b))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if overlap != tc.expected {
+			t.Errorf("expected %q and %q overlapping to be %v", tc.a, tc.b, tc.expected)
+		}
+	}
+}
+
+func TestLocalBuilder(t *testing.T) {
+	build := &buildv1.Build{}
+	build.Spec.Strategy.DockerStrategy = &buildv1.DockerBuildStrategy{}
+	if b, err := localBuilder(build); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if _, ok := b.(dockerBuilder); !ok {
+		t.Errorf("expected a docker builder, got %T", b)
+	}
+
+	build = &buildv1.Build{}
+	build.Spec.Strategy.SourceStrategy = &buildv1.SourceBuildStrategy{}
+	if b, err := localBuilder(build); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if _, ok := b.(s2iBuilder); !ok {
+		t.Errorf("expected an s2i builder, got %T", b)
+	}
+
+	build = &buildv1.Build{}
+	build.Spec.Strategy.CustomStrategy = &buildv1.CustomBuildStrategy{}
+	if _, err := localBuilder(build); err == nil {
+		t.Errorf("expected an error for a custom build")
+	}
+}
+
+func TestLocalBuildsClient(t *testing.T) {
+	build := &buildv1.Build{ObjectMeta: metav1.ObjectMeta{Name: "example"}}
+	out := &bytes.Buffer{}
+	client := newLocalBuildsClient(build, out)
+
+	if _, err := client.Get(context.TODO(), "other", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected an error getting a different build")
+	}
+
+	for _, phase := range []buildv1.BuildPhase{buildv1.BuildPhaseRunning, buildv1.BuildPhaseComplete} {
+		latest, err := client.Get(context.TODO(), "example", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		latest.Status.Phase = phase
+		if _, err := client.UpdateDetails(context.TODO(), "example", latest, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 status updates, got %d: %q", len(lines), out.String())
+	}
+	var update localStatusUpdate
+	if err := json.Unmarshal([]byte(lines[1]), &update); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if update.Status.Phase != buildv1.BuildPhaseComplete {
+		t.Errorf("expected the last update to be %q, got %q", buildv1.BuildPhaseComplete, update.Status.Phase)
+	}
+	if latest, _ := client.Get(context.TODO(), "example", metav1.GetOptions{}); latest.Status.Phase != buildv1.BuildPhaseComplete {
+		t.Errorf("expected the build to be updated, got %q", latest.Status.Phase)
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
 )
 
 const SSHPrivateKeyMethodName = "ssh-privatekey"
-const knownHostsFileName = "known_hosts"
 
 // SSHPrivateKey implements SCMAuth interface for using SSH private keys.
 type SSHPrivateKey struct{}
@@ -32,7 +33,7 @@ func (SSHPrivateKey) Setup(baseDir string, context SCMAuthContext) (string, erro
 	}
 	for _, file := range files {
 		switch {
-		case file.Name() == knownHostsFileName:
+		case file.Name() == builderutil.SSHKnownHostsFileName:
 			foundKnownHosts = true
 		case file.Name() == SSHPrivateKeyMethodName:
 			foundPrivateKey = true
@@ -47,7 +48,7 @@ func (SSHPrivateKey) Setup(baseDir string, context SCMAuthContext) (string, erro
 	if !foundKnownHosts {
 		content = content + " -o StrictHostKeyChecking=false \"$@\"\n"
 	} else {
-		content = content + " -o UserKnownHostsFile=" + filepath.Join(baseDir, knownHostsFileName) + " \"$@\"\n"
+		content = content + " -o UserKnownHostsFile=" + filepath.Join(baseDir, builderutil.SSHKnownHostsFileName) + " \"$@\"\n"
 	}
 	log.V(5).Infof("Adding Private SSH Auth:\n%s\n", content)
 
@@ -49,30 +49,76 @@ const (
 	// We cannot reuse the prefix "k8s" because we don't want the containers to
 	// be managed by a kubelet.
 	containerNamePrefix = "openshift"
+	// buildVolumeSuffix is a suffix for BuildVolume names
+	buildVolumeSuffix = "user-build-volume"
+)
+
+var (
+	// log is a placeholder until the builders pass an output stream down
+	// client facing libraries should not be using log
+	log = utillog.ToFile(os.Stderr, 2)
+
 	// configMapBuildSourceBaseMountPath is the path that the controller will have
 	// mounted configmap input content within the build pod
 	configMapBuildSourceBaseMountPath = "/var/run/configs/openshift.io/build"
 	// SecretBuildSourceBaseMountPath is the path that the controller will have
 	// mounted secret input content within the build pod
 	secretBuildSourceBaseMountPath = "/var/run/secrets/openshift.io/build"
-	// BuildWorkDirMount is the working directory within the build pod, mounted as a volume.
-	buildWorkDirMount = "/tmp/build"
 	// buildVolumeMountPath is where user defined BuildVolumes get mounted
 	buildVolumeMountPath = "/var/run/openshift.io/volumes"
-	// buildVolumeSuffix is a suffix for BuildVolume names
-	buildVolumeSuffix = "user-build-volume"
-)
 
-var (
-	// log is a placeholder until the builders pass an output stream down
-	// client facing libraries should not be using log
-	log = utillog.ToFile(os.Stderr, 2)
+	// buildWorkDirMount is the working directory within the build pod, mounted as a volume.
+	buildWorkDirMount = "/tmp/build"
 
 	// InputContentPath is the path at which the build inputs will be available
 	// to all the build containers.
 	InputContentPath = filepath.Join(buildWorkDirMount, "inputs")
 )
 
+// SetBuildWorkDir has the build keep its inputs, and what it records about its
+// source, under dir, in place of the working directory that build pods mount.
+// It has to be called before the build starts.
+func SetBuildWorkDir(dir string) {
+	buildWorkDirMount = dir
+	InputContentPath = filepath.Join(dir, "inputs")
+}
+
+// SetBuildInputMountDir has the build look for its secrets, config maps and
+// volumes in directories under dir, in place of where the controller mounts
+// them in build pods.  It has to be called before the build starts.
+func SetBuildInputMountDir(dir string) {
+	configMapBuildSourceBaseMountPath = filepath.Join(dir, "configs")
+	secretBuildSourceBaseMountPath = filepath.Join(dir, "secrets")
+	buildVolumeMountPath = filepath.Join(dir, "volumes")
+}
+
+// PathForSecretBuildSource returns the path in the builder container where
+// the secret build source with the name is mounted.
+func PathForSecretBuildSource(name string) string {
+	return filepath.Join(secretBuildSourceBaseMountPath, name)
+}
+
+// PathForConfigMapBuildSource returns the path in the builder container where
+// the config map build source with the name is mounted.
+func PathForConfigMapBuildSource(name string) string {
+	return filepath.Join(configMapBuildSourceBaseMountPath, name)
+}
+
+// SetFailedStatus records that the build failed for the reason, with the
+// message, unless ctx was cancelled.  Then the failure was most likely caused
+// by the build being told to stop, so it records that it was cancelled.
+func SetFailedStatus(ctx context.Context, build *buildapiv1.Build, reason buildapiv1.StatusReason, message string) {
+	if ctx.Err() != nil {
+		build.Status.Phase = buildapiv1.BuildPhaseCancelled
+		build.Status.Reason = buildapiv1.StatusReasonCancelledBuild
+		build.Status.Message = builderutil.StatusMessageCancelledBuild
+		return
+	}
+	build.Status.Phase = buildapiv1.BuildPhaseFailed
+	build.Status.Reason = reason
+	build.Status.Message = message
+}
+
 // KeyValue can be used to build ordered lists of key-value pairs.
 type KeyValue struct {
 	Key   string
@@ -242,6 +288,8 @@ func GetSourceRevision(build *buildapiv1.Build, sourceInfo *git.SourceInfo) *bui
 
 // HandleBuildStatusUpdate handles updating the build status
 // retries occur on update conflict and unreachable api server
+// the update doesn't use the build's context, so that a build which has been
+// cancelled can still record why it stopped
 func HandleBuildStatusUpdate(build *buildapiv1.Build, client buildclientv1.BuildInterface, sourceRev *buildapiv1.SourceRevision) {
 	var latestBuild *buildapiv1.Build
 	var err error
@@ -256,7 +304,7 @@ func HandleBuildStatusUpdate(build *buildapiv1.Build, client buildclientv1.Build
 	wait.ExponentialBackoff(updateBackoff, func() (bool, error) {
 		// before updating, make sure we are using the latest version of the build
 		if latestBuild == nil {
-			latestBuild, err = client.Get(context.TODO(), build.Name, metav1.GetOptions{})
+			latestBuild, err = client.Get(context.Background(), build.Name, metav1.GetOptions{})
 			if err != nil {
 				latestBuild = nil
 				return false, nil
@@ -278,7 +326,7 @@ func HandleBuildStatusUpdate(build *buildapiv1.Build, client buildclientv1.Build
 		latestBuild.Status.Output.To = build.Status.Output.To
 		latestBuild.Status.Stages = timing.AppendStageAndStepInfo(latestBuild.Status.Stages, build.Status.Stages)
 
-		_, err = client.UpdateDetails(context.TODO(), latestBuild.Name, latestBuild, metav1.UpdateOptions{})
+		_, err = client.UpdateDetails(context.Background(), latestBuild.Name, latestBuild, metav1.UpdateOptions{})
 
 		switch {
 		case err == nil:
@@ -298,10 +346,28 @@ func HandleBuildStatusUpdate(build *buildapiv1.Build, client buildclientv1.Build
 	}
 }
 
-// buildEnv converts the buildInfo output to a format that appendEnv can
+// imageBuildInfo returns the buildInfo which is recorded in the environment of
+// the image that build produces.  The name and namespace of the build change
+// every time it runs, so reproducible builds leave them out.
+func imageBuildInfo(build *buildapiv1.Build, sourceInfo *git.SourceInfo) []KeyValue {
+	bi := buildInfo(build, sourceInfo)
+	if !reproducibleBuild() {
+		return bi
+	}
+	kv := make([]KeyValue, 0, len(bi))
+	for _, item := range bi {
+		if item.Key == "OPENSHIFT_BUILD_NAME" || item.Key == "OPENSHIFT_BUILD_NAMESPACE" {
+			continue
+		}
+		kv = append(kv, item)
+	}
+	return kv
+}
+
+// buildEnv converts the imageBuildInfo output to a format that appendEnv can
 // consume.
 func buildEnv(build *buildapiv1.Build, sourceInfo *git.SourceInfo) []dockerfile.KeyValue {
-	bi := buildInfo(build, sourceInfo)
+	bi := imageBuildInfo(build, sourceInfo)
 	kv := make([]dockerfile.KeyValue, len(bi))
 	for i, item := range bi {
 		kv[i] = dockerfile.KeyValue{Key: item.Key, Value: item.Value}
@@ -383,6 +449,79 @@ func readSourceInfo() (*git.SourceInfo, error) {
 	return sourceInfo, nil
 }
 
+// gitDateLayout is the default format that git uses for dates, and which we
+// record in sourceinfo.json.
+const gitDateLayout = "Mon Jan 2 15:04:05 2006 -0700"
+
+// reproducibleBuild returns whether the build is meant to produce the same
+// image every time that it's run with the same inputs.
+func reproducibleBuild() bool {
+	if os.Getenv(builderutil.SourceDateEpoch) != "" {
+		return true
+	}
+	reproducible, _ := strconv.ParseBool(os.Getenv(builderutil.BuildReproducible))
+	return reproducible
+}
+
+// sourceDateEpoch returns the time that a reproducible build should use for
+// all of the timestamps in the image that it produces, or nil if the build
+// isn't meant to be reproducible.  An explicit $SOURCE_DATE_EPOCH is used if
+// one is set, otherwise the date of the commit being built is used.
+func sourceDateEpoch() (*time.Time, error) {
+	if epoch, ok := os.LookupEnv(builderutil.SourceDateEpoch); ok && epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s %q: %v", builderutil.SourceDateEpoch, epoch, err)
+		}
+		timestamp := time.Unix(seconds, 0).UTC()
+		return &timestamp, nil
+	}
+	if !reproducibleBuild() {
+		return nil, nil
+	}
+	sourceInfo, err := readSourceInfo()
+	if err != nil {
+		return nil, err
+	}
+	if sourceInfo == nil || sourceInfo.Date == "" {
+		return nil, fmt.Errorf("reproducible builds need the date of a git commit, or %s to be set", builderutil.SourceDateEpoch)
+	}
+	return parseSourceDate(sourceInfo.Date)
+}
+
+// buildTarget returns the name of the Dockerfile stage which a Docker build
+// should build, or "" if it should build the last stage.
+func buildTarget() string {
+	return strings.TrimSpace(os.Getenv(builderutil.BuildTarget))
+}
+
+// useSecretMounts returns whether secrets which are listed as build sources
+// should only be made available to RUN --mount=type=secret instructions in a
+// Dockerfile, instead of being copied into the build context.
+func useSecretMounts() bool {
+	secretMounts, _ := strconv.ParseBool(os.Getenv(builderutil.BuildSecretMounts))
+	return secretMounts
+}
+
+// forwardSSHKey returns whether the SSH private key in the build's source
+// secret should be made available to RUN --mount=type=ssh instructions in a
+// Dockerfile.
+func forwardSSHKey() bool {
+	forward, _ := strconv.ParseBool(os.Getenv(builderutil.BuildSSHForward))
+	return forward
+}
+
+// parseSourceDate parses the date of a commit, as recorded by GitClone.
+func parseSourceDate(date string) (*time.Time, error) {
+	for _, layout := range []string{gitDateLayout, time.RFC3339} {
+		if timestamp, err := time.Parse(layout, strings.TrimSpace(date)); err == nil {
+			timestamp = timestamp.UTC()
+			return &timestamp, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to parse commit date %q", date)
+}
+
 // addBuildParameters checks if a Image is set to replace the default base image.
 // If that's the case then change the Dockerfile to make the build with the given image.
 // Also append the environment variables and labels in the Dockerfile.
@@ -413,6 +552,15 @@ func addBuildParameters(dir string, build *buildapiv1.Build, sourceInfo *git.Sou
 		}
 	}
 
+	// Drop the stages after the target stage, so that the changes we
+	// make to the last stage are made to the target stage.
+	target := buildTarget()
+	if len(target) > 0 {
+		if err := truncateToStage(node, target); err != nil {
+			return err
+		}
+	}
+
 	// Update base image if build strategy specifies the From field.
 	if build.Spec.Strategy.DockerStrategy != nil && build.Spec.Strategy.DockerStrategy.From != nil && build.Spec.Strategy.DockerStrategy.From.Kind == "DockerImage" {
 		// Reduce the name to a minimal canonical form for the daemon
@@ -434,7 +582,7 @@ func addBuildParameters(dir string, build *buildapiv1.Build, sourceInfo *git.Sou
 	}
 
 	// Append post commit
-	if err := appendPostCommit(node, buildPostCommit(build.Spec.PostCommit)); err != nil {
+	if err := appendPostCommit(node, buildPostCommit(build.Spec.PostCommit), target); err != nil {
 		return err
 	}
 
@@ -502,7 +650,9 @@ func replaceImagesFromSource(node *parser.Node, imageSources []buildapiv1.ImageS
 }
 
 // findReferencedImages returns all qualified images referenced by the Dockerfile, or returns an error.
-func findReferencedImages(dockerfilePath string, buildArgs []corev1.EnvVar) ([]string, error) {
+// If target names a stage, only the images which that stage and the stages that it depends on
+// reference are returned.
+func findReferencedImages(dockerfilePath string, buildArgs []corev1.EnvVar, target string) ([]string, error) {
 	if len(dockerfilePath) == 0 {
 		return nil, nil
 	}
@@ -510,27 +660,24 @@ func findReferencedImages(dockerfilePath string, buildArgs []corev1.EnvVar) ([]s
 	if err != nil {
 		return nil, err
 	}
-	images := sets.NewString()
-	headerArgs := dockerfile.HeaderArgs(node)
-	buildArgMap := make(map[string]string)
-	for _, arg := range headerArgs {
-		kv := strings.SplitN(arg, "=", 2)
-		if len(kv) == 2 {
-			buildArgMap[kv[0]] = kv[1]
-		}
-	}
-	for _, ba := range buildArgs {
-		buildArgMap[ba.Name] = ba.Value
-	}
+	buildArgMap := dockerfileArgs(node, buildArgs)
 	stages, err := imagebuilder.NewStages(node, imagebuilder.NewBuilder(buildArgMap))
 	if err != nil {
 		return nil, err
 	}
-	var argsSlice []string
-	for k, v := range buildArgMap {
-		argsSlice = append(argsSlice, fmt.Sprintf("%s=%s", k, v))
+	argsSlice := argsAsSlice(buildArgMap)
+	// the images that each stage references, and the earlier stages
+	// that it uses
+	stageImages := make([][]string, len(stages))
+	stageDeps := make([][]int, len(stages))
+	knownAliases := make(map[string]int)
+	reference := func(nthStage int, image string) {
+		if dep, alias := knownAliases[canonicalStageName(image)]; alias {
+			stageDeps[nthStage] = append(stageDeps[nthStage], dep)
+		} else {
+			stageImages[nthStage] = append(stageImages[nthStage], image)
+		}
 	}
-	knownAliases := make(map[string]struct{})
 	for nthStage, stage := range stages {
 		for _, child := range stage.Node.Children {
 			switch {
@@ -539,11 +686,9 @@ func findReferencedImages(dockerfilePath string, buildArgs []corev1.EnvVar) ([]s
 				if err != nil {
 					return nil, err
 				}
-				if _, alias := knownAliases[image]; !alias {
-					images.Insert(image)
-				}
-				if child.Next != nil && child.Next.Next != nil && strings.ToUpper(child.Next.Next.Value) == "AS" && child.Next.Next.Next != nil {
-					knownAliases[child.Next.Next.Next.Value] = struct{}{}
+				reference(nthStage, image)
+				if name := stageName(child); name != "" {
+					knownAliases[name] = nthStage
 				}
 			case child.Value == dockercmd.Copy:
 				if ref, ok := nodeHasFromRef(child); ok && len(ref) > 0 {
@@ -551,17 +696,65 @@ func findReferencedImages(dockerfilePath string, buildArgs []corev1.EnvVar) ([]s
 					if err != nil {
 						return nil, err
 					}
-					if _, alias := knownAliases[image]; !alias {
-						images.Insert(image)
-					}
+					reference(nthStage, image)
 				}
 			}
 		}
-		knownAliases[strconv.Itoa(nthStage)] = struct{}{}
+		knownAliases[strconv.Itoa(nthStage)] = nthStage
+	}
+
+	images := sets.NewString()
+	if len(target) == 0 {
+		for _, referenced := range stageImages {
+			images.Insert(referenced...)
+		}
+		return images.List(), nil
+	}
+	targetStage, ok := knownAliases[canonicalStageName(target)]
+	if !ok {
+		return nil, fmt.Errorf("target stage %q was not found in the Dockerfile", target)
+	}
+	visited := make(map[int]bool)
+	pending := []int{targetStage}
+	for len(pending) > 0 {
+		nthStage := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[nthStage] {
+			continue
+		}
+		visited[nthStage] = true
+		images.Insert(stageImages[nthStage]...)
+		pending = append(pending, stageDeps[nthStage]...)
 	}
 	return images.List(), nil
 }
 
+// dockerfileArgs returns the values of the arguments which are declared before
+// the first stage of a Dockerfile, overridden by the build's arguments.
+func dockerfileArgs(node *parser.Node, buildArgs []corev1.EnvVar) map[string]string {
+	buildArgMap := make(map[string]string)
+	for _, arg := range dockerfile.HeaderArgs(node) {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 2 {
+			buildArgMap[kv[0]] = kv[1]
+		}
+	}
+	for _, ba := range buildArgs {
+		buildArgMap[ba.Name] = ba.Value
+	}
+	return buildArgMap
+}
+
+// argsAsSlice returns arguments in the "name=value" form which
+// imagebuilder.ProcessWord expects.
+func argsAsSlice(args map[string]string) []string {
+	var argsSlice []string
+	for k, v := range args {
+		argsSlice = append(argsSlice, fmt.Sprintf("%s=%s", k, v))
+	}
+	return argsSlice
+}
+
 func overwriteFile(name string, out []byte) error {
 	f, err := os.OpenFile(name, os.O_TRUNC|os.O_WRONLY, 0)
 	if err != nil {
@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -9,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/MakeNowJust/heredoc"
 
@@ -19,6 +21,7 @@ import (
 	buildapiv1 "github.com/openshift/api/build/v1"
 	"github.com/openshift/library-go/pkg/git"
 
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
 	"github.com/openshift/builder/pkg/build/builder/util/dockerfile"
 )
 
@@ -123,6 +126,68 @@ func TestContainerName(t *testing.T) {
 	}
 }
 
+func TestSourceDateEpoch(t *testing.T) {
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.SourceDateEpoch)
+	defer func() {
+		if preserveSet {
+			os.Setenv(builderutil.SourceDateEpoch, preserveEnv)
+		} else {
+			os.Unsetenv(builderutil.SourceDateEpoch)
+		}
+	}()
+
+	os.Setenv(builderutil.SourceDateEpoch, "1700000000")
+	timestamp, err := sourceDateEpoch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp == nil || !timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("expected %v, got %v", time.Unix(1700000000, 0).UTC(), timestamp)
+	}
+
+	os.Setenv(builderutil.SourceDateEpoch, "yesterday")
+	if _, err := sourceDateEpoch(); err == nil {
+		t.Errorf("expected an error parsing an invalid %s", builderutil.SourceDateEpoch)
+	}
+}
+
+func TestSetFailedStatus(t *testing.T) {
+	build := &buildapiv1.Build{}
+	SetFailedStatus(context.Background(), build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessagePushImageToRegistryFailed)
+	if build.Status.Phase != buildapiv1.BuildPhaseFailed || build.Status.Reason != buildapiv1.StatusReasonPushImageToRegistryFailed || build.Status.Message != builderutil.StatusMessagePushImageToRegistryFailed {
+		t.Errorf("expected a failed push, got %q %q %q", build.Status.Phase, build.Status.Reason, build.Status.Message)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	build = &buildapiv1.Build{}
+	SetFailedStatus(ctx, build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessagePushImageToRegistryFailed)
+	if build.Status.Phase != buildapiv1.BuildPhaseCancelled || build.Status.Reason != buildapiv1.StatusReasonCancelledBuild || build.Status.Message != builderutil.StatusMessageCancelledBuild {
+		t.Errorf("expected a cancelled build, got %q %q %q", build.Status.Phase, build.Status.Reason, build.Status.Message)
+	}
+}
+
+func TestParseSourceDate(t *testing.T) {
+	expected := time.Date(2023, time.November, 14, 22, 13, 20, 0, time.UTC)
+	for _, date := range []string{
+		"Tue Nov 14 23:13:20 2023 +0100",
+		"Tue Nov 14 22:13:20 2023 +0000\n",
+		"2023-11-14T22:13:20Z",
+	} {
+		timestamp, err := parseSourceDate(date)
+		if err != nil {
+			t.Errorf("%q: %v", date, err)
+			continue
+		}
+		if !timestamp.Equal(expected) || timestamp.Location() != time.UTC {
+			t.Errorf("%q: expected %v, got %v", date, expected, timestamp)
+		}
+	}
+	if _, err := parseSourceDate("last tuesday"); err == nil {
+		t.Errorf("expected an error parsing an invalid date")
+	}
+}
+
 func TestBuildPostCommit(t *testing.T) {
 	tests := []struct {
 		postCommit buildapiv1.BuildPostCommitSpec
@@ -549,6 +614,52 @@ func Test_addBuildParameters(t *testing.T) {
 	}
 }
 
+func TestReproducibleBuildParameters(t *testing.T) {
+	for _, name := range []string{builderutil.BuildReproducible, builderutil.SourceDateEpoch} {
+		preserveEnv, preserveSet := os.LookupEnv(name)
+		defer func(name string) {
+			if preserveSet {
+				os.Setenv(name, preserveEnv)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+	os.Unsetenv(builderutil.SourceDateEpoch)
+	os.Setenv(builderutil.BuildReproducible, "true")
+
+	var dockerfiles []string
+	for _, name := range []string{"app-1", "app-2"} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\nRUN echo hello\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		build := &buildapiv1.Build{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: name + "-namespace"}}
+		build.Spec.Source.Git = &buildapiv1.GitBuildSource{URI: "https://example.com/app.git"}
+		build.Spec.Strategy.DockerStrategy = &buildapiv1.DockerBuildStrategy{}
+		sourceInfo := &git.SourceInfo{CommitID: "abc123"}
+		if err := addBuildParameters(dir, build, sourceInfo); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.ReadFile(filepath.Join(dir, "Dockerfile"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dockerfiles = append(dockerfiles, string(out))
+	}
+	if dockerfiles[0] != dockerfiles[1] {
+		t.Errorf("expected builds with different names to produce the same Dockerfile, got:\n%s\nand:\n%s", dockerfiles[0], dockerfiles[1])
+	}
+	for _, name := range []string{"OPENSHIFT_BUILD_NAME", "OPENSHIFT_BUILD_NAMESPACE", "io.openshift.build.name", "io.openshift.build.namespace"} {
+		if strings.Contains(dockerfiles[0], `"`+name+`"`) {
+			t.Errorf("expected %q to be left out of a reproducible build, got:\n%s", name, dockerfiles[0])
+		}
+	}
+	if !strings.Contains(dockerfiles[0], "OPENSHIFT_BUILD_COMMIT") {
+		t.Errorf("expected the commit to be recorded, got:\n%s", dockerfiles[0])
+	}
+}
+
 func Test_findReferencedImages(t *testing.T) {
 	type want struct {
 		Images []string
@@ -556,6 +667,7 @@ func Test_findReferencedImages(t *testing.T) {
 	}
 	tests := []struct {
 		original string
+		target   string
 		want     want
 	}{
 		{
@@ -655,6 +767,47 @@ func Test_findReferencedImages(t *testing.T) {
 				Images: []string{"3", "other:", "other:h", "testImage"},
 			},
 		},
+		{
+			original: heredoc.Doc(`
+				FROM golang AS builder
+				RUN make
+				FROM builder AS test
+				COPY --from=testdata /a /b
+				RUN make test
+				FROM ubi-minimal AS release
+				COPY --from=builder /bin/app /bin/app
+				COPY --from=0 /bin/app /bin/app2
+				FROM debugger
+				COPY --from=release /bin/app /bin/app
+				`),
+			target: "release",
+			want: want{
+				Images: []string{"golang", "ubi-minimal"},
+			},
+		},
+		{
+			original: heredoc.Doc(`
+				FROM golang AS Builder
+				FROM ubi-minimal AS Release
+				COPY --from=BUILDER /bin/app /bin/app
+				FROM debugger
+				COPY --from=release /bin/app /bin/app
+				`),
+			target: "RELEASE",
+			want: want{
+				Images: []string{"golang", "ubi-minimal"},
+			},
+		},
+		{
+			original: heredoc.Doc(`
+				FROM golang AS builder
+				FROM ubi-minimal AS release
+				`),
+			target: "debug",
+			want: want{
+				Err: true,
+			},
+		},
 	}
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
@@ -671,7 +824,7 @@ func Test_findReferencedImages(t *testing.T) {
 			if _, err := dockerfile.Parse(strings.NewReader(test.original)); err != nil {
 				t.Fatal(err)
 			}
-			images, err := findReferencedImages(f.Name(), nil)
+			images, err := findReferencedImages(f.Name(), nil, test.target)
 			got := want{
 				Images: images,
 				Err:    err != nil,
@@ -4,30 +4,52 @@
 package builder
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	goruntime "runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/containers/buildah"
 	"github.com/containers/buildah/imagebuildah"
+	"github.com/containers/buildah/pkg/binfmt"
+	"github.com/containers/buildah/pkg/parse"
+	"github.com/containers/buildah/pkg/sshagent"
 	"github.com/containers/buildah/util"
+	"github.com/containers/common/libimage"
+	"github.com/containers/common/libimage/manifests"
+	cp "github.com/containers/image/v5/copy"
+	idocker "github.com/containers/image/v5/docker"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
 	ireference "github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/pkg/compression"
 	"github.com/containers/image/v5/pkg/docker/config"
+	istorage "github.com/containers/image/v5/storage"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/kubernetes/pkg/credentialprovider"
@@ -75,6 +97,254 @@ func dropCapabilities() []string {
 	return dropCapabilities
 }
 
+// BuildPlatform is an os/arch[/variant] platform which a build produces an
+// image for.
+type BuildPlatform struct {
+	OS, Arch, Variant string
+}
+
+func (p BuildPlatform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Arch + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Arch
+}
+
+// platformsFromEnv parses the list of platforms that the build should target
+// from the environment.  An empty list means that the build should target the
+// platform that we're running on.
+func platformsFromEnv() ([]BuildPlatform, error) {
+	var platforms []BuildPlatform
+	if platformList, ok := os.LookupEnv(buildutil.BuildPlatforms); ok && platformList != "" {
+		for _, platform := range strings.Split(platformList, ",") {
+			platform = strings.TrimSpace(platform)
+			if platform == "" {
+				continue
+			}
+			platformOS, arch, variant, err := parse.Platform(platform)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s: %v", buildutil.BuildPlatforms, err)
+			}
+			platforms = append(platforms, BuildPlatform{OS: platformOS, Arch: arch, Variant: variant})
+		}
+	}
+	return platforms, nil
+}
+
+// imageFormatFromEnv returns the manifest type that the build should produce
+// and push, based on the environment.  Docker v2s2 remains the default.
+func imageFormatFromEnv() (string, error) {
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv(buildutil.BuildImageFormat))); format {
+	case "", "docker":
+		return buildah.Dockerv2ImageManifest, nil
+	case "oci":
+		return buildah.OCIv1ImageManifest, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s %q, expected \"oci\" or \"docker\"", buildutil.BuildImageFormat, format)
+	}
+}
+
+// daemonlessNetwork is the network access that RUN instructions are given.
+type daemonlessNetwork string
+
+const (
+	// networkHost runs instructions in the build pod's network namespace.
+	networkHost daemonlessNetwork = "host"
+	// networkPrivate runs instructions in a network namespace of their own,
+	// which is connected to the build pod's network.
+	networkPrivate daemonlessNetwork = "private"
+	// networkNone runs instructions in a network namespace of their own,
+	// which only has a loopback interface, for hermetic builds.
+	networkNone daemonlessNetwork = "none"
+)
+
+// networkFromEnv returns the network access that RUN instructions should be
+// given, based on the environment.  Using the host's network remains the
+// default.
+func networkFromEnv() (daemonlessNetwork, error) {
+	switch network := daemonlessNetwork(strings.ToLower(strings.TrimSpace(os.Getenv(buildutil.BuildNetwork)))); network {
+	case "":
+		return networkHost, nil
+	case networkHost, networkPrivate, networkNone:
+		return network, nil
+	default:
+		return "", fmt.Errorf("unrecognized %s %q, expected %q, %q, or %q", buildutil.BuildNetwork, network, networkHost, networkPrivate, networkNone)
+	}
+}
+
+// namespaceOptions returns the network namespace settings for running
+// instructions with this network access.
+func (n daemonlessNetwork) namespaceOptions() (buildah.NamespaceOptions, buildah.NetworkConfigurationPolicy) {
+	switch n {
+	case networkPrivate:
+		return buildah.NamespaceOptions{{Name: string(specs.NetworkNamespace)}}, buildah.NetworkEnabled
+	case networkNone:
+		return buildah.NamespaceOptions{{Name: string(specs.NetworkNamespace)}}, buildah.NetworkDisabled
+	default:
+		return buildah.NamespaceOptions{{Name: string(specs.NetworkNamespace), Host: true}}, buildah.NetworkDefault
+	}
+}
+
+// explainNetworkError adds a reminder that instructions couldn't use the
+// network to an error from a build or a container which had no network access,
+// if the error looks like it was caused by not being able to reach something.
+func (n daemonlessNetwork) explainNetworkError(err error) error {
+	if err == nil || n != networkNone || !isNetworkError(err) {
+		return err
+	}
+	return fmt.Errorf("%w (network access is disabled for this build by %s=%s)", err, buildutil.BuildNetwork, networkNone)
+}
+
+// networkErrorMessages are the parts of error messages which suggest that a
+// name couldn't be resolved, or that a host couldn't be reached.
+var networkErrorMessages = []string{
+	"name resolution",
+	"could not resolve",
+	"no such host",
+	"connection refused",
+	"network is unreachable",
+	"no route to host",
+}
+
+// isNetworkError returns whether err looks like it was caused by a failure to
+// resolve a name or connect to a host.
+func isNetworkError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, part := range networkErrorMessages {
+		if strings.Contains(message, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// daemonlessLayerCache describes the registry repositories which intermediate
+// layers are imported from and exported to during builds which use layers.
+type daemonlessLayerCache struct {
+	From []ireference.Named
+	To   []ireference.Named
+	TTL  time.Duration
+}
+
+// layerCacheFromEnv reads the layer cache settings from the environment.
+func layerCacheFromEnv() (daemonlessLayerCache, error) {
+	var cache daemonlessLayerCache
+	var err error
+	repoList := func(env string) []string {
+		var repos []string
+		for _, repo := range strings.Split(os.Getenv(env), ",") {
+			if repo = strings.TrimSpace(repo); repo != "" {
+				repos = append(repos, repo)
+			}
+		}
+		return repos
+	}
+	if cache.From, err = parse.RepoNamesToNamedReferences(repoList(buildutil.BuildCacheFrom)); err != nil {
+		return cache, fmt.Errorf("error parsing %s: %v", buildutil.BuildCacheFrom, err)
+	}
+	if cache.To, err = parse.RepoNamesToNamedReferences(repoList(buildutil.BuildCacheTo)); err != nil {
+		return cache, fmt.Errorf("error parsing %s: %v", buildutil.BuildCacheTo, err)
+	}
+	if ttl, ok := os.LookupEnv(buildutil.BuildCacheTTL); ok && ttl != "" {
+		if cache.TTL, err = time.ParseDuration(ttl); err != nil {
+			return cache, fmt.Errorf("error parsing %s: %v", buildutil.BuildCacheTTL, err)
+		}
+	}
+	return cache, nil
+}
+
+// setLayerCacheAuthentication adds credentials for the layer cache
+// repositories to the system context, using pull credentials for the
+// repositories that we import from, and push credentials for the ones that we
+// export to.  Credentials are scoped to the repository, so that they don't
+// replace the ones which we use for pulling base images.
+func setLayerCacheAuthentication(systemContext *types.SystemContext, cache daemonlessLayerCache) error {
+	setAuthentication := func(repos []ireference.Named, authType string) error {
+		for _, repo := range repos {
+			auth, ok := dockercfg.NewHelper().GetDockerAuth(repo.String(), authType)
+			if !ok {
+				log.V(4).Infof("No authentication secret found for layer cache %q.", repo.String())
+				continue
+			}
+			log.V(5).Infof("Setting authentication for layer cache %q.", repo.String())
+			if err := config.SetAuthentication(systemContext, repo.Name(), auth.Username, auth.Password); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Set credentials for exporting last, since push credentials for a
+	// repository should also let us pull from it.
+	if err := setAuthentication(cache.From, dockercfg.PullAuthType); err != nil {
+		return err
+	}
+	return setAuthentication(cache.To, dockercfg.PushAuthType)
+}
+
+// parsePushCompression parses a comma-separated list of compression
+// algorithms.  The first one is used when pushing the image, and the names of
+// any others are returned so that variants of the image which use them can be
+// added to its manifest list.  An empty list leaves the choice to the image
+// library, which uses gzip.
+func parsePushCompression(spec string) (*compression.Algorithm, []string, error) {
+	var algorithms []compression.Algorithm
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		algorithm, err := compression.AlgorithmByName(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing push compression %q: %v", spec, err)
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	if len(algorithms) == 0 {
+		return nil, nil, nil
+	}
+	var additional []string
+	for _, algorithm := range algorithms[1:] {
+		if algorithm.Name() != algorithms[0].Name() {
+			additional = append(additional, algorithm.Name())
+		}
+	}
+	return &algorithms[0], additional, nil
+}
+
+// squashAllFromEnv returns whether or not the images that we build should be
+// squashed into a single layer, including the contents of their base images.
+func squashAllFromEnv() (bool, error) {
+	squashAll, ok := os.LookupEnv(buildutil.BuildSquashAll)
+	if !ok || squashAll == "" {
+		return false, nil
+	}
+	squash, err := strconv.ParseBool(squashAll)
+	if err != nil {
+		return false, fmt.Errorf("error parsing %s %q: %v", buildutil.BuildSquashAll, squashAll, err)
+	}
+	return squash, nil
+}
+
+// registerEmulators makes any emulators which are configured in binfmt.d
+// available if one or more of the target platforms can't be run natively.
+// RUN instructions for those platforms will fail if no emulator is registered
+// for them, so we only warn here.
+func registerEmulators(platforms []BuildPlatform) {
+	for _, platform := range platforms {
+		if platform.Arch == "" || platform.Arch == goruntime.GOARCH {
+			continue
+		}
+		if err := binfmt.MaybeRegister(nil); err != nil {
+			log.V(0).Infof("Warning: unable to register emulators, RUN instructions for %s may fail: %v", platform, err)
+		}
+		return
+	}
+}
+
 // parsePullCredentials parses credentials from provided file.
 func parsePullCredentials(credsPath string) (credentialprovider.DockerConfig, error) {
 	var creds credentialprovider.DockerConfig
@@ -174,18 +444,11 @@ func mergeNodeCredentialsDockerAuth(credsPath string) *docker.AuthConfigurations
 	}
 }
 
-func pullDaemonlessImage(sc types.SystemContext, store storage.Store, imageName string, searchPaths []string, blobCacheDirectory string) error {
-	log.V(2).Infof("Attempting pull of image %q.", imageName)
-
-	if imageName == "" {
-		return fmt.Errorf("unable to pull using empty image name")
-	}
-
-	_, err := alltransports.ParseImageName("docker://" + imageName)
-	if err != nil {
-		return fmt.Errorf("error parsing image name to pull %s: %v", "docker://"+imageName, err)
-	}
-
+// pullCredentialsFile writes the credentials in searchPaths, merged with the
+// node's credentials, to a temporary file, and returns its name along with a
+// function which removes it.  An error reading the credentials in searchPaths
+// is returned separately, since the node's credentials might be enough.
+func pullCredentialsFile(searchPaths []string) (string, func(), error, error) {
 	dockerConfigCreds, dockerConfigCredsErr := dockercfg.GetDockerConfigPath(searchPaths)
 	// we do not error out immediately if dockercfg.GetDockerConfigPath returns an error
 	// in case the node credentials facilitate the pulling of the image
@@ -193,21 +456,42 @@ func pullDaemonlessImage(sc types.SystemContext, store storage.Store, imageName
 
 	dstFile, err := ioutil.TempFile("", "config")
 	if err != nil {
-		return fmt.Errorf("error creating tmp credentials file: %v", err)
+		return "", nil, nil, fmt.Errorf("error creating tmp credentials file: %v", err)
 	}
-	defer func() {
+	remove := func() {
 		_ = dstFile.Close()
 		if err := os.Remove(dstFile.Name()); err != nil {
 			log.V(2).Infof("unable to remove tmp credentials file: %v", err)
 		}
-	}()
+	}
 
 	if err := json.NewEncoder(dstFile).Encode(mergedCreds); err != nil {
-		return fmt.Errorf("error encoding credentials: %v", err)
+		remove()
+		return "", nil, nil, fmt.Errorf("error encoding credentials: %v", err)
+	}
+	return dstFile.Name(), remove, dockerConfigCredsErr, nil
+}
+
+func pullDaemonlessImage(ctx context.Context, sc types.SystemContext, store storage.Store, imageName string, searchPaths []string, blobCacheDirectory string) error {
+	log.V(2).Infof("Attempting pull of image %q.", imageName)
+
+	if imageName == "" {
+		return fmt.Errorf("unable to pull using empty image name")
+	}
+
+	_, err := alltransports.ParseImageName("docker://" + imageName)
+	if err != nil {
+		return fmt.Errorf("error parsing image name to pull %s: %v", "docker://"+imageName, err)
+	}
+
+	authFile, removeAuthFile, dockerConfigCredsErr, err := pullCredentialsFile(searchPaths)
+	if err != nil {
+		return err
 	}
+	defer removeAuthFile()
 
 	systemContext := sc
-	systemContext.AuthFilePath = dstFile.Name()
+	systemContext.AuthFilePath = authFile
 
 	options := buildah.PullOptions{
 		ReportWriter:  os.Stderr,
@@ -215,7 +499,7 @@ func pullDaemonlessImage(sc types.SystemContext, store storage.Store, imageName
 		SystemContext: &systemContext,
 		BlobDirectory: blobCacheDirectory,
 	}
-	_, err = buildah.Pull(context.TODO(), imageName, options)
+	_, err = buildah.Pull(ctx, imageName, options)
 	if err == nil {
 		log.V(2).Infof("Finished pulling image %q", imageName)
 	} else {
@@ -227,29 +511,155 @@ func pullDaemonlessImage(sc types.SystemContext, store storage.Store, imageName
 	return err
 }
 
-func daemonlessProcessLimits() (defaultProcessLimits []string) {
-	rlim := unix.Rlimit{Cur: 1048576, Max: 1048576}
-	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &rlim); err == nil {
-		defaultProcessLimits = append(defaultProcessLimits, fmt.Sprintf("nofile=%d:%d", rlim.Cur, rlim.Max))
-	} else {
-		if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err == nil {
-			defaultProcessLimits = append(defaultProcessLimits, fmt.Sprintf("nofile=%d:%d", rlim.Cur, rlim.Max))
-		}
+// resolveDaemonlessImage returns the digest of the manifest, or manifest list,
+// which the registry has for imageName, without pulling it.
+func resolveDaemonlessImage(ctx context.Context, sc types.SystemContext, imageName string, searchPaths []string) (string, error) {
+	ref, err := alltransports.ParseImageName("docker://" + imageName)
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name to resolve %s: %v", "docker://"+imageName, err)
 	}
-	rlim = unix.Rlimit{Cur: 1048576, Max: 1048576}
-	if err := unix.Setrlimit(unix.RLIMIT_NPROC, &rlim); err == nil {
-		defaultProcessLimits = append(defaultProcessLimits, fmt.Sprintf("nproc=%d:%d", rlim.Cur, rlim.Max))
-	} else {
-		if err := unix.Getrlimit(unix.RLIMIT_NPROC, &rlim); err == nil {
-			defaultProcessLimits = append(defaultProcessLimits, fmt.Sprintf("nproc=%d:%d", rlim.Cur, rlim.Max))
+
+	authFile, removeAuthFile, dockerConfigCredsErr, err := pullCredentialsFile(searchPaths)
+	if err != nil {
+		return "", err
+	}
+	defer removeAuthFile()
+
+	systemContext := sc
+	systemContext.AuthFilePath = authFile
+
+	imageDigest, err := idocker.GetDigest(ctx, &systemContext, ref)
+	if err != nil && dockerConfigCredsErr != nil {
+		err = fmt.Errorf("Error resolving image %q: %s; also, error processing dockerconfigjson: %s", imageName, err.Error(), dockerConfigCredsErr.Error())
+	}
+	return string(imageDigest), err
+}
+
+// daemonlessProcessLimits returns the limits on open files and processes that
+// the builder runs with, which the containers that a build runs are given
+// unless BUILD_ULIMITS sets them.
+func daemonlessProcessLimits() (defaultProcessLimits []string) {
+	for _, limit := range []struct {
+		name     string
+		resource int
+	}{
+		{name: "nofile", resource: unix.RLIMIT_NOFILE},
+		{name: "nproc", resource: unix.RLIMIT_NPROC},
+	} {
+		var rlim unix.Rlimit
+		if err := unix.Getrlimit(limit.resource, &rlim); err == nil {
+			defaultProcessLimits = append(defaultProcessLimits, fmt.Sprintf("%s=%d:%d", limit.name, rlimitValue(rlim.Cur), rlimitValue(rlim.Max)))
 		}
 	}
 	return defaultProcessLimits
 }
 
-func buildDaemonlessImage(sc types.SystemContext, store storage.Store, isolation buildah.Isolation, ociRuntime, contextDir string, optimization buildapiv1.ImageOptimizationPolicy, opts *docker.BuildImageOptions, blobCacheDirectory string) error {
+// rlimitValue converts a process limit to the form that ulimits use, where -1
+// means that there is no limit.
+func rlimitValue(value uint64) int64 {
+	if value == unix.RLIM_INFINITY {
+		return -1
+	}
+	return int64(value)
+}
+
+// currentHardLimit returns the hard limit that the builder runs with for a
+// type of resource, or -1 if it's unlimited.
+func currentHardLimit(resource int) (int64, error) {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(resource, &rlim); err != nil {
+		return 0, err
+	}
+	return rlimitValue(rlim.Max), nil
+}
+
+// writeTmpfsDockerfile writes a copy of the Dockerfile at path whose RUN
+// instructions each mount tmpfs filesystems of their own, and returns the
+// location of the copy, along with a function which removes it.
+func writeTmpfsDockerfile(path string, mounts []tmpfsMount) (string, func(), error) {
+	dockerfile, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	dockerfile, err = addTmpfsRunMounts(dockerfile, mounts)
+	if err != nil {
+		return "", nil, fmt.Errorf("error adding tmpfs mounts to %q: %v", path, err)
+	}
+	return writeTempDockerfile(dockerfile)
+}
+
+// writeTempDockerfile writes the Dockerfile to a temporary file, and returns
+// its name and a function which removes it.
+func writeTempDockerfile(dockerfile []byte) (string, func(), error) {
+	f, err := os.CreateTemp("", "Dockerfile")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+	_, err = f.Write(dockerfile)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return f.Name(), remove, nil
+}
+
+// tmpfsSpecMounts returns mounts which give a container a tmpfs of its own
+// for each of the mounts.
+func tmpfsSpecMounts(mounts []tmpfsMount) []specs.Mount {
+	var specMounts []specs.Mount
+	for _, mount := range mounts {
+		specMounts = append(specMounts, specs.Mount{
+			Destination: mount.Destination,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     mount.Options,
+		})
+	}
+	return specMounts
+}
+
+// daemonlessBuildOptions are the settings which buildDaemonlessImage uses,
+// other than the ones which come from the request to build an image.
+type daemonlessBuildOptions struct {
+	Isolation          buildah.Isolation
+	OCIRuntime         string
+	ContextDir         string
+	Optimization       buildapiv1.ImageOptimizationPolicy
+	BlobCacheDirectory string
+	// Platforms are the platforms to build images for, or the platform
+	// that we're running on if there are none.
+	Platforms    []BuildPlatform
+	OutputFormat string
+	// ManifestList adds the images that are built to a manifest list which
+	// is given the output name, instead of giving them the name.
+	ManifestList bool
+	LayerCache   daemonlessLayerCache
+	// Timestamp, if set, is used for every timestamp in the image.
+	Timestamp *time.Time
+	SquashAll bool
+	Network   daemonlessNetwork
+	Resources resourceOptions
+	// RetryPolicy is used for pulls and pushes which buildah retries.
+	// It waits the same amount of time before every retry.
+	RetryPolicy retryPolicy
+	// StageBuilt, if set, is called after each stage of a multi-stage
+	// Dockerfile, other than the one which produces the image, is built,
+	// with the IDs of the images of the stages that are still to be used.
+	StageBuilt func(keepImages map[string]bool)
+}
+
+func buildDaemonlessImage(sc types.SystemContext, store storage.Store, opts *docker.BuildImageOptions, buildOpts daemonlessBuildOptions) error {
 	log.V(2).Infof("Building...")
 
+	optimization := buildOpts.Optimization
+	cache := buildOpts.LayerCache
+	network := buildOpts.Network
+	resources := buildOpts.Resources
+
 	args := make(map[string]string)
 	for _, ev := range opts.BuildArgs {
 		args[ev.Name] = ev.Value
@@ -264,12 +674,19 @@ func buildDaemonlessImage(sc types.SystemContext, store storage.Store, isolation
 	layers := false
 	switch optimization {
 	case buildapiv1.ImageOptimizationSkipLayers, buildapiv1.ImageOptimizationSkipLayersAndWarn:
+		// Only commit at the end of each stage, squashing everything
+		// that the stage's instructions add into a single new layer
+		// on top of its base image.
 		layers = false
 	case buildapiv1.ImageOptimizationNone:
 		layers = true
 	default:
 		return fmt.Errorf("internal error: image optimization policy %q not fully implemented", string(optimization))
 	}
+	if buildOpts.SquashAll {
+		// Squash the base image into that single layer, too.
+		log.V(0).Infof("Squashing the image into a single layer.")
+	}
 
 	systemContext := sc
 	// if credsDir, ok := os.LookupEnv("PULL_DOCKERCFG_PATH"); ok {
@@ -289,31 +706,74 @@ func buildDaemonlessImage(sc types.SystemContext, store storage.Store, isolation
 		}
 	}
 
+	if layers {
+		if err := setLayerCacheAuthentication(&systemContext, cache); err != nil {
+			return err
+		}
+	} else if len(cache.From) > 0 || len(cache.To) > 0 {
+		log.V(0).Infof("Warning: not using the layer cache, because image optimization policy %q does not use layers.", string(optimization))
+		cache = daemonlessLayerCache{}
+	}
+
 	transientMounts, err := generateTransientMounts()
 	if err != nil {
 		return err
 	}
+	dockerfile, ignoreFile := opts.Dockerfile, ""
+	if len(resources.Tmpfs) > 0 {
+		if !filepath.IsAbs(dockerfile) {
+			dockerfile = filepath.Join(buildOpts.ContextDir, dockerfile)
+		}
+		// The copy of the Dockerfile that we build won't be next to an
+		// ignore file which is named after the original, so find it now.
+		if _, ignoreFile, err = parse.ContainerIgnoreFile(buildOpts.ContextDir, "", []string{dockerfile}); err != nil {
+			return err
+		}
+		var remove func()
+		if dockerfile, remove, err = writeTmpfsDockerfile(dockerfile, resources.Tmpfs); err != nil {
+			return err
+		}
+		defer remove()
+	}
+
+	var secrets []string
+	if useSecretMounts() {
+		if secrets, err = buildSecretMounts(); err != nil {
+			return err
+		}
+	}
+	var sshSources []string
+	if forwardSSHKey() {
+		var knownHosts []string
+		sshSources, knownHosts = sourceSecretSSHAgent(os.Getenv("SOURCE_SECRET_PATH"))
+		secrets = append(secrets, knownHosts...)
+	}
+
+	namespaceOptions, configureNetwork := network.namespaceOptions()
+	if network != networkHost {
+		log.V(0).Infof("Running instructions with %s network access.", network)
+	}
 
 	// Use a profile provided in the image instead of the default provided
 	// in runtime-tools's generator logic.
 	seccompProfilePath := "/usr/share/containers/seccomp.json"
 
 	options := imagebuildah.BuildOptions{
-		ContextDirectory: contextDir,
+		ContextDirectory: buildOpts.ContextDir,
 		PullPolicy:       pullPolicy,
-		Isolation:        isolation,
-		Runtime:          ociRuntime,
+		Isolation:        buildOpts.Isolation,
+		Runtime:          buildOpts.OCIRuntime,
 		TransientMounts:  transientMounts,
+		IgnoreFile:       ignoreFile,
 		Args:             args,
 		Output:           opts.Name,
 		Out:              opts.OutputStream,
 		Err:              opts.OutputStream,
 		ReportWriter:     opts.OutputStream,
-		OutputFormat:     buildah.Dockerv2ImageManifest,
+		OutputFormat:     buildOpts.OutputFormat,
 		SystemContext:    &systemContext,
-		NamespaceOptions: buildah.NamespaceOptions{
-			{Name: string(specs.NetworkNamespace), Host: true},
-		},
+		NamespaceOptions: namespaceOptions,
+		ConfigureNetwork: configureNetwork,
 		CommonBuildOpts: &buildah.CommonBuildOptions{
 			HTTPProxy:          true,
 			CPUPeriod:          uint64(opts.CPUPeriod),
@@ -322,27 +782,159 @@ func buildDaemonlessImage(sc types.SystemContext, store storage.Store, isolation
 			Memory:             opts.Memory,
 			MemorySwap:         opts.Memswap,
 			CgroupParent:       opts.CgroupParent,
-			Ulimit:             daemonlessProcessLimits(),
+			Ulimit:             resources.ulimitsWithDefaults(daemonlessProcessLimits()),
+			ShmSize:            resources.ShmSize,
 			SeccompProfilePath: seccompProfilePath,
+			Secrets:            secrets,
+			SSHSources:         sshSources,
 		},
 		Layers:                  layers,
+		Squash:                  buildOpts.SquashAll,
 		NoCache:                 opts.NoCache,
 		RemoveIntermediateCtrs:  opts.RmTmpContainer,
 		ForceRmIntermediateCtrs: true,
-		BlobDirectory:           blobCacheDirectory,
+		BlobDirectory:           buildOpts.BlobCacheDirectory,
 		DropCapabilities:        dropCapabilities(),
-		MaxPullPushRetries:      DefaultPushOrPullRetryCount,
-		PullPushRetryDelay:      DefaultPushOrPullRetryDelay,
+		MaxPullPushRetries:      buildOpts.RetryPolicy.MaxRetries,
+		PullPushRetryDelay:      buildOpts.RetryPolicy.InitialDelay,
 		SkipUnusedStages:        types.OptionalBoolFalse,
 	}
 
+	if opts.Target != "" {
+		// Build the target stage, and only the stages that it uses.
+		log.V(0).Infof("Building the %q stage.", opts.Target)
+		options.Target = opts.Target
+		options.SkipUnusedStages = types.OptionalBoolTrue
+	}
+
 	if os.Getenv("BUILDAH_QUIET") == "true" {
 		log.V(4).Infof("Enabling Buildah's --quiet option")
 		options.Quiet = true
 	}
 
-	_, _, err = imagebuildah.BuildDockerfiles(opts.Context, store, options, opts.Dockerfile)
-	return err
+	if timestamp := buildOpts.Timestamp; timestamp != nil {
+		// Use the same time for the image's creation date, its history
+		// entries, and every file in the layers that we write, which
+		// are always written in sorted order.
+		log.V(0).Infof("Using %s for timestamps in the image for a reproducible build.", timestamp.Format(time.RFC3339))
+		options.Timestamp = timestamp
+	}
+
+	if len(cache.From) > 0 || len(cache.To) > 0 {
+		// Import cached layers from, and export new layers to,
+		// registries as each one is committed, so a build which
+		// fails has still exported the layers that it committed
+		// before it failed.  Failed pulls and pushes are retried
+		// using the build's retry policy, waiting the same amount of
+		// time before each retry.
+		options.CacheFrom = cache.From
+		options.CacheTo = cache.To
+		options.CacheTTL = cache.TTL
+	}
+
+	if platforms := buildOpts.Platforms; len(platforms) > 0 {
+		log.V(0).Infof("Building for platforms %v", platforms)
+		registerEmulators(platforms)
+		for _, platform := range platforms {
+			options.Platforms = append(options.Platforms, struct{ OS, Arch, Variant string }(platform))
+		}
+	}
+	if buildOpts.ManifestList {
+		// Build an image for each platform, and add them all
+		// to a manifest list which is given the output name.
+		options.Output = ""
+		options.Manifest = opts.Name
+	}
+
+	// Build the stages of a multi-stage Dockerfile one at a time, so that
+	// what each of them leaves behind can be removed before the next one.
+	stages, err := readDockerfileStages(dockerfile, buildOpts.ContextDir, args)
+	if err != nil {
+		log.V(2).Infof("Not building the stages of %s one at a time: %v", dockerfile, err)
+	} else if len(stages.stages) > 1 {
+		if options.IgnoreFile == "" {
+			// The stages are built from copies of the Dockerfile,
+			// too.
+			if _, options.IgnoreFile, err = parse.ContainerIgnoreFile(buildOpts.ContextDir, "", []string{stages.path}); err != nil {
+				return err
+			}
+		}
+		err = buildDaemonlessStages(opts.Context, store, options, stages, opts.Target, buildOpts.StageBuilt)
+		return network.explainNetworkError(err)
+	}
+
+	_, _, err = imagebuildah.BuildDockerfiles(opts.Context, store, options, dockerfile)
+	return network.explainNetworkError(err)
+}
+
+// readDockerfileStages reads the Dockerfile, which is either absolute or in
+// contextDir, and splits it into its stages.
+func readDockerfileStages(dockerfile, contextDir string, args map[string]string) (*dockerfileStages, error) {
+	if !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(contextDir, dockerfile)
+	}
+	in, err := os.ReadFile(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	stages, err := splitDockerfileStages(in, args)
+	if err != nil {
+		return nil, err
+	}
+	stages.path = dockerfile
+	return stages, nil
+}
+
+// buildDaemonlessStages builds the stages of a multi-stage Dockerfile one at a
+// time, for each of the platforms in options in turn, calling stageBuilt after
+// each stage, other than the one which produces the image, is built.  That
+// stage is built using options as they are, the others aren't given names or
+// added to manifest lists.
+func buildDaemonlessStages(ctx context.Context, store storage.Store, options imagebuildah.BuildOptions, stages *dockerfileStages, target string, stageBuilt func(keepImages map[string]bool)) error {
+	final, build, err := stages.plan(target)
+	if err != nil {
+		return err
+	}
+	platforms := options.Platforms
+	if len(platforms) == 0 {
+		// the platform that we're running on
+		platforms = append(platforms, struct{ OS, Arch, Variant string }{})
+	}
+	for _, platform := range platforms {
+		imageIDs := make(map[int]string)
+		for _, i := range build {
+			stageOptions := options
+			stageOptions.Target = ""
+			stageOptions.SkipUnusedStages = types.OptionalBoolFalse
+			if len(options.Platforms) > 0 {
+				stageOptions.Platforms = []struct{ OS, Arch, Variant string }{platform}
+			}
+			if i != final {
+				stageOptions.Output = ""
+				stageOptions.Manifest = ""
+				stageOptions.Squash = false
+			}
+			dockerfile, err := stages.stageDockerfile(i, imageIDs)
+			if err != nil {
+				return err
+			}
+			path, remove, err := writeTempDockerfile(dockerfile)
+			if err != nil {
+				return err
+			}
+			log.V(0).Infof("Building stage %d of %d.", i+1, len(stages.stages))
+			id, _, err := imagebuildah.BuildDockerfiles(ctx, store, stageOptions, path)
+			remove()
+			if err != nil {
+				return err
+			}
+			imageIDs[i] = id
+			if i != final && stageBuilt != nil {
+				stageBuilt(stages.stillUsed(imageIDs, build))
+			}
+		}
+	}
+	return nil
 }
 
 // appendBuildVolumeMounts appends the Build Volume Mounts to the Transient Mounts Map
@@ -363,16 +955,7 @@ func appendBuildVolumeMounts(mountsMap *TransientMounts) error {
 
 	for _, bv := range buildVolumes {
 		t := true
-		var sourcePath string
-		switch bv.Source.Type {
-
-		case buildapiv1.BuildVolumeSourceTypeSecret:
-			sourcePath = PathForBuildVolume(bv.Source.Secret.SecretName)
-		case buildapiv1.BuildVolumeSourceTypeConfigMap:
-			sourcePath = PathForBuildVolume(bv.Source.ConfigMap.Name)
-		case buildapiv1.BuildVolumeSourceTypeCSI:
-			sourcePath = PathForBuildVolume(bv.Name)
-		}
+		sourcePath := PathForBuildVolumeSource(bv)
 
 		for _, bvm := range bv.Mounts {
 			if err := mountsMap.append(TransientMount{
@@ -391,6 +974,91 @@ func appendBuildVolumeMounts(mountsMap *TransientMounts) error {
 	return nil
 }
 
+// buildSecretMounts returns the secrets that RUN --mount=type=secret
+// instructions can use, one for each of the build's secret build sources.
+func buildSecretMounts() ([]string, error) {
+	build := &buildapiv1.Build{}
+
+	if err := buildutil.GetBuildFromEnv(build); err != nil {
+		return nil, err
+	}
+
+	return secretMountSpecs(build.Spec.Source.Secrets, secretBuildSourceBaseMountPath)
+}
+
+// secretMountSpecs returns a secret specification for each key in each of
+// the secrets, which are mounted in directories under baseDir.  A key's ID is
+// the secret's name followed by a "/" and the key, and if a secret only has
+// one key, the secret's name alone can also be used as the ID for it.
+func secretMountSpecs(secrets []buildapiv1.SecretBuildSource, baseDir string) ([]string, error) {
+	var mounts []string
+	for _, s := range secrets {
+		name := s.Secret.Name
+		secretDir := filepath.Join(baseDir, name)
+		entries, err := os.ReadDir(secretDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading build secret %q: %v", name, err)
+		}
+		var keys []string
+		for _, entry := range entries {
+			// skip the links and directories which the kubelet
+			// uses to update the secret's contents
+			if strings.HasPrefix(entry.Name(), "..") {
+				continue
+			}
+			if info, err := os.Stat(filepath.Join(secretDir, entry.Name())); err != nil || info.IsDir() {
+				continue
+			}
+			keys = append(keys, entry.Name())
+		}
+		if s.DestinationDir != "" {
+			log.V(0).Infof("Warning: ignoring destination directory %q for build secret %q, which is only available to RUN --mount=type=secret instructions.", s.DestinationDir, name)
+		}
+		for _, key := range keys {
+			mounts = append(mounts, fmt.Sprintf("id=%s/%s,src=%s,type=file", name, key, filepath.Join(secretDir, key)))
+		}
+		if len(keys) == 1 {
+			mounts = append(mounts, fmt.Sprintf("id=%s,src=%s,type=file", name, filepath.Join(secretDir, keys[0])))
+		}
+		log.V(3).Infof("Build secret %q is available to RUN --mount=type=secret instructions with keys %v", name, keys)
+	}
+	return mounts, nil
+}
+
+// sourceSecretSSHAgent returns the SSH agent sources that RUN --mount=type=ssh
+// instructions can use, if the build's source secret, mounted at
+// sourceSecretDir, contains an SSH private key.  An agent which holds the key
+// is started for each instruction which asks for one, and only the agent's
+// socket is made available to it.  If the secret also contains a known_hosts
+// file, as the clone step would use to verify host keys, it's returned as a
+// secret with the ID "known_hosts", so that the instruction can also mount it.
+// Unlike the clone step, we can't turn off host key checking when there's no
+// known_hosts file, since the instruction runs ssh with its own settings.
+func sourceSecretSSHAgent(sourceSecretDir string) (sshSources, knownHosts []string) {
+	if sourceSecretDir == "" {
+		return nil, nil
+	}
+	privateKey := filepath.Join(sourceSecretDir, corev1.SSHAuthPrivateKey)
+	if _, err := os.Stat(privateKey); err != nil {
+		return nil, nil
+	}
+	// Check the key now, so that a key that the agent can't load, like
+	// one with a passphrase, doesn't fail builds which don't need it.
+	if _, err := sshagent.NewSource([]string{privateKey}); err != nil {
+		log.V(0).Infof("Warning: the source secret's SSH key can't be used by RUN --mount=type=ssh instructions: %v", err)
+		return nil, nil
+	}
+	sshSources = []string{"default=" + privateKey}
+	knownHostsFile := filepath.Join(sourceSecretDir, buildutil.SSHKnownHostsFileName)
+	if _, err := os.Stat(knownHostsFile); err == nil {
+		knownHosts = []string{fmt.Sprintf("id=%s,src=%s,type=file", buildutil.SSHKnownHostsFileName, knownHostsFile)}
+		log.V(0).Infof("The source secret's SSH key and known hosts are available to RUN --mount=type=ssh and RUN --mount=type=secret,id=%s instructions.", buildutil.SSHKnownHostsFileName)
+	} else {
+		log.V(0).Infof("The source secret's SSH key is available to RUN --mount=type=ssh instructions.  It includes no %s file, so instructions will have to trust the hosts that they connect to some other way.", buildutil.SSHKnownHostsFileName)
+	}
+	return sshSources, knownHosts
+}
+
 func appendRHRepoMount(pathStart string, mountsMap *TransientMounts) error {
 	path := filepath.Join(pathStart, repoFile)
 	st, err := os.Stat(path)
@@ -523,16 +1191,11 @@ func tagDaemonlessImage(sc types.SystemContext, store storage.Store, buildTag, p
 		return fmt.Errorf("unable to add empty tag to image")
 	}
 
-	systemContext := sc
-
-	_, img, err := util.FindImage(store, "", &systemContext, buildTag)
+	img, err := findDaemonlessImage(sc, store, buildTag)
 	if err != nil {
 		return err
 	}
-	if img == nil {
-		return storage.ErrImageUnknown
-	}
-	if err := util.AddImageNames(store, "", &systemContext, img, []string{pushTag}); err != nil {
+	if err := img.Tag(pushTag); err != nil {
 		return err
 	}
 	log.V(2).Infof("Added name %q to local image.", pushTag)
@@ -540,37 +1203,80 @@ func tagDaemonlessImage(sc types.SystemContext, store storage.Store, buildTag, p
 	return nil
 }
 
-func removeDaemonlessImage(sc types.SystemContext, store storage.Store, buildTag string) error {
-	log.V(2).Infof("Removing name %q from local image.", buildTag)
-
-	if buildTag == "" {
-		return fmt.Errorf("unable to remove image using empty image name")
-	}
-
+// findDaemonlessImage looks up an image in local storage.  Unlike
+// util.FindImage, a manifest list is returned as-is instead of being resolved
+// to the instance which matches our platform, since that's what we want to
+// tag, remove, and push after a multi-platform build.
+func findDaemonlessImage(sc types.SystemContext, store storage.Store, name string) (*libimage.Image, error) {
 	systemContext := sc
 
-	_, img, err := util.FindImage(store, "", &systemContext, buildTag)
+	runtime, err := libimage.RuntimeFromStore(store, &libimage.RuntimeOptions{SystemContext: &systemContext})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if img == nil {
-		return storage.ErrImageUnknown
+	img, _, err := runtime.LookupImage(name, &libimage.LookupImageOptions{ManifestList: true})
+	if err != nil {
+		return nil, err
 	}
+	return img, nil
+}
 
-	filtered := make([]string, 0, len(img.Names))
-	for _, name := range img.Names {
-		if name != buildTag {
-			filtered = append(filtered, name)
-		}
+// daemonlessImageIDs returns the ID of the named image, or if it's a
+// manifest list, the IDs of the images that it lists.  Errors are only
+// logged, since the IDs are only used to keep track of blob cache usage.
+func daemonlessImageIDs(ctx context.Context, sc types.SystemContext, store storage.Store, name string) []string {
+	img, err := findDaemonlessImage(sc, store, name)
+	if err != nil {
+		log.V(4).Infof("Error looking up image %q: %v", name, err)
+		return nil
 	}
-	if err := store.SetNames(img.ID, filtered); err != nil {
+	if isList, err := img.IsManifestList(ctx); err != nil || !isList {
+		return []string{img.ID()}
+	}
+	_, list, err := manifests.LoadFromImage(store, img.ID())
+	if err != nil {
+		log.V(4).Infof("Error reading manifest list %q: %v", name, err)
+		return nil
+	}
+	var ids []string
+	for _, instance := range list.Instances() {
+		images, err := store.ImagesByDigest(instance)
+		if err != nil {
+			continue
+		}
+		for _, image := range images {
+			ids = append(ids, image.ID)
+		}
+	}
+	return ids
+}
+
+func removeDaemonlessImage(sc types.SystemContext, store storage.Store, buildTag string) error {
+	log.V(2).Infof("Removing name %q from local image.", buildTag)
+
+	if buildTag == "" {
+		return fmt.Errorf("unable to remove image using empty image name")
+	}
+
+	img, err := findDaemonlessImage(sc, store, buildTag)
+	if err != nil {
+		return err
+	}
+
+	filtered := make([]string, 0, len(img.Names()))
+	for _, name := range img.Names() {
+		if name != buildTag {
+			filtered = append(filtered, name)
+		}
+	}
+	if err := store.SetNames(img.ID(), filtered); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func pushDaemonlessImage(sc types.SystemContext, store storage.Store, imageName string, authConfig docker.AuthConfiguration, blobCacheDirectory string) (string, error) {
+func pushDaemonlessImage(ctx context.Context, sc types.SystemContext, store storage.Store, imageName string, authConfig docker.AuthConfiguration, blobCacheDirectory, manifestType string, compressionFormat *compression.Algorithm, additionalCompressions []string) (string, error) {
 	log.V(2).Infof("Pushing image %q from local storage.", imageName)
 
 	if imageName == "" {
@@ -584,6 +1290,7 @@ func pushDaemonlessImage(sc types.SystemContext, store storage.Store, imageName
 
 	systemContext := sc
 	systemContext.AuthFilePath = "/tmp/config.json"
+	systemContext.CompressionFormat = compressionFormat
 
 	if authConfig.Username != "" && authConfig.Password != "" {
 		log.V(2).Infof("Setting authentication secret for %q.", authConfig.ServerAddress)
@@ -595,20 +1302,11 @@ func pushDaemonlessImage(sc types.SystemContext, store storage.Store, imageName
 		log.V(2).Infof("No authentication secret provided for pushing to registry.")
 	}
 
-	options := buildah.PushOptions{
-		Compression:   archive.Gzip,
-		ReportWriter:  os.Stdout,
-		Store:         store,
-		SystemContext: &systemContext,
-		BlobDirectory: blobCacheDirectory,
-	}
-
-	// return the digest of the image
-	_, digest, err := buildah.Push(context.TODO(), imageName, dest, options)
+	imageDigest, err := copyDaemonlessImage(ctx, systemContext, store, imageName, dest, blobCacheDirectory, manifestType, compressionFormat, additionalCompressions)
 	logName := imageName
 	if dref := dest.DockerReference(); dref != nil {
 		if named, ok := dref.(ireference.Named); ok {
-			if canonical, err := ireference.WithDigest(ireference.TrimNamed(named), digest); err == nil {
+			if canonical, err := ireference.WithDigest(ireference.TrimNamed(named), imageDigest); err == nil {
 				logName = canonical.String()
 			}
 		}
@@ -616,10 +1314,338 @@ func pushDaemonlessImage(sc types.SystemContext, store storage.Store, imageName
 	if err == nil {
 		log.V(0).Infof("Successfully pushed %s", logName)
 	}
-	return string(digest), err
+	return string(imageDigest), err
+}
+
+// copyDaemonlessImage copies the image, or manifest list, which is named
+// imageName in local storage to dest, and returns the digest of the manifest
+// that it wrote there.
+func copyDaemonlessImage(ctx context.Context, systemContext types.SystemContext, store storage.Store, imageName string, dest types.ImageReference, blobCacheDirectory, manifestType string, compressionFormat *compression.Algorithm, additionalCompressions []string) (digest.Digest, error) {
+	img, err := findDaemonlessImage(systemContext, store, imageName)
+	if err != nil {
+		return "", err
+	}
+	isList, err := img.IsManifestList(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var imageDigest digest.Digest
+	if isList {
+		// return the digest of the manifest list
+		imageDigest, err = pushDaemonlessManifestList(ctx, store, img.ID(), dest, systemContext, blobCacheDirectory, manifestType, additionalCompressions)
+	} else {
+		if len(additionalCompressions) > 0 {
+			log.V(0).Infof("Warning: not adding %v variants of %q, which is not a manifest list.", additionalCompressions, imageName)
+		}
+		options := buildah.PushOptions{
+			Compression:               archive.Gzip,
+			ReportWriter:              os.Stdout,
+			Store:                     store,
+			SystemContext:             &systemContext,
+			ManifestType:              manifestType,
+			CompressionFormat:         compressionFormat,
+			ForceCompressionFormat:    compressionFormat != nil,
+			SourceLookupReferenceFunc: blobCacheSourceLookup(blobCacheDirectory, compressionFormat),
+		}
+
+		// return the digest of the image
+		_, imageDigest, err = buildah.Push(ctx, imageName, dest, options)
+	}
+	return imageDigest, err
+}
+
+// exportDaemonlessImage writes the image, or manifest list, named imageName
+// in local storage to dest, and returns the digest of the manifest that it
+// wrote there.  Docker archives can't hold manifest lists, and their layers
+// are always written uncompressed.
+func exportDaemonlessImage(ctx context.Context, sc types.SystemContext, store storage.Store, imageName string, dest types.ImageReference, blobCacheDirectory, manifestType string, compressionFormat *compression.Algorithm, additionalCompressions []string) (string, error) {
+	log.V(2).Infof("Exporting image %q from local storage.", imageName)
+
+	systemContext := sc
+	if dest.Transport().Name() == dockerarchive.Transport.Name() {
+		img, err := findDaemonlessImage(sc, store, imageName)
+		if err != nil {
+			return "", err
+		}
+		if isList, err := img.IsManifestList(ctx); err != nil {
+			return "", err
+		} else if isList {
+			return "", fmt.Errorf("unable to write manifest list %q to a docker archive", imageName)
+		}
+		manifestType = buildah.Dockerv2ImageManifest
+		compressionFormat = nil
+		additionalCompressions = nil
+	}
+	systemContext.CompressionFormat = compressionFormat
+
+	imageDigest, err := copyDaemonlessImage(ctx, systemContext, store, imageName, dest, blobCacheDirectory, manifestType, compressionFormat, additionalCompressions)
+	if err != nil {
+		return "", err
+	}
+	return string(imageDigest), nil
+}
+
+// signDaemonlessImage signs the image which was pushed as imageName, and which
+// has the digest imageDigest, in the registry, and returns where the signature
+// was stored.
+func signDaemonlessImage(ctx context.Context, sc types.SystemContext, imageName, imageDigest string, authConfig docker.AuthConfiguration, signing *imageSigning) (string, error) {
+	log.V(2).Infof("Signing image %q.", imageName)
+
+	named, err := ireference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name %s: %v", imageName, err)
+	}
+	pushedDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", fmt.Errorf("error parsing digest %q of image %s: %v", imageDigest, imageName, err)
+	}
+	canonical, err := ireference.WithDigest(ireference.TrimNamed(named), pushedDigest)
+	if err != nil {
+		return "", err
+	}
+	ref, err := alltransports.ParseImageName("docker://" + canonical.String())
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name %s: %v", "docker://"+canonical.String(), err)
+	}
+
+	systemContext := sc
+	systemContext.AuthFilePath = "/tmp/config.json"
+	if authConfig.Username != "" && authConfig.Password != "" {
+		systemContext.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: authConfig.Username,
+			Password: authConfig.Password,
+		}
+	}
+	if signing.Format == signingFormatSigstore {
+		registriesDir := sc.RegistriesDirPath
+		if registriesDir == "" {
+			registriesDir = defaultRegistriesDirPath
+		}
+		sigstoreDir, err := sigstoreRegistriesDir(registriesDir, canonical.Name())
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(sigstoreDir)
+		systemContext.RegistriesDirPath = sigstoreDir
+	}
+
+	// the signature vouches for the tag, and not only the digest
+	if err := signing.sign(ctx, &systemContext, ref, ireference.TagNameOnly(named)); err != nil {
+		return "", err
+	}
+	location := signing.signatureLocation(canonical)
+	log.V(0).Infof("Successfully signed %s, signature stored at %s", canonical.String(), location)
+	return location, nil
+}
+
+// generateDaemonlessSBOM lists the packages in the image which was built as
+// imageName, writes an SBOM which describes the image as subjectName, and if
+// label is set, labels the image with the SBOM's digest.  Images in manifest
+// lists aren't labeled, since that would replace them with images which the
+// list doesn't include.
+func generateDaemonlessSBOM(ctx context.Context, sc types.SystemContext, store storage.Store, imageName, subjectName, format, outputFormat string, timestamp *time.Time, label bool) (sbomDocument, error) {
+	log.V(2).Infof("Generating an SBOM for %q.", imageName)
+
+	systemContext := sc
+	builder, err := buildah.NewBuilder(ctx, store, buildah.BuilderOptions{
+		FromImage:     imageName,
+		PullPolicy:    buildah.PullNever,
+		SystemContext: &systemContext,
+	})
+	if err != nil {
+		return sbomDocument{}, fmt.Errorf("error reading image %s: %v", imageName, err)
+	}
+	defer func() {
+		if err := builder.Delete(); err != nil {
+			log.V(0).Infof("Warning: failed to remove the container used to generate an SBOM: %v", err)
+		}
+	}()
+
+	mountPath, err := builder.Mount("")
+	if err != nil {
+		return sbomDocument{}, fmt.Errorf("error mounting image %s: %v", imageName, err)
+	}
+	packages, err := scanRootfs(mountPath)
+	if unmountErr := builder.Unmount(); unmountErr != nil {
+		log.V(0).Infof("Warning: failed to unmount image %s: %v", imageName, unmountErr)
+	}
+	if err != nil {
+		return sbomDocument{}, fmt.Errorf("error listing the packages in image %s: %v", imageName, err)
+	}
+
+	created := time.Now()
+	if timestamp != nil {
+		created = *timestamp
+	}
+	document, err := newSBOMDocument(format, subjectName, packages, created)
+	if err != nil {
+		return sbomDocument{}, err
+	}
+	if !label {
+		log.V(0).Infof("Generated an SBOM listing %d packages in %s, with digest %s.", len(packages), imageName, document.Digest)
+		return document, nil
+	}
+
+	// The labels only add to the image's configuration, so committing
+	// it again doesn't need to add a layer.
+	builder.SetLabel(sbomDigestLabel, document.Digest.String())
+	builder.SetLabel(sbomMediaTypeLabel, document.MediaType)
+	dest, err := istorage.Transport.ParseStoreReference(store, imageName)
+	if err != nil {
+		return sbomDocument{}, fmt.Errorf("error parsing image name %s: %v", imageName, err)
+	}
+	_, _, _, err = builder.Commit(ctx, dest, buildah.CommitOptions{
+		PreferredManifestType: outputFormat,
+		SystemContext:         &systemContext,
+		HistoryTimestamp:      timestamp,
+		EmptyLayer:            true,
+	})
+	if err != nil {
+		return sbomDocument{}, fmt.Errorf("error labeling image %s with its SBOM: %v", imageName, err)
+	}
+	log.V(0).Infof("Generated an SBOM listing %d packages, with digest %s, and recorded it in the %s label.", len(packages), document.Digest, sbomDigestLabel)
+	return document, nil
 }
 
-func inspectDaemonlessImage(sc types.SystemContext, store storage.Store, name string) (*docker.Image, error) {
+// registrySystemContext returns a copy of sc which authenticates to registries
+// with authConfig, if it has credentials, or the build's auth file.
+func registrySystemContext(sc types.SystemContext, authConfig docker.AuthConfiguration) types.SystemContext {
+	systemContext := sc
+	systemContext.AuthFilePath = "/tmp/config.json"
+	if authConfig.Username != "" && authConfig.Password != "" {
+		systemContext.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: authConfig.Username,
+			Password: authConfig.Password,
+		}
+	}
+	return systemContext
+}
+
+// pushDaemonlessArtifact attaches data, which has the type mediaType, to the
+// image which was pushed as imageName, and which has the digest imageDigest,
+// in the registry.  It's pushed as an OCI artifact of the type artifactType,
+// whose subject is the image, and which is also tagged with the image's digest
+// and the suffix, so that it can be found without the referrers API.  It
+// returns the artifact's name, with its digest.
+func pushDaemonlessArtifact(ctx context.Context, sc types.SystemContext, imageName, imageDigest string, authConfig docker.AuthConfiguration, artifactType, mediaType string, data []byte, suffix string) (string, error) {
+	log.V(2).Infof("Attaching %s to image %q.", artifactType, imageName)
+
+	named, err := ireference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name %s: %v", imageName, err)
+	}
+	pushedDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", fmt.Errorf("error parsing digest %q of image %s: %v", imageDigest, imageName, err)
+	}
+	repository := ireference.TrimNamed(named)
+	canonical, err := ireference.WithDigest(repository, pushedDigest)
+	if err != nil {
+		return "", err
+	}
+	tagged, err := ireference.WithTag(repository, fmt.Sprintf("%s-%s.%s", pushedDigest.Algorithm(), pushedDigest.Encoded(), suffix))
+	if err != nil {
+		return "", err
+	}
+
+	systemContext := registrySystemContext(sc, authConfig)
+
+	srcRef, err := alltransports.ParseImageName("docker://" + canonical.String())
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name %s: %v", "docker://"+canonical.String(), err)
+	}
+	src, err := srcRef.NewImageSource(ctx, &systemContext)
+	if err != nil {
+		return "", fmt.Errorf("error reading image %s: %v", canonical.String(), err)
+	}
+	defer src.Close()
+	imageManifest, imageManifestType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("error reading manifest of image %s: %v", canonical.String(), err)
+	}
+
+	artifact, err := json.Marshal(imgspecv1.Manifest{
+		Versioned:    imgspecs.Versioned{SchemaVersion: 2},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       imgspecv1.DescriptorEmptyJSON,
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}},
+		Subject: &imgspecv1.Descriptor{
+			MediaType: imageManifestType,
+			Digest:    pushedDigest,
+			Size:      int64(len(imageManifest)),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	destRef, err := alltransports.ParseImageName("docker://" + tagged.String())
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name %s: %v", "docker://"+tagged.String(), err)
+	}
+	dest, err := destRef.NewImageDestination(ctx, &systemContext)
+	if err != nil {
+		return "", fmt.Errorf("error writing to %s: %v", tagged.String(), err)
+	}
+	defer dest.Close()
+	for _, blob := range []struct {
+		descriptor imgspecv1.Descriptor
+		data       []byte
+		isConfig   bool
+	}{
+		{descriptor: imgspecv1.DescriptorEmptyJSON, data: imgspecv1.DescriptorEmptyJSON.Data, isConfig: true},
+		{descriptor: imgspecv1.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}, data: data},
+	} {
+		info := types.BlobInfo{Digest: blob.descriptor.Digest, Size: blob.descriptor.Size}
+		if _, err := dest.PutBlob(ctx, bytes.NewReader(blob.data), info, none.NoCache, blob.isConfig); err != nil {
+			return "", fmt.Errorf("error pushing %s for %s: %v", artifactType, canonical.String(), err)
+		}
+	}
+	if err := dest.PutManifest(ctx, artifact, nil); err != nil {
+		return "", fmt.Errorf("error pushing %s for %s: %v", artifactType, canonical.String(), err)
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return "", fmt.Errorf("error pushing %s for %s: %v", artifactType, canonical.String(), err)
+	}
+	return tagged.String() + "@" + digest.FromBytes(artifact).String(), nil
+}
+
+// pushDaemonlessManifestList pushes a manifest list, along with every image
+// that it lists, and returns the digest of the manifest list.  The images are
+// pushed using manifestType, and the list is pushed using the corresponding
+// list type.  Layers are compressed using the algorithm set in systemContext,
+// and a variant of each image is added to the list for each of the
+// additionalCompressions.
+func pushDaemonlessManifestList(ctx context.Context, store storage.Store, listID string, dest types.ImageReference, systemContext types.SystemContext, blobCacheDirectory, manifestType string, additionalCompressions []string) (digest.Digest, error) {
+	_, list, err := manifests.LoadFromImage(store, listID)
+	if err != nil {
+		return "", err
+	}
+
+	options := manifests.PushOptions{
+		Store:                  store,
+		SystemContext:          &systemContext,
+		ImageListSelection:     cp.CopyAllImages,
+		ReportWriter:           os.Stdout,
+		ManifestType:           manifestType,
+		AddCompression:         additionalCompressions,
+		ForceCompressionFormat: systemContext.CompressionFormat != nil,
+	}
+	if blobCacheDirectory != "" {
+		options.SourceFilter = blobCacheSourceLookup(blobCacheDirectory, systemContext.CompressionFormat)
+	}
+
+	_, listDigest, err := list.Push(ctx, dest, options)
+	return listDigest, err
+}
+
+func inspectDaemonlessImage(ctx context.Context, sc types.SystemContext, store storage.Store, name string) (*docker.Image, error) {
 	systemContext := sc
 
 	ref, img, err := util.FindImage(store, "", &systemContext, name)
@@ -635,7 +1661,7 @@ func inspectDaemonlessImage(sc types.SystemContext, store storage.Store, name st
 		return nil, docker.ErrNoSuchImage
 	}
 
-	image, err := ref.NewImage(context.TODO(), &systemContext)
+	image, err := ref.NewImage(ctx, &systemContext)
 	if err != nil {
 		return nil, err
 	}
@@ -645,7 +1671,7 @@ func inspectDaemonlessImage(sc types.SystemContext, store storage.Store, name st
 	if err != nil {
 		return nil, err
 	}
-	oconfig, err := image.OCIConfig(context.TODO())
+	oconfig, err := image.OCIConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -696,15 +1722,38 @@ func inspectDaemonlessImage(sc types.SystemContext, store storage.Store, name st
 		Architecture:    oconfig.Architecture,
 		Size:            size,
 		VirtualSize:     size,
-		RepoDigests:     []string{},
+		RepoDigests:     daemonlessRepoDigests(img),
 		RootFS:          rootfs,
 		OS:              oconfig.OS,
 	}, nil
 }
 
+// daemonlessRepoDigests returns the names of the image, with the digest of its
+// manifest in place of their tags.
+func daemonlessRepoDigests(img *storage.Image) []string {
+	repoDigests := []string{}
+	if img.Digest == "" {
+		return repoDigests
+	}
+	seen := make(map[string]bool)
+	for _, name := range img.Names {
+		named, err := ireference.ParseNormalizedNamed(name)
+		if err != nil {
+			continue
+		}
+		canonical, err := ireference.WithDigest(ireference.TrimNamed(named), img.Digest)
+		if err != nil || seen[canonical.String()] {
+			continue
+		}
+		seen[canonical.String()] = true
+		repoDigests = append(repoDigests, canonical.String())
+	}
+	return repoDigests
+}
+
 // daemonlessRun mimics the 'docker run --rm' CLI command well enough. It creates and
 // starts a container and streams its logs. The container is removed after it terminates.
-func daemonlessRun(ctx context.Context, store storage.Store, isolation buildah.Isolation, ociRuntime string, createOpts docker.CreateContainerOptions, attachOpts docker.AttachToContainerOptions, blobCacheDirectory string) error {
+func daemonlessRun(ctx context.Context, store storage.Store, isolation buildah.Isolation, ociRuntime string, createOpts docker.CreateContainerOptions, attachOpts docker.AttachToContainerOptions, blobCacheDirectory string, network daemonlessNetwork, resources resourceOptions, policy retryPolicy) error {
 	if createOpts.Config == nil {
 		return fmt.Errorf("error calling daemonlessRun: expected a Config")
 	}
@@ -712,22 +1761,28 @@ func daemonlessRun(ctx context.Context, store storage.Store, isolation buildah.I
 		return fmt.Errorf("error calling daemonlessRun: expected a HostConfig")
 	}
 
+	namespaceOptions, configureNetwork := network.namespaceOptions()
 	builderOptions := buildah.BuilderOptions{
-		Container: createOpts.Name,
-		FromImage: createOpts.Config.Image,
+		Container:        createOpts.Name,
+		FromImage:        createOpts.Config.Image,
+		NamespaceOptions: namespaceOptions,
+		ConfigureNetwork: configureNetwork,
 		CommonBuildOpts: &buildah.CommonBuildOptions{
 			HTTPProxy:    true,
 			Memory:       createOpts.HostConfig.Memory,
 			MemorySwap:   createOpts.HostConfig.MemorySwap,
 			CgroupParent: createOpts.HostConfig.CgroupParent,
-			Ulimit:       daemonlessProcessLimits(),
+			Ulimit:       resources.ulimitsWithDefaults(daemonlessProcessLimits()),
+			ShmSize:      resources.ShmSize,
 		},
-		BlobDirectory:  blobCacheDirectory,
-		MaxPullRetries: DefaultPushOrPullRetryCount,
-		PullRetryDelay: DefaultPushOrPullRetryDelay,
+		BlobDirectory: blobCacheDirectory,
 	}
 
-	builder, err := buildah.NewBuilder(ctx, store, builderOptions)
+	var builder *buildah.Builder
+	err := policy.retry(ctx, "Pull", func() (pullErr error) {
+		builder, pullErr = buildah.NewBuilder(ctx, store, builderOptions)
+		return pullErr
+	})
 	if err != nil {
 		return err
 	}
@@ -749,9 +1804,143 @@ func daemonlessRun(ctx context.Context, store storage.Store, isolation buildah.I
 		Stdout:           attachOpts.OutputStream,
 		Stderr:           attachOpts.ErrorStream,
 		DropCapabilities: dropCapabilities(),
+		Mounts:           tmpfsSpecMounts(resources.Tmpfs),
+	}
+
+	err = builder.Run(append(entrypoint, createOpts.Config.Cmd...), runOptions)
+	return network.explainNetworkError(err)
+}
+
+// graphRootUsage returns the space used in, and available to us in, the
+// filesystem at path.
+func graphRootUsage(path string) (used, available uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return (st.Blocks - st.Bfree) * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
+
+// remoteDaemonlessImageSize returns the size of the layers of the image which
+// the registry has for imageName, as they're stored there, without pulling
+// it.  If imageName is a manifest list, the image for our platform is used.
+func remoteDaemonlessImageSize(ctx context.Context, sc types.SystemContext, imageName string, searchPaths []string) (int64, error) {
+	ref, err := alltransports.ParseImageName("docker://" + imageName)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing image name to inspect %s: %v", "docker://"+imageName, err)
+	}
+
+	authFile, removeAuthFile, _, err := pullCredentialsFile(searchPaths)
+	if err != nil {
+		return 0, err
 	}
+	defer removeAuthFile()
 
-	return builder.Run(append(entrypoint, createOpts.Config.Cmd...), runOptions)
+	systemContext := sc
+	systemContext.AuthFilePath = authFile
+
+	img, err := ref.NewImage(ctx, &systemContext)
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+
+	var size int64
+	for _, layer := range img.LayerInfos() {
+		if layer.Size > 0 {
+			size += layer.Size
+		}
+	}
+	return size, nil
+}
+
+// pruneDaemonlessStorage removes images which have no names, other than the
+// ones in keepImages and the ones in manifest lists which have names, and
+// containers, other than the ones in keepContainers, from the store.
+// Newer images are removed first, so that intermediate images are removed
+// before the images that they were built on, and layers which they share are
+// removed along with the last of them.
+func pruneDaemonlessStorage(store storage.Store, keepImages, keepContainers map[string]bool) (images, containers int) {
+	ctrs, err := store.Containers()
+	if err != nil {
+		log.V(2).Infof("Unable to list containers to prune: %v", err)
+	}
+	for _, ctr := range ctrs {
+		if keepContainers[ctr.ID] {
+			continue
+		}
+		if err := store.DeleteContainer(ctr.ID); err != nil {
+			log.V(2).Infof("Unable to prune container %s: %v", ctr.ID, err)
+			continue
+		}
+		containers++
+	}
+
+	imgs, err := store.Images()
+	if err != nil {
+		log.V(2).Infof("Unable to list images to prune: %v", err)
+	}
+	listed := listedImages(store, imgs)
+	sort.Slice(imgs, func(i, j int) bool {
+		return imgs[i].Created.After(imgs[j].Created)
+	})
+	for _, img := range imgs {
+		if len(img.Names) > 0 || keepImages[img.ID] || listed[img.ID] {
+			continue
+		}
+		if _, err := store.DeleteImage(img.ID, true); err != nil {
+			log.V(2).Infof("Unable to prune image %s: %v", img.ID, err)
+			continue
+		}
+		images++
+	}
+	return images, containers
+}
+
+// listedImages returns the IDs of the images which are in the manifest lists,
+// out of imgs, which have names.
+func listedImages(store storage.Store, imgs []storage.Image) map[string]bool {
+	listed := make(map[string]bool)
+	for _, img := range imgs {
+		if len(img.Names) == 0 {
+			continue
+		}
+		_, list, err := manifests.LoadFromImage(store, img.ID)
+		if err != nil {
+			// not a manifest list
+			continue
+		}
+		for _, instance := range list.Instances() {
+			images, err := store.ImagesByDigest(instance)
+			if err != nil {
+				continue
+			}
+			for _, image := range images {
+				listed[image.ID] = true
+			}
+		}
+	}
+	return listed
+}
+
+// storageContents returns the IDs of the images and containers in the store.
+func storageContents(store storage.Store) (images, containers map[string]bool) {
+	images, containers = make(map[string]bool), make(map[string]bool)
+	imgs, err := store.Images()
+	if err != nil {
+		log.V(2).Infof("Unable to list images: %v", err)
+	}
+	for _, img := range imgs {
+		images[img.ID] = true
+	}
+	ctrs, err := store.Containers()
+	if err != nil {
+		log.V(2).Infof("Unable to list containers: %v", err)
+	}
+	for _, ctr := range ctrs {
+		containers[ctr.ID] = true
+	}
+	return images, containers
 }
 
 // DaemonlessClient is a daemonless DockerClient-like implementation.
@@ -760,16 +1949,33 @@ type DaemonlessClient struct {
 	Store                   storage.Store
 	Isolation               buildah.Isolation
 	OCIRuntime              string
-	BlobCacheDirectory      string
+	BlobCache               *BlobCache
 	ImageOptimizationPolicy buildapiv1.ImageOptimizationPolicy
+	Platforms               []BuildPlatform
+	OutputFormat            string
+	PushCompression         *compression.Algorithm
+	AdditionalCompressions  []string
+	layerCache              daemonlessLayerCache
+	network                 daemonlessNetwork
+	resources               resourceOptions
+	signing                 *imageSigning
+	sbomFormat              string
+	sboms                   map[digest.Digest]sbomDocument
+	platformSBOMs           map[string]sbomDocument
 	builders                map[string]*buildah.Builder
+	retryPolicy             retryPolicy
+	storageMonitor          *storageMonitor
+	existingImages          map[string]bool
+	existingContainers      map[string]bool
+	pulledLock              sync.Mutex
+	pulled                  map[string]bool
 }
 
 // GetDaemonlessClient returns a valid implemenatation of the DockerClient
 // interface, or an error if the implementation couldn't be created.
-func GetDaemonlessClient(systemContext types.SystemContext, store storage.Store, blobCacheDirectory string, isolationSpec, ociRuntime string, imageOptimizationPolicy buildapiv1.ImageOptimizationPolicy) (client DockerClient, err error) {
-	if blobCacheDirectory != "" {
-		log.V(0).Infof("Caching blobs under %q.", blobCacheDirectory)
+func GetDaemonlessClient(systemContext types.SystemContext, store storage.Store, blobCache *BlobCache, isolationSpec, ociRuntime string, imageOptimizationPolicy buildapiv1.ImageOptimizationPolicy) (client DockerClient, err error) {
+	if blobCache != nil {
+		log.V(0).Infof("Caching blobs under %q.", blobCache.Directory())
 	}
 
 	var isolation buildah.Isolation
@@ -785,27 +1991,388 @@ func GetDaemonlessClient(systemContext types.SystemContext, store storage.Store,
 		return nil, fmt.Errorf("Unrecognized isolation type %q.", isolationSpec)
 	}
 
+	platforms, err := platformsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	outputFormat, err := imageFormatFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Layers are pushed using gzip compression unless something else is
+	// selected.
+	compressionFormat, additionalCompressions, err := parsePushCompression(os.Getenv(buildutil.BuildPushCompression))
+	if err != nil {
+		return nil, err
+	}
+	if outputFormat == buildah.Dockerv2ImageManifest {
+		// Docker v2s2 manifests can't describe zstd-compressed layers.
+		names := additionalCompressions
+		if compressionFormat != nil {
+			names = append([]string{compressionFormat.Name()}, names...)
+		}
+		for _, name := range names {
+			if name != compression.Gzip.Name() {
+				return nil, fmt.Errorf("%s compression requires the OCI image format, set %s=oci", name, buildutil.BuildImageFormat)
+			}
+		}
+	}
+
+	if len(platforms) < 2 && len(additionalCompressions) > 0 {
+		log.V(0).Infof("Pushing a manifest list which includes %v variants of the image, instead of a single image.", additionalCompressions)
+	}
+
+	layerCache, err := layerCacheFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	network, err := networkFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := resourceOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUlimits(resources.Ulimits, currentHardLimit); err != nil {
+		return nil, err
+	}
+
+	signing, err := imageSigningFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	sbomFormat, err := sbomFormatFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var monitor *storageMonitor
+	var existingImages, existingContainers map[string]bool
+	if store != nil {
+		monitor = newStorageMonitor(store.GraphRoot(), graphRootUsage)
+		monitor.start(storageSampleInterval)
+		// we only prune what we create, and the store may be shared
+		existingImages, existingContainers = storageContents(store)
+	}
+
 	return &DaemonlessClient{
 		SystemContext:           systemContext,
 		Store:                   store,
 		Isolation:               isolation,
 		OCIRuntime:              ociRuntime,
-		BlobCacheDirectory:      blobCacheDirectory,
+		BlobCache:               blobCache,
 		ImageOptimizationPolicy: imageOptimizationPolicy,
+		Platforms:               platforms,
+		OutputFormat:            outputFormat,
+		PushCompression:         compressionFormat,
+		AdditionalCompressions:  additionalCompressions,
+		layerCache:              layerCache,
+		network:                 network,
+		resources:               resources,
+		signing:                 signing,
+		sbomFormat:              sbomFormat,
+		sboms:                   make(map[digest.Digest]sbomDocument),
+		platformSBOMs:           make(map[string]sbomDocument),
 		builders:                make(map[string]*buildah.Builder),
+		retryPolicy:             retryPolicyFromEnv(),
+		storageMonitor:          monitor,
+		existingImages:          existingImages,
+		existingContainers:      existingContainers,
+		pulled:                  make(map[string]bool),
 	}, nil
 }
 
+// optionsContext returns the context from a request's options, or one which is
+// never cancelled if the caller didn't supply one.
+func optionsContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.TODO()
+	}
+	return ctx
+}
+
+// pushPullRetryPolicy returns the retry policy which was read when the client
+// was created.
+func (d *DaemonlessClient) pushPullRetryPolicy() retryPolicy {
+	return d.retryPolicy
+}
+
+// buildsManifestList returns true if the images we build should be added to a
+// manifest list, either because there's more than one of them, or because
+// we'll be adding variants of them which use different compression.  Asking
+// for more than one compression algorithm makes an image for a single
+// platform into a manifest list, too, since that's where variants are listed.
+func (d *DaemonlessClient) buildsManifestList() bool {
+	return len(d.Platforms) > 1 || len(d.AdditionalCompressions) > 0
+}
+
 func (d *DaemonlessClient) BuildImage(opts docker.BuildImageOptions) error {
-	return buildDaemonlessImage(d.SystemContext, d.Store, d.Isolation, d.OCIRuntime, opts.ContextDir, d.ImageOptimizationPolicy, &opts, d.BlobCacheDirectory)
+	ctx := optionsContext(opts.Context)
+	// clear out anything that we left behind before building, whatever
+	// each stage of the build leaves behind before the next one, and
+	// whatever the build leaves behind before pushing
+	d.pruneStorage(nil)
+	defer d.pruneStorage(nil)
+	timestamp, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	squashAll, err := squashAllFromEnv()
+	if err != nil {
+		return err
+	}
+	err = d.BlobCache.Use(d.Store, "build", func() ([]string, error) {
+		err := buildDaemonlessImage(d.SystemContext, d.Store, &opts, daemonlessBuildOptions{
+			Isolation:          d.Isolation,
+			OCIRuntime:         d.OCIRuntime,
+			ContextDir:         opts.ContextDir,
+			Optimization:       d.ImageOptimizationPolicy,
+			BlobCacheDirectory: d.BlobCache.Directory(),
+			Platforms:          d.Platforms,
+			OutputFormat:       d.OutputFormat,
+			ManifestList:       d.buildsManifestList(),
+			LayerCache:         d.layerCache,
+			Timestamp:          timestamp,
+			SquashAll:          squashAll,
+			Network:            d.network,
+			Resources:          d.resources,
+			RetryPolicy:        d.retryPolicy,
+			StageBuilt:         d.pruneStorage,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return daemonlessImageIDs(ctx, d.SystemContext, d.Store, opts.Name), nil
+	})
+	if err != nil || d.sbomFormat == "" {
+		return err
+	}
+	if d.buildsManifestList() {
+		return d.generatePlatformSBOMs(ctx, opts.Name, timestamp)
+	}
+	document, err := generateDaemonlessSBOM(ctx, d.SystemContext, d.Store, opts.Name, sbomImageName(opts.Name), d.sbomFormat, d.OutputFormat, timestamp, true)
+	if err != nil {
+		return err
+	}
+	d.sboms[document.Digest] = document
+	return nil
+}
+
+// generatePlatformSBOMs generates an SBOM for the image for each platform in
+// the manifest list which was built as listName, and records it for that
+// platform, so that it can be attached to each of the images for the platform
+// that the list is pushed with.
+func (d *DaemonlessClient) generatePlatformSBOMs(ctx context.Context, listName string, timestamp *time.Time) error {
+	img, err := findDaemonlessImage(d.SystemContext, d.Store, listName)
+	if err != nil {
+		return err
+	}
+	_, list, err := manifests.LoadFromImage(d.Store, img.ID())
+	if err != nil {
+		return fmt.Errorf("error reading manifest list %s: %v", listName, err)
+	}
+	for _, instance := range list.Instances() {
+		var platform BuildPlatform
+		if platform.OS, err = list.OS(instance); err != nil {
+			return err
+		}
+		if platform.Arch, err = list.Architecture(instance); err != nil {
+			return err
+		}
+		if platform.Variant, err = list.Variant(instance); err != nil {
+			return err
+		}
+		images, err := d.Store.ImagesByDigest(instance)
+		if err != nil || len(images) == 0 {
+			log.V(0).Infof("Warning: not generating an SBOM for %s in %s, which isn't in local storage.", platform, listName)
+			continue
+		}
+		document, err := generateDaemonlessSBOM(ctx, d.SystemContext, d.Store, images[0].ID, sbomImageName(listName), d.sbomFormat, d.OutputFormat, timestamp, false)
+		if err != nil {
+			return err
+		}
+		d.platformSBOMs[platform.String()] = document
+	}
+	return nil
+}
+
+// sbomImageName returns the name which an SBOM should call the image that was
+// built as imageName: the name that it will be pushed as, if there is one.
+func sbomImageName(imageName string) string {
+	build := &buildapiv1.Build{}
+	if err := buildutil.GetBuildFromEnv(build); err == nil && build.Status.OutputDockerImageReference != "" {
+		return build.Status.OutputDockerImageReference
+	}
+	return imageName
 }
 
 func (d *DaemonlessClient) PushImage(opts docker.PushImageOptions, auth docker.AuthConfiguration) (string, error) {
+	ctx := optionsContext(opts.Context)
 	imageName := opts.Name
 	if opts.Tag != "" {
 		imageName = imageName + ":" + opts.Tag
 	}
-	return pushDaemonlessImage(d.SystemContext, d.Store, imageName, auth, d.BlobCacheDirectory)
+	var imageDigest string
+	err := d.BlobCache.Use(d.Store, "push", func() ([]string, error) {
+		var err error
+		imageDigest, err = pushDaemonlessImage(ctx, d.SystemContext, d.Store, imageName, auth, d.BlobCache.Directory(), d.OutputFormat, d.PushCompression, d.AdditionalCompressions)
+		return daemonlessImageIDs(ctx, d.SystemContext, d.Store, imageName), err
+	})
+	if err != nil || len(d.sboms)+len(d.platformSBOMs) == 0 {
+		return imageDigest, err
+	}
+	if err := d.pushSBOM(ctx, imageName, imageDigest, auth); err != nil {
+		return imageDigest, err
+	}
+	return imageDigest, nil
+}
+
+// pushSBOM attaches the SBOM that was generated for the image which was pushed
+// as imageName, if there is one, to the image in the registry.  If a manifest
+// list was pushed, each image in it gets the SBOM for its platform.
+func (d *DaemonlessClient) pushSBOM(ctx context.Context, imageName, imageDigest string, auth docker.AuthConfiguration) error {
+	img, err := findDaemonlessImage(d.SystemContext, d.Store, imageName)
+	if err != nil {
+		return err
+	}
+	isList, err := img.IsManifestList(ctx)
+	if err != nil {
+		return err
+	}
+	if isList {
+		return d.pushPlatformSBOMs(ctx, imageName, imageDigest, auth)
+	}
+	labels, err := img.Labels(ctx)
+	if err != nil {
+		return err
+	}
+	document, ok := d.sboms[digest.Digest(labels[sbomDigestLabel])]
+	if !ok {
+		return nil
+	}
+	artifact, err := pushDaemonlessArtifact(ctx, d.SystemContext, imageName, imageDigest, auth, document.MediaType, document.MediaType, document.Data, "sbom")
+	if err != nil {
+		return err
+	}
+	log.V(0).Infof("Attached SBOM %s to %s as %s", document.Digest, imageName, artifact)
+	return nil
+}
+
+// pushPlatformSBOMs attaches the SBOM that was generated for each platform to
+// the images for that platform in the manifest list which was pushed as
+// imageName, and which has the digest imageDigest.  The list is read back from
+// the registry, since pushing it can convert the images that it lists, and add
+// variants of them which use other compression algorithms.
+func (d *DaemonlessClient) pushPlatformSBOMs(ctx context.Context, imageName, imageDigest string, auth docker.AuthConfiguration) error {
+	if len(d.platformSBOMs) == 0 {
+		return nil
+	}
+	named, err := ireference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return fmt.Errorf("error parsing image name %s: %v", imageName, err)
+	}
+	listDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return fmt.Errorf("error parsing digest %q of image %s: %v", imageDigest, imageName, err)
+	}
+	canonical, err := ireference.WithDigest(ireference.TrimNamed(named), listDigest)
+	if err != nil {
+		return err
+	}
+	ref, err := idocker.NewReference(canonical)
+	if err != nil {
+		return err
+	}
+	systemContext := registrySystemContext(d.SystemContext, auth)
+	src, err := ref.NewImageSource(ctx, &systemContext)
+	if err != nil {
+		return fmt.Errorf("error reading manifest list %s: %v", canonical.String(), err)
+	}
+	defer src.Close()
+	listManifest, listManifestType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error reading manifest list %s: %v", canonical.String(), err)
+	}
+	list, err := manifest.ListFromBlob(listManifest, listManifestType)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest list %s: %v", canonical.String(), err)
+	}
+
+	for instance, platform := range instancePlatforms(list) {
+		document, ok := d.platformSBOMs[platform.String()]
+		if !ok {
+			continue
+		}
+		artifact, err := pushDaemonlessArtifact(ctx, d.SystemContext, imageName, instance.String(), auth, document.MediaType, document.MediaType, document.Data, "sbom")
+		if err != nil {
+			return err
+		}
+		log.V(0).Infof("Attached SBOM %s to the %s image %s@%s as %s", document.Digest, platform, imageName, instance, artifact)
+	}
+	return nil
+}
+
+// instancePlatforms returns the platforms of the images in the manifest list,
+// by their digests.  Instances which don't say which platform they're for are
+// left out.
+func instancePlatforms(list manifest.List) map[digest.Digest]BuildPlatform {
+	platforms := make(map[digest.Digest]BuildPlatform)
+	for _, instance := range list.Instances() {
+		update, err := list.Instance(instance)
+		if err != nil || update.ReadOnly.Platform == nil {
+			continue
+		}
+		platform := update.ReadOnly.Platform
+		platforms[instance] = BuildPlatform{OS: platform.OS, Arch: platform.Architecture, Variant: platform.Variant}
+	}
+	return platforms
+}
+
+// ExportImage writes the image, or manifest list, named name to dest, in the
+// format that the build produces, unless dest can only hold docker images.
+func (d *DaemonlessClient) ExportImage(ctx context.Context, name string, dest types.ImageReference) (string, error) {
+	var imageDigest string
+	err := d.BlobCache.Use(d.Store, "export", func() ([]string, error) {
+		var err error
+		imageDigest, err = exportDaemonlessImage(ctx, d.SystemContext, d.Store, name, dest, d.BlobCache.Directory(), d.OutputFormat, d.PushCompression, d.AdditionalCompressions)
+		return daemonlessImageIDs(ctx, d.SystemContext, d.Store, name), err
+	})
+	return imageDigest, err
+}
+
+// SignImage signs the image which was pushed as name, and which has the
+// digest, with the key that the build was given.  It returns where the
+// signature was stored, or "" if the build wasn't given a key.
+func (d *DaemonlessClient) SignImage(ctx context.Context, name, imageDigest string, auth docker.AuthConfiguration) (string, error) {
+	if d.signing == nil {
+		return "", nil
+	}
+	return signDaemonlessImage(ctx, d.SystemContext, name, imageDigest, auth, d.signing)
+}
+
+// AttachAttestation attaches the in-toto statement to the image which was
+// pushed as name, and which has the digest, in the registry.  If the build was
+// given a sigstore key, the statement is signed with it, in a DSSE envelope.
+func (d *DaemonlessClient) AttachAttestation(ctx context.Context, name, imageDigest string, statement []byte, auth docker.AuthConfiguration) (string, error) {
+	mediaType, data := inTotoMediaType, statement
+	if d.signing != nil {
+		envelope, err := d.signing.signEnvelope(inTotoMediaType, statement)
+		if err != nil {
+			return "", err
+		}
+		if envelope != nil {
+			mediaType, data = dsseEnvelopeMediaType, envelope
+		} else {
+			log.V(0).Infof("Warning: attaching an unsigned attestation to %s, only %s keys can sign attestations.", name, signingFormatSigstore)
+		}
+	}
+	return pushDaemonlessArtifact(ctx, d.SystemContext, name, imageDigest, auth, inTotoMediaType, mediaType, data, "att")
 }
 
 func (d *DaemonlessClient) RemoveImage(name string) error {
@@ -836,11 +2403,97 @@ func (d *DaemonlessClient) RemoveContainer(opts docker.RemoveContainerOptions) e
 }
 
 func (d *DaemonlessClient) PullImage(opts docker.PullImageOptions, searchPaths []string) error {
+	ctx := optionsContext(opts.Context)
 	imageName := opts.Repository
 	if opts.Tag != "" {
 		imageName = imageName + ":" + opts.Tag
 	}
-	return pullDaemonlessImage(d.SystemContext, d.Store, imageName, searchPaths, d.BlobCacheDirectory)
+	return d.BlobCache.Use(d.Store, "pull", func() ([]string, error) {
+		err := pullDaemonlessImage(ctx, d.SystemContext, d.Store, imageName, searchPaths, d.BlobCache.Directory())
+		ids := daemonlessImageIDs(ctx, d.SystemContext, d.Store, imageName)
+		d.pulledLock.Lock()
+		for _, id := range ids {
+			d.pulled[id] = true
+		}
+		d.pulledLock.Unlock()
+		return ids, err
+	})
+}
+
+// CheckStorage returns an insufficientStorageError if the images named names
+// won't fit in the store, along with the space that the build keeps free.
+// Images which are already in the store don't need any more space.  The size
+// of the others is estimated from the size of their layers in the registry,
+// for each platform that the build is for.
+func (d *DaemonlessClient) CheckStorage(ctx context.Context, names, searchPaths []string) error {
+	if d.storageMonitor == nil {
+		return nil
+	}
+	platforms := len(d.Platforms)
+	if platforms < 1 {
+		platforms = 1
+	}
+	var needed uint64
+	for _, name := range names {
+		if _, err := inspectDaemonlessImage(ctx, d.SystemContext, d.Store, name); err == nil {
+			continue
+		}
+		size, err := remoteDaemonlessImageSize(ctx, d.SystemContext, name, searchPaths)
+		if err != nil {
+			log.V(0).Infof("Warning: unable to find the size of %s, not counting it: %v", name, err)
+			continue
+		}
+		needed += estimateImageStorage(size, d.BlobCache.Directory() != "") * uint64(platforms)
+	}
+	return d.storageMonitor.check(needed)
+}
+
+// pruneStorage removes images which have no names and containers which we
+// aren't using from the store.  Only images and containers which weren't in
+// the store when the client was created are removed, since other builds or
+// steps may be using the rest.  Images which we pulled, and the ones in
+// keepImages, are kept, even if they have no names.  This runs before and
+// after each build, and between its stages.
+func (d *DaemonlessClient) pruneStorage(keepImages map[string]bool) {
+	if d.Store == nil {
+		return
+	}
+	keepContainers := make(map[string]bool)
+	for id := range d.existingContainers {
+		keepContainers[id] = true
+	}
+	for _, builder := range d.builders {
+		keepContainers[builder.ContainerID] = true
+	}
+	d.pulledLock.Lock()
+	keep := make(map[string]bool)
+	for id := range keepImages {
+		keep[id] = true
+	}
+	for id := range d.existingImages {
+		keep[id] = true
+	}
+	for id := range d.pulled {
+		keep[id] = true
+	}
+	d.pulledLock.Unlock()
+	images, containers := pruneDaemonlessStorage(d.Store, keep, keepContainers)
+	if images > 0 || containers > 0 {
+		log.V(0).Infof("Pruned %d unused images and %d unused containers.", images, containers)
+	}
+	d.storageMonitor.sample()
+}
+
+// ReportStorage logs the most space that was used in the store while the
+// build ran.
+func (d *DaemonlessClient) ReportStorage() {
+	d.storageMonitor.report()
+}
+
+// ResolveImage returns the digest of the manifest, or manifest list, which
+// the registry has for name, using the credentials in searchPaths.
+func (d *DaemonlessClient) ResolveImage(ctx context.Context, name string, searchPaths []string) (string, error) {
+	return resolveDaemonlessImage(ctx, d.SystemContext, name, searchPaths)
 }
 
 func (d *DaemonlessClient) TagImage(name string, opts docker.TagImageOptions) error {
@@ -851,6 +2504,9 @@ func (d *DaemonlessClient) TagImage(name string, opts docker.TagImageOptions) er
 	return tagDaemonlessImage(d.SystemContext, d.Store, name, imageName)
 }
 
+// InspectImage describes the named image in local storage.  DockerClient's
+// InspectImage doesn't take a context, so callers can't cancel it, but it only
+// reads from local storage.
 func (d *DaemonlessClient) InspectImage(name string) (*docker.Image, error) {
-	return inspectDaemonlessImage(d.SystemContext, d.Store, name)
+	return inspectDaemonlessImage(context.Background(), d.SystemContext, d.Store, name)
 }
@@ -1,17 +1,32 @@
 package builder
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/containers/buildah"
+	"github.com/containers/image/v5/manifest"
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/kubernetes/pkg/credentialprovider"
 
+	buildapiv1 "github.com/openshift/api/build/v1"
+
 	builderutil "github.com/openshift/builder/pkg/build/builder/util"
 )
 
@@ -394,6 +409,451 @@ func TestParseDropCapabilities(t *testing.T) {
 	}
 }
 
+func TestPlatformsFromEnv(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  []BuildPlatform
+		expectErr bool
+	}{
+		{
+			input: "",
+		},
+		{
+			input:    "linux/amd64",
+			expected: []BuildPlatform{{"linux", "amd64", ""}},
+		},
+		{
+			input:    "linux/amd64, linux/arm64/v8,linux/arm/v7,",
+			expected: []BuildPlatform{{"linux", "amd64", ""}, {"linux", "arm64", "v8"}, {"linux", "arm", "v7"}},
+		},
+		{
+			input:     "linux/not-an-arch/v1/extra",
+			expectErr: true,
+		},
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildPlatforms)
+	for _, test := range tests {
+		if err := os.Setenv(builderutil.BuildPlatforms, test.input); err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		actual, err := platformsFromEnv()
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.input, test.expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildPlatforms, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildPlatforms)
+	}
+}
+
+func TestImageFormatFromEnv(t *testing.T) {
+	tests := map[string]string{
+		"":        buildah.Dockerv2ImageManifest,
+		"docker":  buildah.Dockerv2ImageManifest,
+		"oci":     buildah.OCIv1ImageManifest,
+		" OCI ":   buildah.OCIv1ImageManifest,
+		"unknown": "",
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildImageFormat)
+	for input, expected := range tests {
+		if err := os.Setenv(builderutil.BuildImageFormat, input); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		actual, err := imageFormatFromEnv()
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%s: expected %q, got %q", input, expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildImageFormat, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildImageFormat)
+	}
+}
+
+func TestSquashAllFromEnv(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  bool
+		expectErr bool
+	}{
+		{input: "", expected: false},
+		{input: "false", expected: false},
+		{input: "true", expected: true},
+		{input: "1", expected: true},
+		{input: "sometimes", expectErr: true},
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildSquashAll)
+	for _, test := range tests {
+		if err := os.Setenv(builderutil.BuildSquashAll, test.input); err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		actual, err := squashAllFromEnv()
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.input, test.expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildSquashAll, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildSquashAll)
+	}
+}
+
+func TestSecretMountSpecs(t *testing.T) {
+	baseDir := t.TempDir()
+	files := map[string]string{
+		"single/token":                  "token",
+		"single/..data/token":           "token",
+		"multiple/tls.crt":              "crt",
+		"multiple/tls.key":              "key",
+		"multiple/..2024_01_01/tls.key": "key",
+	}
+	for name, content := range files {
+		path := filepath.Join(baseDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secrets := []buildapiv1.SecretBuildSource{
+		{Secret: corev1.LocalObjectReference{Name: "single"}},
+		{Secret: corev1.LocalObjectReference{Name: "multiple"}, DestinationDir: "certs"},
+	}
+	expected := []string{
+		"id=single/token,src=" + filepath.Join(baseDir, "single", "token") + ",type=file",
+		"id=single,src=" + filepath.Join(baseDir, "single", "token") + ",type=file",
+		"id=multiple/tls.crt,src=" + filepath.Join(baseDir, "multiple", "tls.crt") + ",type=file",
+		"id=multiple/tls.key,src=" + filepath.Join(baseDir, "multiple", "tls.key") + ",type=file",
+	}
+	actual, err := secretMountSpecs(secrets, baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	missing := []buildapiv1.SecretBuildSource{{Secret: corev1.LocalObjectReference{Name: "missing"}}}
+	if _, err := secretMountSpecs(missing, baseDir); err == nil {
+		t.Errorf("expected an error for a secret which isn't mounted")
+	}
+}
+
+func TestSourceSecretSSHAgent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	tests := map[string]struct {
+		files              map[string]string
+		expectAgent        bool
+		expectKnownHostsID bool
+	}{
+		"no key": {
+			files: map[string]string{"password": "secret"},
+		},
+		"unusable key": {
+			files: map[string]string{"ssh-privatekey": "not a key"},
+		},
+		"key": {
+			files:       map[string]string{"ssh-privatekey": string(privateKey)},
+			expectAgent: true,
+		},
+		"key and known hosts": {
+			files:              map[string]string{"ssh-privatekey": string(privateKey), "known_hosts": "github.com ssh-ed25519 AAAA"},
+			expectAgent:        true,
+			expectKnownHostsID: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for file, content := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sshSources, knownHosts := sourceSecretSSHAgent(dir)
+			if test.expectAgent {
+				expected := []string{"default=" + filepath.Join(dir, "ssh-privatekey")}
+				if !reflect.DeepEqual(expected, sshSources) {
+					t.Errorf("expected SSH sources %v, got %v", expected, sshSources)
+				}
+			} else if len(sshSources) > 0 {
+				t.Errorf("expected no SSH sources, got %v", sshSources)
+			}
+			if test.expectKnownHostsID {
+				expected := []string{"id=known_hosts,src=" + filepath.Join(dir, "known_hosts") + ",type=file"}
+				if !reflect.DeepEqual(expected, knownHosts) {
+					t.Errorf("expected known hosts secrets %v, got %v", expected, knownHosts)
+				}
+			} else if len(knownHosts) > 0 {
+				t.Errorf("expected no known hosts secret, got %v", knownHosts)
+			}
+		})
+	}
+
+	if sshSources, knownHosts := sourceSecretSSHAgent(""); sshSources != nil || knownHosts != nil {
+		t.Errorf("expected nothing without a source secret, got %v and %v", sshSources, knownHosts)
+	}
+}
+
+func TestNetworkFromEnv(t *testing.T) {
+	tests := map[string]daemonlessNetwork{
+		"":         networkHost,
+		"host":     networkHost,
+		"private":  networkPrivate,
+		" None ":   networkNone,
+		"internet": "",
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildNetwork)
+	for input, expected := range tests {
+		if err := os.Setenv(builderutil.BuildNetwork, input); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		actual, err := networkFromEnv()
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%s: expected %q, got %q", input, expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildNetwork, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildNetwork)
+	}
+}
+
+func TestNetworkNamespaceOptions(t *testing.T) {
+	tests := map[daemonlessNetwork]struct {
+		host             bool
+		configureNetwork buildah.NetworkConfigurationPolicy
+	}{
+		networkHost:    {host: true, configureNetwork: buildah.NetworkDefault},
+		networkPrivate: {host: false, configureNetwork: buildah.NetworkEnabled},
+		networkNone:    {host: false, configureNetwork: buildah.NetworkDisabled},
+	}
+	for network, expected := range tests {
+		namespaceOptions, configureNetwork := network.namespaceOptions()
+		namespace := namespaceOptions.Find(string(specs.NetworkNamespace))
+		if namespace == nil {
+			t.Errorf("%s: expected network namespace options, got %v", network, namespaceOptions)
+			continue
+		}
+		if namespace.Host != expected.host {
+			t.Errorf("%s: expected host network %v, got %v", network, expected.host, namespace.Host)
+		}
+		if configureNetwork != expected.configureNetwork {
+			t.Errorf("%s: expected network configuration %v, got %v", network, expected.configureNetwork, configureNetwork)
+		}
+	}
+
+	failure := errors.New("curl: (6) Could not resolve host: example.com")
+	if err := networkHost.explainNetworkError(failure); err != failure {
+		t.Errorf("expected errors with host networking to be unchanged, got %v", err)
+	}
+	if err := networkNone.explainNetworkError(failure); !errors.Is(err, failure) || !strings.Contains(err.Error(), builderutil.BuildNetwork) {
+		t.Errorf("expected the error to mention that networking is disabled, got %v", err)
+	}
+	refused := fmt.Errorf("dial tcp 10.0.0.1:443: %w", syscall.ECONNREFUSED)
+	if err := networkNone.explainNetworkError(refused); !strings.Contains(err.Error(), builderutil.BuildNetwork) {
+		t.Errorf("expected a refused connection to mention that networking is disabled, got %v", err)
+	}
+	other := errors.New("exit status 1")
+	if err := networkNone.explainNetworkError(other); err != other {
+		t.Errorf("expected an error which isn't about the network to be unchanged, got %v", err)
+	}
+	if err := networkNone.explainNetworkError(nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestParsePushCompression(t *testing.T) {
+	tests := []struct {
+		input      string
+		primary    string
+		additional []string
+		expectErr  bool
+	}{
+		{
+			input: "",
+		},
+		{
+			input:   "gzip",
+			primary: "gzip",
+		},
+		{
+			input:   "zstd:chunked",
+			primary: "zstd:chunked",
+		},
+		{
+			input:      "ZSTD, gzip,zstd",
+			primary:    "zstd",
+			additional: []string{"gzip"},
+		},
+		{
+			input:     "zstd,lz4",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		primary, additional, err := parsePushCompression(test.input)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		actual := ""
+		if primary != nil {
+			actual = primary.Name()
+		}
+		if actual != test.primary {
+			t.Errorf("%q: expected %q, got %q", test.input, test.primary, actual)
+		}
+		if !reflect.DeepEqual(additional, test.additional) {
+			t.Errorf("%q: expected additional %v, got %v", test.input, test.additional, additional)
+		}
+	}
+}
+
+func TestLayerCacheFromEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		from      string
+		to        string
+		ttl       string
+		expected  []string
+		expectTTL time.Duration
+		expectErr bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:      "from and to",
+			from:      "registry.example.com/cache/app, quay.io/cache/app",
+			to:        "registry.example.com/cache/app",
+			ttl:       "168h",
+			expected:  []string{"registry.example.com/cache/app", "quay.io/cache/app", "registry.example.com/cache/app"},
+			expectTTL: 168 * time.Hour,
+		},
+		{
+			name:     "normalized",
+			to:       "cache",
+			expected: []string{"docker.io/library/cache"},
+		},
+		{
+			name:      "tagged",
+			from:      "registry.example.com/cache/app:latest",
+			expectErr: true,
+		},
+		{
+			name:      "bad ttl",
+			ttl:       "a week",
+			expectErr: true,
+		},
+	}
+	envs := []string{builderutil.BuildCacheFrom, builderutil.BuildCacheTo, builderutil.BuildCacheTTL}
+	preserved := make(map[string]string)
+	for _, env := range envs {
+		if value, ok := os.LookupEnv(env); ok {
+			preserved[env] = value
+		}
+	}
+	for _, test := range tests {
+		os.Setenv(builderutil.BuildCacheFrom, test.from)
+		os.Setenv(builderutil.BuildCacheTo, test.to)
+		os.Setenv(builderutil.BuildCacheTTL, test.ttl)
+		cache, err := layerCacheFromEnv()
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var actual []string
+		for _, repo := range append(cache.From, cache.To...) {
+			actual = append(actual, repo.String())
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+		if cache.TTL != test.expectTTL {
+			t.Errorf("%s: expected TTL %v, got %v", test.name, test.expectTTL, cache.TTL)
+		}
+	}
+	for _, env := range envs {
+		if value, ok := preserved[env]; ok {
+			os.Setenv(env, value)
+		} else {
+			os.Unsetenv(env)
+		}
+	}
+}
+
 type appendFunc func(string, *TransientMounts) error
 
 func coreTestSubscriptionDirMounts(t *testing.T, path string, fn appendFunc) {
@@ -712,3 +1172,32 @@ func TestAppendCATrustMount(t *testing.T) {
 		})
 	}
 }
+
+func TestInstancePlatforms(t *testing.T) {
+	amd64 := digest.FromString("amd64")
+	amd64Zstd := digest.FromString("amd64+zstd")
+	arm64 := digest.FromString("arm64")
+	unknown := digest.FromString("unknown")
+	index := fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": [
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": %q, "size": 1, "platform": {"os": "linux", "architecture": "amd64"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": %q, "size": 1, "platform": {"os": "linux", "architecture": "amd64"}, "annotations": {"io.github.containers.compression.zstd": "true"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": %q, "size": 1, "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": %q, "size": 1}
+		]
+	}`, amd64, amd64Zstd, arm64, unknown)
+	list, err := manifest.ListFromBlob([]byte(index), "application/vnd.oci.image.index.v1+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[digest.Digest]BuildPlatform{
+		amd64:     {OS: "linux", Arch: "amd64"},
+		amd64Zstd: {OS: "linux", Arch: "amd64"},
+		arm64:     {OS: "linux", Arch: "arm64", Variant: "v8"},
+	}
+	if actual := instancePlatforms(list); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,149 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/openshift/builder/pkg/build/builder/cmd/dockercfg"
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// optionalDestination is the suffix which marks an additional destination as
+// one that the build can succeed without.
+const optionalDestination = ";optional"
+
+// pushDestination is an image, other than the build's output image, which
+// the build's output is also pushed to.
+type pushDestination struct {
+	Name     string
+	Optional bool
+}
+
+// pushedImage is an image which a build pushed, along with the credentials
+// it was pushed with.
+type pushedImage struct {
+	Name   string
+	Digest string
+	Auth   docker.AuthConfiguration
+}
+
+// additionalDestinations returns the destinations, other than pushTag, that
+// the build's output should also be pushed to.  Destinations which are just
+// a tag are in pushTag's repository, and variables in them are expanded using
+// vars, so that a destination can be tagged with the commit being built.
+func additionalDestinations(pushTag string, vars []KeyValue) ([]pushDestination, error) {
+	spec := strings.TrimSpace(os.Getenv(builderutil.BuildAdditionalDestinations))
+	if spec == "" {
+		return nil, nil
+	}
+	values := make(map[string]string)
+	for _, kv := range vars {
+		values[kv.Key] = kv.Value
+	}
+	repository, _ := docker.ParseRepositoryTag(pushTag)
+
+	var destinations []pushDestination
+	seen := map[string]bool{pushTag: true}
+	for _, field := range strings.Fields(spec) {
+		name, optional := strings.CutSuffix(field, optionalDestination)
+		var missing []string
+		name = os.Expand(name, func(key string) string {
+			value, ok := values[key]
+			if !ok || value == "" {
+				missing = append(missing, key)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("error parsing %s destination %q: %s not known", builderutil.BuildAdditionalDestinations, field, strings.Join(missing, ", "))
+		}
+		if strings.HasPrefix(name, ":") {
+			name = repository + name
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s destination %q: %v", builderutil.BuildAdditionalDestinations, field, err)
+		}
+		if _, ok := named.(reference.Digested); ok {
+			return nil, fmt.Errorf("error parsing %s destination %q: images can't be pushed by digest", builderutil.BuildAdditionalDestinations, field)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		destinations = append(destinations, pushDestination{Name: name, Optional: optional})
+	}
+	return destinations, nil
+}
+
+// pushAdditionalDestinations tags image with each of the destinations and
+// pushes it there, using the push credentials for the destination's
+// registry.  Layers which were already pushed are reused by the registry
+// instead of being uploaded again.  Destinations that couldn't be pushed are
+// logged, and if any of them weren't optional an error is returned.
+func pushAdditionalDestinations(ctx context.Context, client DockerClient, image string, destinations []pushDestination, push func(ctx context.Context, name string, authConfig docker.AuthConfiguration) (string, error)) ([]pushedImage, error) {
+	var pushed []pushedImage
+	var failed []string
+	for _, destination := range destinations {
+		if err := ctx.Err(); err != nil {
+			return pushed, err
+		}
+		authConfig, authPresent := dockercfg.NewHelper().GetDockerAuth(destination.Name, dockercfg.PushAuthType)
+		if authPresent {
+			log.V(4).Infof("Authenticating push to %s with user %q", destination.Name, authConfig.Username)
+		}
+		log.V(0).Infof("\nPushing image %s ...", destination.Name)
+		err := tagImage(client, image, destination.Name)
+		var digest string
+		if err == nil {
+			digest, err = push(ctx, destination.Name, authConfig)
+		}
+		if err != nil {
+			if destination.Optional {
+				log.V(0).Infof("Warning: failed to push image to optional destination %s: %v", destination.Name, err)
+				continue
+			}
+			log.V(0).Infof("Failed to push image to %s: %v", destination.Name, err)
+			failed = append(failed, destination.Name)
+			continue
+		}
+		pushed = append(pushed, pushedImage{Name: destination.Name, Digest: digest, Auth: authConfig})
+	}
+	if len(failed) > 0 {
+		return pushed, fmt.Errorf("unable to push image to %s", strings.Join(failed, ", "))
+	}
+	return pushed, nil
+}
+
+// distinctRepositories returns the images, leaving out those which are in the
+// same repository, with the same digest, as one of the images before them.
+func distinctRepositories(images []pushedImage) []pushedImage {
+	var distinct []pushedImage
+	seen := make(map[string]bool)
+	for _, image := range images {
+		repository, _ := docker.ParseRepositoryTag(image.Name)
+		if seen[repository+"@"+image.Digest] {
+			continue
+		}
+		seen[repository+"@"+image.Digest] = true
+		distinct = append(distinct, image)
+	}
+	return distinct
+}
+
+// logPushedImages logs each of the images that the build's output was pushed
+// as, with their digests.
+func logPushedImages(images []pushedImage) {
+	for _, image := range images {
+		if image.Digest == "" {
+			log.V(0).Infof("Pushed image %s", image.Name)
+		} else {
+			log.V(0).Infof("Pushed image %s@%s", image.Name, image.Digest)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestAdditionalDestinations(t *testing.T) {
+	vars := []KeyValue{
+		{"OPENSHIFT_BUILD_NAME", "app-1"},
+		{"OPENSHIFT_BUILD_COMMIT", "1575a90c569a7cc0eea84fbd3304d9df37c9f5ee"},
+	}
+	tests := []struct {
+		spec     string
+		expected []pushDestination
+		err      bool
+	}{
+		{spec: ""},
+		{
+			spec: ":latest :${OPENSHIFT_BUILD_COMMIT} :1.2.3",
+			expected: []pushDestination{
+				{Name: "registry.example.com:5000/ns/app:latest"},
+				{Name: "registry.example.com:5000/ns/app:1575a90c569a7cc0eea84fbd3304d9df37c9f5ee"},
+				{Name: "registry.example.com:5000/ns/app:1.2.3"},
+			},
+		},
+		{
+			spec: "mirror.example.com/ns/app:v1;optional\n:v1 :v1 registry.example.com:5000/ns/app:v2",
+			expected: []pushDestination{
+				{Name: "mirror.example.com/ns/app:v1", Optional: true},
+				{Name: "registry.example.com:5000/ns/app:v2"},
+			},
+		},
+		{spec: ":${OPENSHIFT_BUILD_SOURCE}", err: true},
+		{spec: ":not/a/tag", err: true},
+		{spec: "mirror.example.com/ns/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", err: true},
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildAdditionalDestinations)
+	for _, test := range tests {
+		if err := os.Setenv(builderutil.BuildAdditionalDestinations, test.spec); err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		actual, err := additionalDestinations("registry.example.com:5000/ns/app:v1", vars)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.spec, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildAdditionalDestinations, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildAdditionalDestinations)
+	}
+}
+
+func TestPushAdditionalDestinations(t *testing.T) {
+	digests := map[string]string{
+		"registry.example.com/ns/app:latest": "sha256:1111",
+		"mirror.example.com/ns/app:v1":       "sha256:1111",
+	}
+	push := func(ctx context.Context, name string, authConfig docker.AuthConfiguration) (string, error) {
+		if digest, ok := digests[name]; ok {
+			return digest, nil
+		}
+		return "", fmt.Errorf("unauthorized")
+	}
+	destinations := []pushDestination{
+		{Name: "registry.example.com/ns/app:latest"},
+		{Name: "broken.example.com/ns/app:v1", Optional: true},
+		{Name: "mirror.example.com/ns/app:v1"},
+	}
+
+	client := NewFakeDockerClient()
+	pushed, err := pushAdditionalDestinations(context.Background(), client, "registry.example.com/ns/app:v1", destinations, push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, image := range pushed {
+		names = append(names, image.Name+"@"+image.Digest)
+	}
+	expected := []string{"registry.example.com/ns/app:latest@sha256:1111", "mirror.example.com/ns/app:v1@sha256:1111"}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("expected %v to be pushed, got %v", expected, names)
+	}
+	if len(client.callLog) != len(destinations) {
+		t.Errorf("expected each destination to be tagged, got %v", client.callLog)
+	}
+
+	destinations[1].Optional = false
+	if _, err := pushAdditionalDestinations(context.Background(), client, "registry.example.com/ns/app:v1", destinations, push); err == nil {
+		t.Errorf("expected an error when a required destination can't be pushed")
+	}
+}
+
+func TestDistinctRepositories(t *testing.T) {
+	pushed := []pushedImage{
+		{Name: "registry.example.com/ns/app:v1", Digest: "sha256:1111"},
+		{Name: "registry.example.com/ns/app:latest", Digest: "sha256:1111"},
+		{Name: "mirror.example.com:5000/ns/app:v1", Digest: "sha256:1111"},
+	}
+	if distinct := distinctRepositories(pushed); !reflect.DeepEqual([]pushedImage{pushed[0], pushed[2]}, distinct) {
+		t.Errorf("expected one image for each repository, got %v", distinct)
+	}
+}
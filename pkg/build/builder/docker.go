@@ -35,6 +35,7 @@ type DockerBuilder struct {
 	client       buildclientv1.BuildInterface
 	cgLimits     *s2iapi.CGroupLimits
 	inputDir     string
+	retryPolicy  retryPolicy
 }
 
 // NewDockerBuilder creates a new instance of DockerBuilder
@@ -45,14 +46,15 @@ func NewDockerBuilder(dockerClient DockerClient, buildsClient buildclientv1.Buil
 		client:       buildsClient,
 		cgLimits:     cgLimits,
 		inputDir:     InputContentPath,
+		retryPolicy:  clientRetryPolicy(dockerClient),
 	}
 }
 
-// Build executes a Docker build
-func (d *DockerBuilder) Build() error {
+// Build executes a Docker build, stopping early if ctx is cancelled
+func (d *DockerBuilder) Build(ctx context.Context) error {
 
 	var err error
-	ctx := timing.NewContext(context.Background())
+	ctx = timing.NewContext(ctx)
 	defer func() {
 		d.build.Status.Stages = timing.AppendStageAndStepInfo(d.build.Status.Stages, timing.GetStages(ctx))
 		HandleBuildStatusUpdate(d.build, d.client, nil)
@@ -77,16 +79,38 @@ func (d *DockerBuilder) Build() error {
 		push = true
 	}
 
+	var destinations []pushDestination
+	if push {
+		sourceInfo, err := readSourceInfo()
+		if err != nil {
+			return fmt.Errorf("error reading git source info: %v", err)
+		}
+		destinations, err = additionalDestinations(pushTag, buildInfo(d.build, sourceInfo))
+		if err != nil {
+			return err
+		}
+	}
+	exportTo, err := exportDestinationFromEnv()
+	if err != nil {
+		return err
+	}
+
 	buildTag := randomBuildTag(d.build.Namespace, d.build.Name)
 	dockerfilePath := getDockerfilePath(buildDir, d.build)
 
-	imageNames, err := findReferencedImages(dockerfilePath, d.build.Spec.Strategy.DockerStrategy.BuildArgs)
+	imageNames, err := findReferencedImages(dockerfilePath, d.build.Spec.Strategy.DockerStrategy.BuildArgs, buildTarget())
 	if err != nil {
 		return err
 	}
 	if len(imageNames) == 0 {
 		return fmt.Errorf("no FROM image in Dockerfile")
 	}
+	if err := checkBaseImagePolicy(imageNames); err != nil {
+		SetFailedStatus(ctx, d.build, builderutil.StatusReasonBaseImagePolicyViolation, builderutil.StatusMessageBaseImagePolicyViolation)
+		HandleBuildStatusUpdate(d.build, d.client, nil)
+		return err
+	}
+	var pulls []string
 	for _, imageName := range imageNames {
 		if imageName == "scratch" {
 			log.V(4).Infof("\nSkipping image \"scratch\"")
@@ -103,22 +127,46 @@ func (d *DockerBuilder) Build() error {
 		}
 		// if forcePull or the image does not exist on the node we should pull the image first
 		if d.build.Spec.Strategy.DockerStrategy.ForcePull || !imageExists {
-			searchPaths := dockercfg.NewHelper().GetDockerAuthSearchPaths(dockercfg.PullAuthType)
+			pulls = append(pulls, imageName)
+		}
+	}
+	pinned := make(map[string]string)
+	if len(pulls) > 0 {
+		searchPaths := dockercfg.NewHelper().GetDockerAuthSearchPaths(dockercfg.PullAuthType)
+		if pinImagesEnabled() {
+			// pull images by digest, so that the build uses them even if
+			// they're retagged while it runs
+			pinned = resolveImages(ctx, d.dockerClient, pulls, searchPaths)
+		}
+		if err := checkStorage(ctx, d.dockerClient, pinnedImageNames(pulls, pinned), searchPaths); err != nil {
+			SetFailedStatus(ctx, d.build, builderutil.StatusReasonInsufficientStorage, builderutil.StatusMessageInsufficientStorage)
+			HandleBuildStatusUpdate(d.build, d.client, nil)
+			return err
+		}
+		err = pullImagesInParallel(ctx, pinnedImageNames(pulls, pinned), pullConcurrency(), buildapiv1.StepPullBaseImage, func(imageName string) error {
 			log.V(0).Infof("\nPulling image %s ...", imageName)
-			startTime := metav1.Now()
-			err = d.pullImage(imageName, searchPaths)
-
-			timing.RecordNewStep(ctx, buildapiv1.StagePullImages, buildapiv1.StepPullBaseImage, startTime, metav1.Now())
+			return d.pullImage(ctx, imageName, searchPaths)
+		})
+		if err != nil {
+			SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonPullBuilderImageFailed, builderutil.StatusMessagePullBuilderImageFailed)
+			HandleBuildStatusUpdate(d.build, d.client, nil)
+			return fmt.Errorf("failed to pull images: %v", err)
+		}
+	}
 
-			if err != nil {
-				d.build.Status.Phase = buildapiv1.BuildPhaseFailed
-				d.build.Status.Reason = buildapiv1.StatusReasonPullBuilderImageFailed
-				d.build.Status.Message = builderutil.StatusMessagePullBuilderImageFailed
-				HandleBuildStatusUpdate(d.build, d.client, nil)
-				return fmt.Errorf("failed to pull image: %v", err)
-			}
+	if policy := d.build.Spec.Strategy.DockerStrategy.ImageOptimizationPolicy; policy != nil && *policy == buildapiv1.ImageOptimizationSkipLayersAndWarn {
+		log.V(0).Infof("Warning: %s", builderutil.StatusMessageSkipLayersWarning)
+		d.build.Status.Message = builderutil.StatusMessageSkipLayersWarning
+		HandleBuildStatusUpdate(d.build, d.client, nil)
+	}
 
+	if pinImagesEnabled() {
+		pinLocalImages(d.dockerClient, imageNames, pinned)
+		if err := pinDockerfileImages(dockerfilePath, d.build.Spec.Strategy.DockerStrategy.BuildArgs, pinned); err != nil {
+			return fmt.Errorf("error pinning images to digests: %v", err)
 		}
+		logPinnedImages(pinned)
+		imageNames = pinnedImageNames(imageNames, pinned)
 	}
 
 	startTime := metav1.Now()
@@ -127,13 +175,19 @@ func (d *DockerBuilder) Build() error {
 	timing.RecordNewStep(ctx, buildapiv1.StageBuild, buildapiv1.StepDockerBuild, startTime, metav1.Now())
 
 	if err != nil {
-		d.build.Status.Phase = buildapiv1.BuildPhaseFailed
-		d.build.Status.Reason = buildapiv1.StatusReasonDockerBuildFailed
-		d.build.Status.Message = builderutil.StatusMessageDockerBuildFailed
+		SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonDockerBuildFailed, builderutil.StatusMessageDockerBuildFailed)
 		HandleBuildStatusUpdate(d.build, d.client, nil)
 		return err
 	}
 
+	if exportTo != nil {
+		if err := exportImage(ctx, d.dockerClient, buildTag, exportTo); err != nil {
+			SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonGenericBuildFailed, builderutil.StatusMessageExportImageFailed)
+			HandleBuildStatusUpdate(d.build, d.client, nil)
+			return fmt.Errorf("Failed to export image: %v", err)
+		}
+	}
+
 	if push {
 		if err := tagImage(d.dockerClient, buildTag, pushTag); err != nil {
 			return err
@@ -155,18 +209,34 @@ func (d *DockerBuilder) Build() error {
 		}
 		log.V(0).Infof("\nPushing image %s ...", pushTag)
 		startTime = metav1.Now()
-		digest, err := d.pushImage(pushTag, pushAuthConfig)
+		digest, err := d.pushImage(ctx, pushTag, pushAuthConfig)
 
 		timing.RecordNewStep(ctx, buildapiv1.StagePushImage, buildapiv1.StepPushDockerImage, startTime, metav1.Now())
 
 		if err != nil {
-			d.build.Status.Phase = buildapiv1.BuildPhaseFailed
-			d.build.Status.Reason = buildapiv1.StatusReasonPushImageToRegistryFailed
-			d.build.Status.Message = builderutil.StatusMessagePushImageToRegistryFailed
+			SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessagePushImageToRegistryFailed)
 			HandleBuildStatusUpdate(d.build, d.client, nil)
 			return reportPushFailure(err, authPresent, pushAuthConfig)
 		}
 
+		pushed := []pushedImage{{Name: pushTag, Digest: digest, Auth: pushAuthConfig}}
+		if len(destinations) > 0 {
+			// the build's output isn't reported until it has been pushed
+			// to every destination that it has to be pushed to
+			startTime = metav1.Now()
+			additional, err := pushAdditionalDestinations(ctx, d.dockerClient, pushTag, destinations, d.pushImage)
+
+			timing.RecordNewStep(ctx, buildapiv1.StagePushImage, buildapiv1.StepPushDockerImage, startTime, metav1.Now())
+
+			if err != nil {
+				SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessagePushAdditionalDestinationFailed)
+				HandleBuildStatusUpdate(d.build, d.client, nil)
+				return fmt.Errorf("Failed to push image: %v", err)
+			}
+			pushed = append(pushed, additional...)
+			logPushedImages(pushed)
+		}
+
 		if len(digest) > 0 {
 			d.build.Status.Output.To = &buildapiv1.BuildStatusOutputTo{
 				ImageDigest: digest,
@@ -174,13 +244,33 @@ func (d *DockerBuilder) Build() error {
 			HandleBuildStatusUpdate(d.build, d.client, nil)
 		}
 		log.V(0).Infof("Push successful")
+
+		for i, image := range distinctRepositories(pushed) {
+			signature, err := signPushedImage(ctx, d.dockerClient, d.retryPolicy, image.Name, image.Digest, image.Auth)
+			if err != nil {
+				SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessageSignImageFailed)
+				HandleBuildStatusUpdate(d.build, d.client, nil)
+				return fmt.Errorf("Failed to sign image: %v", err)
+			}
+			if signature != "" && i == 0 {
+				d.build.Status.Message = appendSignatureMessage(d.build.Status.Message, signature)
+				HandleBuildStatusUpdate(d.build, d.client, nil)
+			}
+
+			if err := attachProvenance(ctx, d.dockerClient, d.retryPolicy, d.build, image.Name, image.Digest, imageNames, image.Auth); err != nil {
+				SetFailedStatus(ctx, d.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessageAttachProvenanceFailed)
+				HandleBuildStatusUpdate(d.build, d.client, nil)
+				return fmt.Errorf("Failed to attach provenance attestation: %v", err)
+			}
+		}
 	}
 	return nil
 }
 
-func (d *DockerBuilder) pullImage(name string, searchPaths []string) error {
+func (d *DockerBuilder) pullImage(ctx context.Context, name string, searchPaths []string) error {
 	repository, tag := docker.ParseRepositoryTag(name)
 	options := docker.PullImageOptions{
+		Context:    ctx,
 		Repository: repository,
 		Tag:        tag,
 	}
@@ -189,20 +279,21 @@ func (d *DockerBuilder) pullImage(name string, searchPaths []string) error {
 		options.Repository = name
 	}
 
-	return retryImageAction("Pull", func() (pullErr error) {
+	return d.retryPolicy.retry(ctx, "Pull", func() (pullErr error) {
 		return d.dockerClient.PullImage(options, searchPaths)
 	})
 }
 
-func (d *DockerBuilder) pushImage(name string, authConfig docker.AuthConfiguration) (string, error) {
+func (d *DockerBuilder) pushImage(ctx context.Context, name string, authConfig docker.AuthConfiguration) (string, error) {
 	repository, tag := docker.ParseRepositoryTag(name)
 	options := docker.PushImageOptions{
-		Name: repository,
-		Tag:  tag,
+		Context: ctx,
+		Name:    repository,
+		Tag:     tag,
 	}
 	var err error
 	sha := ""
-	retryImageAction("Push", func() (pushErr error) {
+	d.retryPolicy.retry(ctx, "Push", func() (pushErr error) {
 		sha, err = d.dockerClient.PushImage(options, authConfig)
 		return err
 	})
@@ -330,7 +421,13 @@ func (d *DockerBuilder) dockerBuild(ctx context.Context, dir string, tag string)
 
 	auth := mergeNodeCredentialsDockerAuth(os.Getenv(dockercfg.PullAuthType))
 
-	if err := d.copySecrets(d.build.Spec.Source.Secrets, dir); err != nil {
+	if useSecretMounts() {
+		// The secrets are made available to RUN --mount=type=secret
+		// instructions by the daemonless client instead.
+		if len(d.build.Spec.Source.Secrets) > 0 {
+			log.V(0).Infof("Not copying build secrets into the build context, they can be used with RUN --mount=type=secret instructions.")
+		}
+	} else if err := d.copySecrets(d.build.Spec.Source.Secrets, dir); err != nil {
 		return err
 	}
 	if err := d.copyConfigMaps(d.build.Spec.Source.ConfigMaps, dir); err != nil {
@@ -348,6 +445,7 @@ func (d *DockerBuilder) dockerBuild(ctx context.Context, dir string, tag string)
 		Pull:                forcePull,
 		BuildArgs:           buildArgs,
 		ContextDir:          dir,
+		Target:              buildTarget(),
 	}
 
 	// Though we are capped on memory and cpu at the cgroup parent level,
@@ -417,6 +515,46 @@ func replaceLastFrom(node *parser.Node, image string, alias string) {
 	}
 }
 
+// truncateToStage removes the stages which follow the stage named target
+// from node, leaving the target as the last stage.
+func truncateToStage(node *parser.Node, target string) error {
+	if node == nil {
+		return nil
+	}
+	found := false
+	for i, child := range node.Children {
+		if child == nil || child.Value != dockercmd.From {
+			continue
+		}
+		if found {
+			log.V(4).Infof("Ignoring the stages after the target stage %q", target)
+			node.Children = node.Children[:i]
+			return nil
+		}
+		found = stageName(child) == canonicalStageName(target)
+	}
+	if !found {
+		return fmt.Errorf("target stage %q was not found in the Dockerfile", target)
+	}
+	return nil
+}
+
+// stageName returns the name which a FROM instruction gives its stage, in the
+// form returned by canonicalStageName, or "" if it doesn't name its stage.
+func stageName(from *parser.Node) string {
+	if from.Next != nil && from.Next.Next != nil && strings.ToUpper(from.Next.Next.Value) == "AS" && from.Next.Next.Next != nil {
+		return canonicalStageName(from.Next.Next.Next.Value)
+	}
+	return ""
+}
+
+// canonicalStageName returns the form of a stage name which we compare to
+// other stage names.  Stage names aren't case sensitive, so it's in lower
+// case.
+func canonicalStageName(name string) string {
+	return strings.ToLower(name)
+}
+
 // getLastFrom gets the image name of the last FROM instruction
 // in the dockerfile
 func getLastFrom(node *parser.Node) (string, string) {
@@ -456,14 +594,16 @@ func appendLabel(node *parser.Node, m []dockerfile.KeyValue) error {
 	return appendKeyValueInstruction(dockerfile.Label, node, m)
 }
 
-// appendPostCommit appends a RUN <cmd> Dockerfile instruction as the last child of node
-func appendPostCommit(node *parser.Node, cmd string) error {
+// appendPostCommit appends a RUN <cmd> Dockerfile instruction as the last child of node.
+// If target is set, it names the last stage of node, and the stage which produces the
+// image after the command has run is given that name in its place.
+func appendPostCommit(node *parser.Node, cmd string, target string) error {
 	if len(cmd) == 0 {
 		return nil
 	}
 
 	image, alias := getLastFrom(node)
-	if len(alias) == 0 {
+	if len(alias) == 0 || len(target) > 0 {
 		alias = postCommitAlias
 		replaceLastFrom(node, image, alias)
 	}
@@ -476,7 +616,11 @@ func appendPostCommit(node *parser.Node, cmd string) error {
 		return err
 	}
 
-	if err := appendStringInstruction(dockerfile.From, node, alias); err != nil {
+	final := alias
+	if len(target) > 0 {
+		final = alias + " as " + target
+	}
+	if err := appendStringInstruction(dockerfile.From, node, final); err != nil {
 		return err
 	}
 
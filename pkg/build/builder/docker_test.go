@@ -152,6 +152,7 @@ func TestAppendPostCommit(t *testing.T) {
 		description string
 		original    string
 		postCommit  buildapiv1.BuildPostCommitSpec
+		target      string
 		from        *corev1.ObjectReference
 		build       []buildapiv1.ImageSource
 		want        want
@@ -311,6 +312,30 @@ func TestAppendPostCommit(t *testing.T) {
 				`),
 			},
 		},
+		{
+			description: "target stage keeps its name",
+			original: heredoc.Doc(`
+				FROM busybox as appimage
+				RUN echo "hello world"
+				FROM appimage as release
+				RUN touch /tmp/hello
+				`),
+			postCommit: buildapiv1.BuildPostCommitSpec{
+				Command: []string{"ls", "/tmp/hello"},
+			},
+			target: "release",
+			want: want{
+				Out: heredoc.Doc(`
+				FROM busybox as appimage
+				RUN echo "hello world"
+				FROM appimage as <alias>
+				RUN touch /tmp/hello
+				FROM <alias>
+				RUN ls /tmp/hello
+				FROM <alias> as release
+				`),
+			},
+		},
 	}
 
 	for i, test := range tests {
@@ -319,7 +344,7 @@ func TestAppendPostCommit(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			if err := appendPostCommit(node, buildPostCommit(test.postCommit)); err != nil {
+			if err := appendPostCommit(node, buildPostCommit(test.postCommit), test.target); err != nil {
 				t.Errorf("appendPostCommit error: %#v", err)
 			}
 			wantNode, err := imagebuilder.ParseDockerfile(strings.NewReader(strings.Replace(test.want.Out, "<alias>", postCommitAlias, -1)))
@@ -335,6 +360,99 @@ func TestAppendPostCommit(t *testing.T) {
 	}
 }
 
+func TestTruncateToStage(t *testing.T) {
+	tests := []struct {
+		description string
+		original    string
+		target      string
+		want        string
+		wantErr     bool
+	}{
+		{
+			description: "middle stage",
+			original: heredoc.Doc(`
+				FROM busybox as test
+				RUN make test
+				FROM busybox as Debug
+				RUN make debug
+				FROM busybox as release
+				RUN make release
+				`),
+			target: "debug",
+			want: heredoc.Doc(`
+				FROM busybox as test
+				RUN make test
+				FROM busybox as Debug
+				RUN make debug
+				`),
+		},
+		{
+			description: "last stage",
+			original: heredoc.Doc(`
+				FROM busybox as test
+				RUN make test
+				FROM busybox as release
+				RUN make release
+				`),
+			target: "release",
+			want: heredoc.Doc(`
+				FROM busybox as test
+				RUN make test
+				FROM busybox as release
+				RUN make release
+				`),
+		},
+		{
+			description: "mixed case",
+			original: heredoc.Doc(`
+				FROM busybox as Test
+				RUN make test
+				FROM busybox as release
+				RUN make release
+				`),
+			target: "TEST",
+			want: heredoc.Doc(`
+				FROM busybox as Test
+				RUN make test
+				`),
+		},
+		{
+			description: "missing stage",
+			original: heredoc.Doc(`
+				FROM busybox as test
+				RUN make test
+				`),
+			target:  "release",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			node, err := imagebuilder.ParseDockerfile(strings.NewReader(test.original))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = truncateToStage(node, test.target)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got:\n%s", dockerfile.Write(node))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantNode, err := imagebuilder.ParseDockerfile(strings.NewReader(test.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dockerfile.Write(node), dockerfile.Write(wantNode)) {
+				t.Errorf("wanted:\n%s\ngot:\n%s", dockerfile.Write(wantNode), dockerfile.Write(node))
+			}
+		})
+	}
+}
+
 // TestDockerfilePath validates that we can use a Dockerfile with a custom name, and in a sub-directory
 func TestDockerfilePath(t *testing.T) {
 	tests := []struct {
@@ -515,7 +633,7 @@ func TestEmptySource(t *testing.T) {
 		build:  build,
 	}
 
-	if err := dockerBuilder.Build(); err == nil {
+	if err := dockerBuilder.Build(context.Background()); err == nil {
 		t.Error("Should have received error on docker build")
 	} else {
 		if !strings.Contains(err.Error(), "must provide a value for at least one of source, binary, images, or dockerfile") {
@@ -584,10 +702,10 @@ USER 1001`
 		dockerClient: dockerClient,
 		inputDir:     buildDir,
 	}
-	if err := ManageDockerfile(buildDir, build); err != nil {
+	if err := ManageDockerfile(buildDir, build, nil); err != nil {
 		t.Errorf("failed to manage the dockerfile: %v", err)
 	}
-	if err := dockerBuilder.Build(); err != nil {
+	if err := dockerBuilder.Build(context.Background()); err != nil {
 		if strings.Contains(err.Error(), "cannot pull scratch") {
 			t.Errorf("Docker build should not have attempted to pull from scratch")
 		} else {
@@ -1,7 +1,7 @@
 package builder
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"math"
 	"os"
@@ -9,8 +9,6 @@ import (
 	"strings"
 	"time"
 
-	idocker "github.com/containers/image/v5/docker"
-	"github.com/docker/distribution/registry/api/errcode"
 	docker "github.com/fsouza/go-dockerclient"
 
 	"github.com/openshift/builder/pkg/build/builder/cmd/dockercfg"
@@ -36,38 +34,41 @@ type DockerClient interface {
 	TagImage(name string, opts docker.TagImageOptions) error
 }
 
-func retryImageAction(actionName string, action func() error) error {
-	var err error
+// imageSigner is implemented by DockerClients which can sign the images that
+// they push.
+type imageSigner interface {
+	// SignImage signs the image which was pushed as name, and which has the
+	// digest, and returns where the signature was stored, or "" if images
+	// aren't being signed.
+	SignImage(ctx context.Context, name, imageDigest string, auth docker.AuthConfiguration) (string, error)
+}
 
-	for retries := 0; retries <= DefaultPushOrPullRetryCount; retries++ {
-		err = action()
-		if err == nil {
-			return nil
-		}
-		log.V(0).Infof("Warning: %s failed, retrying in %s ...", actionName, DefaultPushOrPullRetryDelay)
-		time.Sleep(DefaultPushOrPullRetryDelay)
+// signPushedImage signs the image which was pushed as name, if the client is
+// able to and the build was given a key to sign it with, and returns where the
+// signature was stored.
+func signPushedImage(ctx context.Context, client DockerClient, policy retryPolicy, name, imageDigest string, authConfig docker.AuthConfiguration) (string, error) {
+	signer, ok := client.(imageSigner)
+	if !ok || imageDigest == "" {
+		return "", nil
 	}
+	var location string
+	err := policy.retry(ctx, "Sign", func() (signErr error) {
+		location, signErr = signer.SignImage(ctx, name, imageDigest, authConfig)
+		return signErr
+	})
+	return location, err
+}
 
-	var errs errcode.Errors
-	var unauthorized idocker.ErrUnauthorizedForCredentials
-	if errors.As(err, &errs) {
-		// if this error is a group of errors, process them all in turn
-		for i := range errs {
-			if errors.As(errs[i], &unauthorized) {
-				// this is the error we actually care about
-				err = errs[i]
-				break
-			}
-		}
+// appendSignatureMessage adds where the signature of the build's output image
+// was stored to a build's status message.  Only the output image's signature
+// is added, so that the message stays short however many other places the
+// image is pushed to.
+func appendSignatureMessage(message, location string) string {
+	signed := fmt.Sprintf("Image signature stored at %s.", location)
+	if message == "" {
+		return signed
 	}
-	// unwrap the error if it's an "unauthorized" error -- those wrappers
-	// mainly add the image name as their added context, which just
-	// duplicates information that we're already supplying ourselves
-	if errors.As(err, &unauthorized) {
-		err = unauthorized.Err
-	}
-
-	return fmt.Errorf("After retrying %d times, %s image still failed due to error: %v", DefaultPushOrPullRetryCount, actionName, err)
+	return message + " " + signed
 }
 
 func removeImage(client DockerClient, name string) error {
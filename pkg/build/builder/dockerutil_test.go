@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"io/ioutil"
 	"math"
 	"os"
@@ -111,6 +112,35 @@ func TestTagImage(t *testing.T) {
 	}
 }
 
+// fakeSigningDocker is a FakeDocker which stores signatures at location.
+type fakeSigningDocker struct {
+	*FakeDocker
+	location string
+}
+
+func (d *fakeSigningDocker) SignImage(ctx context.Context, name, imageDigest string, auth docker.AuthConfiguration) (string, error) {
+	return d.location + "/" + imageDigest, nil
+}
+
+func TestSignPushedImage(t *testing.T) {
+	client := &fakeSigningDocker{FakeDocker: NewFakeDockerClient(), location: "registry.example.com/ns/app"}
+	location, err := signPushedImage(context.Background(), client, retryPolicy{}, "registry.example.com/ns/app:latest", "sha256:1111", docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if location != "registry.example.com/ns/app/sha256:1111" {
+		t.Errorf("unexpected signature location %q", location)
+	}
+	if location, err := signPushedImage(context.Background(), NewFakeDockerClient(), retryPolicy{}, "registry.example.com/ns/app:latest", "sha256:1111", docker.AuthConfiguration{}); err != nil || location != "" {
+		t.Errorf("expected a client which can't sign to be skipped, got %q, %v", location, err)
+	}
+
+	expected := "Build complete. Image signature stored at " + location + "."
+	if actual := appendSignatureMessage("Build complete.", location); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
 type testcase struct {
 	name   string
 	input  map[string]string
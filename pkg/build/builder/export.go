@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// imageExporter is implemented by DockerClients which can write the images
+// that they build to places other than registries.
+type imageExporter interface {
+	// ExportImage writes the image named name to dest, and returns the
+	// digest of the manifest that it wrote there.
+	ExportImage(ctx context.Context, name string, dest types.ImageReference) (string, error)
+}
+
+// exportDestinationFromEnv returns where the build should write the image it
+// builds, or nil if it shouldn't.  The destination is an OCI layout, an OCI
+// archive, or a docker archive, at an absolute path, named in the same way
+// that skopeo and podman name them.
+func exportDestinationFromEnv() (types.ImageReference, error) {
+	spec := strings.TrimSpace(os.Getenv(builderutil.BuildExport))
+	if spec == "" {
+		return nil, nil
+	}
+	transport, path, ok := strings.Cut(spec, ":")
+	if !ok || !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("error parsing %s %q: expected a transport and an absolute path, like \"oci-archive:/path/to/image.tar\"", builderutil.BuildExport, spec)
+	}
+	var dest types.ImageReference
+	var err error
+	switch transport {
+	case layout.Transport.Name():
+		dest, err = layout.ParseReference(path)
+	case ociarchive.Transport.Name():
+		dest, err = ociarchive.ParseReference(path)
+	case dockerarchive.Transport.Name():
+		dest, err = dockerarchive.ParseReference(path)
+	default:
+		return nil, fmt.Errorf("error parsing %s %q: unsupported transport %q, expected %q, %q or %q", builderutil.BuildExport, spec, transport, layout.Transport.Name(), ociarchive.Transport.Name(), dockerarchive.Transport.Name())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s %q: %v", builderutil.BuildExport, spec, err)
+	}
+	return dest, nil
+}
+
+// exportImage writes the image named name to dest, if the client is able to.
+func exportImage(ctx context.Context, client DockerClient, name string, dest types.ImageReference) error {
+	exporter, ok := client.(imageExporter)
+	if !ok {
+		return fmt.Errorf("this client can't export images to %s", transports.ImageName(dest))
+	}
+	log.V(0).Infof("\nExporting image to %s ...", transports.ImageName(dest))
+	imageDigest, err := exporter.ExportImage(ctx, name, dest)
+	if err != nil {
+		return err
+	}
+	log.V(0).Infof("Exported image %s to %s", imageDigest, transports.ImageName(dest))
+	return nil
+}
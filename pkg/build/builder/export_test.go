@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/transports"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestExportDestinationFromEnv(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"":                                 "",
+		"oci:" + dir + "/layout":           "oci:" + dir + "/layout:",
+		"oci:" + dir + "/layout:app":       "oci:" + dir + "/layout:app",
+		" oci-archive:" + dir + "/a.tar":   "oci-archive:" + dir + "/a.tar:",
+		"docker-archive:" + dir + "/a.tar": "docker-archive:" + dir + "/a.tar",
+		"docker-archive:" + dir + "/a.tar:registry.example.com/ns/app:latest": "docker-archive:" + dir + "/a.tar:registry.example.com/ns/app:latest",
+		"docker-archive:relative/a.tar":                                       "error",
+		"dir:" + dir + "/dir":                                                 "error",
+		"docker://registry.example.com/":                                      "error",
+		dir + "/a.tar":                                                        "error",
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildExport)
+	for input, expected := range tests {
+		if err := os.Setenv(builderutil.BuildExport, input); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		actual, err := exportDestinationFromEnv()
+		if expected == "error" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if expected == "" {
+			if actual != nil {
+				t.Errorf("%q: expected no destination, got %q", input, transports.ImageName(actual))
+			}
+			continue
+		}
+		if actual == nil || transports.ImageName(actual) != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, transports.ImageName(actual))
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildExport, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildExport)
+	}
+}
@@ -0,0 +1,174 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+
+	buildapiv1 "github.com/openshift/api/build/v1"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// baseImagePolicy controls which images a build may use.  An image is denied
+// if it matches any of the Deny rules, or if there are Allow rules and it
+// doesn't match any of them.  Images which aren't referenced by digest are
+// denied if RequireDigest is set.
+//
+//	{
+//	  "requireDigest": false,
+//	  "allow": [
+//	    {"registry": "registry.redhat.io"},
+//	    {"registry": "quay.io", "repository": "myorg/*", "requireDigest": true}
+//	  ],
+//	  "deny": [
+//	    {"registry": "docker.io"}
+//	  ]
+//	}
+type baseImagePolicy struct {
+	RequireDigest bool            `json:"requireDigest,omitempty"`
+	Allow         []baseImageRule `json:"allow,omitempty"`
+	Deny          []baseImageRule `json:"deny,omitempty"`
+}
+
+// baseImageRule matches images by their registry and repository, each of
+// which is a pattern in the syntax that path.Match uses, and which match
+// anything if they're empty.  An Allow rule with RequireDigest only matches
+// images which are referenced by digest.
+type baseImageRule struct {
+	Registry      string `json:"registry,omitempty"`
+	Repository    string `json:"repository,omitempty"`
+	RequireDigest bool   `json:"requireDigest,omitempty"`
+}
+
+// baseImagePolicyFromEnv reads the base image policy from the file named by
+// $BUILD_BASE_IMAGE_POLICY_PATH, or returns nil if it isn't set.  A policy
+// file which can't be read is an error, so that a build which was meant to be
+// checked isn't let through.
+func baseImagePolicyFromEnv() (*baseImagePolicy, error) {
+	policyPath, ok := os.LookupEnv(builderutil.BuildBaseImagePolicyPath)
+	if !ok || len(policyPath) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading base image policy %q: %v", policyPath, err)
+	}
+	policy := &baseImagePolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("error parsing base image policy %q: %v", policyPath, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("error parsing base image policy %q: %v", policyPath, err)
+	}
+	return policy, nil
+}
+
+// validate checks that the patterns in the policy's rules are well-formed.
+func (p *baseImagePolicy) validate() error {
+	for _, rule := range append(append([]baseImageRule{}, p.Allow...), p.Deny...) {
+		for _, pattern := range []string{rule.Registry, rule.Repository} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	for _, rule := range p.Deny {
+		if rule.RequireDigest {
+			return fmt.Errorf("deny rules can't require a digest")
+		}
+	}
+	return nil
+}
+
+// matches returns whether the rule matches the image, which is referenced by
+// digest if digested is set.
+func (r baseImageRule) matches(named reference.Named, digested bool) bool {
+	if r.RequireDigest && !digested {
+		return false
+	}
+	if r.Registry != "" {
+		if ok, _ := path.Match(r.Registry, reference.Domain(named)); !ok {
+			return false
+		}
+	}
+	if r.Repository != "" {
+		if ok, _ := path.Match(r.Repository, reference.Path(named)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// violation returns why the policy doesn't allow the image with the name, or
+// an empty string if it does.
+func (p *baseImagePolicy) violation(name string) string {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return fmt.Sprintf("%s is not a valid image reference: %v", name, err)
+	}
+	_, digested := named.(reference.Digested)
+	if p.RequireDigest && !digested {
+		return fmt.Sprintf("%s is not referenced by digest", name)
+	}
+	for _, rule := range p.Deny {
+		if rule.matches(named, digested) {
+			return fmt.Sprintf("%s is denied", name)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return ""
+	}
+	for _, rule := range p.Allow {
+		if rule.matches(named, digested) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s is not allowed", name)
+}
+
+// violations returns why the policy doesn't allow each of the images with the
+// names that it doesn't allow.
+func (p *baseImagePolicy) violations(names []string) []string {
+	var violations []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "scratch" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if violation := p.violation(name); violation != "" {
+			violations = append(violations, violation)
+		}
+	}
+	return violations
+}
+
+// checkBaseImagePolicy returns an error if the base image policy, if there is
+// one, doesn't allow any of the images with the names.  It should be called
+// before the images are pulled.
+func checkBaseImagePolicy(names []string) error {
+	policy, err := baseImagePolicyFromEnv()
+	if err != nil || policy == nil {
+		return err
+	}
+	if violations := policy.violations(names); len(violations) > 0 {
+		return fmt.Errorf("images not allowed by the base image policy: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// CheckSourceImagePolicy returns an error if the base image policy doesn't
+// allow any of the images that the build's source is extracted from.
+func CheckSourceImagePolicy(build *buildapiv1.Build) error {
+	var names []string
+	for _, image := range build.Spec.Source.Images {
+		names = append(names, image.From.Name)
+	}
+	return checkBaseImagePolicy(names)
+}
@@ -0,0 +1,139 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestBaseImagePolicyViolations(t *testing.T) {
+	digested := "@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	tests := []struct {
+		name       string
+		policy     baseImagePolicy
+		images     []string
+		violations []string
+	}{
+		{
+			name:   "no rules",
+			policy: baseImagePolicy{},
+			images: []string{"golang", "registry.example.com/base:1.0"},
+		},
+		{
+			name: "allow by registry",
+			policy: baseImagePolicy{
+				Allow: []baseImageRule{{Registry: "*.example.com"}},
+			},
+			images:     []string{"registry.example.com/base:1.0", "golang", "scratch"},
+			violations: []string{"golang is not allowed"},
+		},
+		{
+			name: "allow by repository",
+			policy: baseImagePolicy{
+				Allow: []baseImageRule{{Registry: "docker.io", Repository: "library/*"}},
+			},
+			images:     []string{"golang", "docker.io/someone/golang"},
+			violations: []string{"docker.io/someone/golang is not allowed"},
+		},
+		{
+			name: "deny overrides allow",
+			policy: baseImagePolicy{
+				Allow: []baseImageRule{{Registry: "registry.example.com"}},
+				Deny:  []baseImageRule{{Repository: "legacy/*"}},
+			},
+			images:     []string{"registry.example.com/app/base", "registry.example.com/legacy/base"},
+			violations: []string{"registry.example.com/legacy/base is denied"},
+		},
+		{
+			name: "allow rule requires a digest",
+			policy: baseImagePolicy{
+				Allow: []baseImageRule{{Registry: "registry.example.com", RequireDigest: true}},
+			},
+			images:     []string{"registry.example.com/base" + digested, "registry.example.com/base:1.0"},
+			violations: []string{"registry.example.com/base:1.0 is not allowed"},
+		},
+		{
+			name:       "policy requires a digest",
+			policy:     baseImagePolicy{RequireDigest: true},
+			images:     []string{"golang" + digested, "golang", "golang"},
+			violations: []string{"golang is not referenced by digest"},
+		},
+	}
+	for _, test := range tests {
+		if violations := test.policy.violations(test.images); !reflect.DeepEqual(test.violations, violations) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.violations, violations)
+		}
+	}
+}
+
+func TestCheckBaseImagePolicy(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]struct {
+		policy  string
+		images  []string
+		missing bool
+		err     bool
+	}{
+		"no policy": {
+			images: []string{"golang"},
+		},
+		"missing policy": {
+			images:  []string{"golang"},
+			missing: true,
+			err:     true,
+		},
+		"allowed": {
+			policy: `{"allow": [{"registry": "docker.io"}]}`,
+			images: []string{"golang"},
+		},
+		"denied": {
+			policy: `{"deny": [{"registry": "docker.io"}]}`,
+			images: []string{"golang"},
+			err:    true,
+		},
+		"bad pattern": {
+			policy: `{"allow": [{"registry": "["}]}`,
+			err:    true,
+		},
+		"deny requires a digest": {
+			policy: `{"deny": [{"registry": "docker.io", "requireDigest": true}]}`,
+			err:    true,
+		},
+		"not json": {
+			policy: `allow: docker.io`,
+			err:    true,
+		},
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildBaseImagePolicyPath)
+	for name, test := range tests {
+		policyPath := ""
+		if test.missing {
+			policyPath = filepath.Join(dir, "missing.json")
+		}
+		if test.policy != "" {
+			policyPath = filepath.Join(dir, name+".json")
+			if err := os.WriteFile(policyPath, []byte(test.policy), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Setenv(builderutil.BuildBaseImagePolicyPath, policyPath); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		err := checkBaseImagePolicy(test.images)
+		if test.err && err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildBaseImagePolicyPath, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildBaseImagePolicyPath)
+	}
+}
@@ -0,0 +1,227 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/opencontainers/go-digest"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift/imagebuilder"
+	dockercmd "github.com/openshift/imagebuilder/dockerfile/command"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+	"github.com/openshift/builder/pkg/build/builder/util/dockerfile"
+)
+
+// pinnedImagesLabel is the label which records the digest that each image the
+// build used was pinned to, as a JSON object.
+const pinnedImagesLabel = builderutil.DefaultDockerLabelNamespace + "build.image-digests"
+
+// imageResolver is implemented by DockerClients which can find the digest of
+// an image in a registry without pulling it.
+type imageResolver interface {
+	// ResolveImage returns the digest of the manifest, or manifest list,
+	// which the registry has for name, using the credentials in
+	// searchPaths.
+	ResolveImage(ctx context.Context, name string, searchPaths []string) (string, error)
+}
+
+// pinImagesEnabled returns whether the build should pin the images that it
+// uses to digests.  It does unless it's told not to.
+func pinImagesEnabled() bool {
+	pin, err := strconv.ParseBool(os.Getenv(builderutil.BuildPinImages))
+	return err != nil || pin
+}
+
+// pinnedReference returns name, without any tag, with the digest.
+func pinnedReference(name, imageDigest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", err
+	}
+	parsedDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), parsedDigest)
+	if err != nil {
+		return "", err
+	}
+	return canonical.String(), nil
+}
+
+// localImageDigest returns the reference, with a digest, which image was
+// pulled by, preferring the repository in name, or nil if the image wasn't
+// pulled from a registry.
+func localImageDigest(image *docker.Image, name string) reference.Canonical {
+	var canonical reference.Canonical
+	named, _ := reference.ParseNormalizedNamed(name)
+	for _, repoDigest := range image.RepoDigests {
+		parsed, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		c, ok := parsed.(reference.Canonical)
+		if !ok {
+			continue
+		}
+		// prefer the repository that the build named
+		if canonical == nil || (named != nil && c.Name() == named.Name()) {
+			canonical = c
+		}
+	}
+	return canonical
+}
+
+// resolveImages returns references, with digests, to what the registries have
+// for each of the images with the names, if the client can find that out.
+// Images that can't be resolved are left out.
+func resolveImages(ctx context.Context, client DockerClient, names, searchPaths []string) map[string]string {
+	pinned := make(map[string]string)
+	resolver, ok := client.(imageResolver)
+	if !ok {
+		return pinned
+	}
+	for _, name := range names {
+		if _, ok := pinned[name]; ok {
+			continue
+		}
+		if named, err := reference.ParseNormalizedNamed(name); err == nil {
+			if _, ok := named.(reference.Canonical); ok {
+				pinned[name] = named.String()
+				continue
+			}
+		}
+		imageDigest, err := resolver.ResolveImage(ctx, name, searchPaths)
+		if err != nil {
+			log.V(0).Infof("Warning: unable to resolve the digest of image %s: %v", name, err)
+			continue
+		}
+		if pinnedName, err := pinnedReference(name, imageDigest); err == nil {
+			pinned[name] = pinnedName
+		}
+	}
+	return pinned
+}
+
+// pinLocalImages adds references, with digests, for the images with the names
+// which are in local storage and which were pulled from the repositories that
+// they're named for, to pinned.
+func pinLocalImages(client DockerClient, names []string, pinned map[string]string) {
+	for _, name := range names {
+		if _, ok := pinned[name]; ok || name == "scratch" {
+			continue
+		}
+		image, err := client.InspectImage(name)
+		if err != nil {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			continue
+		}
+		if canonical := localImageDigest(image, name); canonical != nil && canonical.Name() == named.Name() {
+			pinned[name] = canonical.String()
+		}
+	}
+}
+
+// pinnedImageNames returns the names, replacing each image that was pinned to
+// a digest with the reference that it was pinned to.
+func pinnedImageNames(names []string, pinned map[string]string) []string {
+	pinnedNames := make([]string, 0, len(names))
+	for _, name := range names {
+		if pinnedName, ok := pinned[name]; ok {
+			name = pinnedName
+		}
+		pinnedNames = append(pinnedNames, name)
+	}
+	return pinnedNames
+}
+
+// logPinnedImages logs the digest that each image was pinned to.
+func logPinnedImages(pinned map[string]string) {
+	names := make([]string, 0, len(pinned))
+	for name := range pinned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.V(0).Infof("Using %s for image %s", pinned[name], name)
+	}
+}
+
+// pinnedImagesLabelValue returns the value of the label which records the
+// digest that each image was pinned to.
+func pinnedImagesLabelValue(pinned map[string]string) string {
+	// maps are marshalled with their keys sorted
+	data, _ := json.Marshal(pinned)
+	return string(data)
+}
+
+// pinDockerfileImages rewrites the FROM and COPY --from instructions in the
+// Dockerfile at dockerfilePath which use one of the images in pinned to use
+// the digest it was pinned to instead, and records them in a label.
+func pinDockerfileImages(dockerfilePath string, buildArgs []corev1.EnvVar, pinned map[string]string) error {
+	if len(pinned) == 0 {
+		return nil
+	}
+	in, err := ioutil.ReadFile(dockerfilePath)
+	if err != nil {
+		return err
+	}
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader(string(in)))
+	if err != nil {
+		return err
+	}
+	args := argsAsSlice(dockerfileArgs(node, buildArgs))
+
+	// names of earlier stages, which COPY --from and FROM can also refer to
+	stageNames := make(map[string]bool)
+	nthStage := 0
+	for _, child := range node.Children {
+		switch {
+		case child.Value == dockercmd.From && child.Next != nil:
+			if nthStage > 0 {
+				stageNames[strconv.Itoa(nthStage-1)] = true
+			}
+			nthStage++
+			image, err := imagebuilder.ProcessWord(child.Next.Value, args)
+			if err != nil {
+				return err
+			}
+			if pinnedName, ok := pinned[image]; ok && !stageNames[canonicalStageName(image)] {
+				child.Next.Value = pinnedName
+			}
+			if name := stageName(child); name != "" {
+				stageNames[name] = true
+			}
+		case child.Value == dockercmd.Copy:
+			if ref, ok := nodeHasFromRef(child); ok && len(ref) > 0 {
+				image, err := imagebuilder.ProcessWord(ref, args)
+				if err != nil {
+					return err
+				}
+				if pinnedName, ok := pinned[image]; ok && !stageNames[canonicalStageName(image)] {
+					nodeReplaceFromRef(child, pinnedName)
+				}
+			}
+		}
+	}
+	if err := appendLabel(node, []dockerfile.KeyValue{{Key: pinnedImagesLabel, Value: pinnedImagesLabelValue(pinned)}}); err != nil {
+		return err
+	}
+
+	out := dockerfile.Write(node)
+	log.V(4).Infof("Replacing dockerfile\n%s\nwith:\n%s", string(in), string(out))
+	return overwriteFile(dockerfilePath, out)
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeResolvingDocker is a FakeDocker which can resolve images in a
+// registry.
+type fakeResolvingDocker struct {
+	*FakeDocker
+	digests map[string]string
+}
+
+func (d *fakeResolvingDocker) ResolveImage(ctx context.Context, name string, searchPaths []string) (string, error) {
+	if imageDigest, ok := d.digests[name]; ok {
+		return imageDigest, nil
+	}
+	return "", fmt.Errorf("manifest unknown")
+}
+
+const (
+	pinTestDigest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	pinTestDigest2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestResolveImages(t *testing.T) {
+	client := &fakeResolvingDocker{
+		FakeDocker: NewFakeDockerClient(),
+		digests:    map[string]string{"registry.example.com/base:1.0": pinTestDigest1, "golang": pinTestDigest2},
+	}
+	names := []string{"registry.example.com/base:1.0", "golang", "registry.example.com/missing:1.0", "registry.example.com/pinned@" + pinTestDigest1}
+	expected := map[string]string{
+		"registry.example.com/base:1.0": "registry.example.com/base@" + pinTestDigest1,
+		"golang":                        "docker.io/library/golang@" + pinTestDigest2,
+		"registry.example.com/pinned@" + pinTestDigest1: "registry.example.com/pinned@" + pinTestDigest1,
+	}
+	if actual := resolveImages(context.Background(), client, names, nil); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if actual := resolveImages(context.Background(), NewFakeDockerClient(), names, nil); len(actual) != 0 {
+		t.Errorf("expected clients which can't resolve images not to pin any, got %v", actual)
+	}
+	expectedNames := []string{"registry.example.com/base@" + pinTestDigest1, "docker.io/library/golang@" + pinTestDigest2, "registry.example.com/missing:1.0", "registry.example.com/pinned@" + pinTestDigest1}
+	if actual := pinnedImageNames(names, expected); !reflect.DeepEqual(expectedNames, actual) {
+		t.Errorf("expected %v, got %v", expectedNames, actual)
+	}
+}
+
+func TestPinLocalImages(t *testing.T) {
+	client := NewFakeDockerClient()
+	client.inspectImageFunc = func(name string) (*docker.Image, error) {
+		switch name {
+		case "registry.example.com/base:1.0":
+			return &docker.Image{RepoDigests: []string{"mirror.example.com/base@" + pinTestDigest2, "registry.example.com/base@" + pinTestDigest1}}, nil
+		case "registry.example.com/retagged:1.0":
+			return &docker.Image{RepoDigests: []string{"mirror.example.com/base@" + pinTestDigest2}}, nil
+		case "localhost/built":
+			return &docker.Image{}, nil
+		}
+		return nil, docker.ErrNoSuchImage
+	}
+	pinned := map[string]string{"registry.example.com/pulled:1.0": "registry.example.com/pulled@" + pinTestDigest2}
+	pinLocalImages(client, []string{"registry.example.com/base:1.0", "registry.example.com/retagged:1.0", "localhost/built", "scratch", "registry.example.com/pulled:1.0"}, pinned)
+	expected := map[string]string{
+		"registry.example.com/base:1.0":   "registry.example.com/base@" + pinTestDigest1,
+		"registry.example.com/pulled:1.0": "registry.example.com/pulled@" + pinTestDigest2,
+	}
+	if !reflect.DeepEqual(expected, pinned) {
+		t.Errorf("expected %v, got %v", expected, pinned)
+	}
+}
+
+func TestPinDockerfileImages(t *testing.T) {
+	in := `ARG BASE=registry.example.com/base:1.0
+FROM ${BASE} AS builder
+COPY --from=registry.example.com/tools:2 /bin/tool /bin/tool
+RUN make
+FROM builder AS test
+RUN make test
+FROM scratch
+COPY --from=builder /out /out
+COPY --from=0 /bin/tool /bin/tool
+COPY --from=Test /report /report
+`
+	dockerfilePath := filepath.Join(t.TempDir(), "Dockerfile")
+	if err := os.WriteFile(dockerfilePath, []byte(in), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pinned := map[string]string{
+		"registry.example.com/base:1.0": "registry.example.com/base@" + pinTestDigest1,
+		"registry.example.com/tools:2":  "registry.example.com/tools@" + pinTestDigest2,
+		// a stage with the same name as an image refers to the stage,
+		// whatever case it's given in
+		"builder": "docker.io/library/builder@" + pinTestDigest2,
+		"Test":    "docker.io/library/test@" + pinTestDigest2,
+	}
+	if err := pinDockerfileImages(dockerfilePath, []corev1.EnvVar{{Name: "UNUSED", Value: "1"}}, pinned); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"ARG BASE=registry.example.com/base:1.0\n",
+		"FROM registry.example.com/base@" + pinTestDigest1 + " AS builder\n",
+		"COPY --from=registry.example.com/tools@" + pinTestDigest2 + " /bin/tool /bin/tool\n",
+		"FROM builder AS test\n",
+		"COPY --from=builder /out /out\n",
+		"COPY --from=0 /bin/tool /bin/tool\n",
+		"COPY --from=Test /report /report\n",
+		`LABEL "io.openshift.build.image-digests"=`,
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("expected %q in the rewritten Dockerfile:\n%s", expected, out)
+		}
+	}
+	images, err := findReferencedImages(dockerfilePath, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedImages := []string{"registry.example.com/base@" + pinTestDigest1, "registry.example.com/tools@" + pinTestDigest2, "scratch"}
+	if !reflect.DeepEqual(expectedImages, images) {
+		t.Errorf("expected the rewritten Dockerfile to reference %v, got %v", expectedImages, images)
+	}
+}
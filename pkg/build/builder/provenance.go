@@ -0,0 +1,237 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/opencontainers/go-digest"
+
+	buildapiv1 "github.com/openshift/api/build/v1"
+
+	"github.com/openshift/builder/pkg/build/builder/timing"
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+	"github.com/openshift/builder/pkg/version"
+)
+
+const (
+	inTotoStatementType         = "https://in-toto.io/Statement/v1"
+	slsaProvenancePredicateType = "https://slsa.dev/provenance/v1"
+	// provenanceBuildType describes the parameters that our provenance
+	// statements record.
+	provenanceBuildType = "https://github.com/openshift/builder/provenance/v1"
+	// provenanceBuilderID identifies us as the builder of an image.
+	provenanceBuilderID = "https://github.com/openshift/builder"
+
+	// inTotoMediaType is the media type of unsigned in-toto statements, and
+	// of the artifacts which hold signed or unsigned statements.
+	inTotoMediaType = "application/vnd.in-toto+json"
+	// dsseEnvelopeMediaType is the media type of signed in-toto statements.
+	dsseEnvelopeMediaType = "application/vnd.dsse.envelope.v1+json"
+)
+
+// attestationAttacher is implemented by DockerClients which can attach
+// attestations to the images that they push.
+type attestationAttacher interface {
+	// AttachAttestation attaches an in-toto statement about the image which
+	// was pushed as name, and which has the digest, to the image in the
+	// registry, signing it if it can.  It returns the name of the
+	// attestation, with its digest.
+	AttachAttestation(ctx context.Context, name, imageDigest string, statement []byte, auth docker.AuthConfiguration) (string, error)
+}
+
+// provenanceDependency is something that the build used, identified by its
+// digests.
+type provenanceDependency struct {
+	URI    string            `json:"uri"`
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// provenanceEnabled returns whether the build should attach a provenance
+// attestation to the image that it pushes.
+func provenanceEnabled() bool {
+	provenance, _ := strconv.ParseBool(os.Getenv(builderutil.BuildProvenance))
+	return provenance
+}
+
+// attachProvenance attaches a provenance attestation for the image which was
+// pushed as name, and which has the digest, to the image in the registry, if
+// the build asked for one.  The images are those that the build used, which
+// the client should have in local storage.
+func attachProvenance(ctx context.Context, client DockerClient, policy retryPolicy, build *buildapiv1.Build, name, imageDigest string, images []string, authConfig docker.AuthConfiguration) error {
+	if !provenanceEnabled() || imageDigest == "" {
+		return nil
+	}
+	attacher, ok := client.(attestationAttacher)
+	if !ok {
+		log.V(0).Infof("Warning: not attaching a provenance attestation to %s, which this client can't do.", name)
+		return nil
+	}
+
+	var sourceRevision *buildapiv1.SourceRevision
+	if sourceInfo, err := readSourceInfo(); err != nil {
+		log.V(0).Infof("Warning: the provenance attestation won't record the source revision: %v", err)
+	} else if sourceInfo != nil || build.Spec.Revision != nil {
+		sourceRevision = GetSourceRevision(build, sourceInfo)
+	}
+	statement, err := newProvenanceStatement(build, sourceRevision, name, imageDigest, resolveImageDependencies(client, images), timing.GetStages(ctx), time.Now())
+	if err != nil {
+		return err
+	}
+
+	var attestation string
+	err = policy.retry(ctx, "Attestation", func() (attachErr error) {
+		attestation, attachErr = attacher.AttachAttestation(ctx, name, imageDigest, statement, authConfig)
+		return attachErr
+	})
+	if err != nil {
+		return err
+	}
+	log.V(0).Infof("Attached provenance attestation %s", attestation)
+	return nil
+}
+
+// resolveImageDependencies returns the images with the names, identified by
+// the digests that they were pulled by.  Images that aren't in local storage,
+// or that weren't pulled from a registry, are skipped.
+func resolveImageDependencies(client DockerClient, names []string) []provenanceDependency {
+	var dependencies []provenanceDependency
+	for _, name := range names {
+		if name == "scratch" {
+			continue
+		}
+		image, err := client.InspectImage(name)
+		if err != nil {
+			log.V(2).Infof("Not recording image %s in the provenance attestation: %v", name, err)
+			continue
+		}
+		canonical := localImageDigest(image, name)
+		if canonical == nil {
+			log.V(2).Infof("Not recording image %s in the provenance attestation, its digest is unknown.", name)
+			continue
+		}
+		dependencies = append(dependencies, provenanceDependency{
+			URI:    "oci://" + canonical.Name(),
+			Name:   name,
+			Digest: map[string]string{canonical.Digest().Algorithm().String(): canonical.Digest().Encoded()},
+		})
+	}
+	return dependencies
+}
+
+// newProvenanceStatement returns an in-toto statement, with a SLSA provenance
+// predicate, which says that the build produced the image which was pushed as
+// name and has the digest, from the source revision and images.
+func newProvenanceStatement(build *buildapiv1.Build, sourceRevision *buildapiv1.SourceRevision, name, imageDigest string, images []provenanceDependency, stages []buildapiv1.StageInfo, finishedOn time.Time) ([]byte, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	pushedDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	externalParameters := map[string]interface{}{
+		"build":    build.Namespace + "/" + build.Name,
+		"strategy": string(build.Spec.Strategy.Type),
+		"output":   name,
+	}
+	if buildConfig := build.Annotations[buildapiv1.BuildConfigAnnotation]; buildConfig != "" {
+		externalParameters["buildConfig"] = buildConfig
+	}
+	var dependencies []provenanceDependency
+	if git := build.Spec.Source.Git; git != nil {
+		source := map[string]string{"uri": git.URI}
+		if git.Ref != "" {
+			source["ref"] = git.Ref
+		}
+		if build.Spec.Source.ContextDir != "" {
+			source["contextDir"] = build.Spec.Source.ContextDir
+		}
+		externalParameters["source"] = source
+		if sourceRevision != nil && sourceRevision.Git != nil && sourceRevision.Git.Commit != "" {
+			dependencies = append(dependencies, provenanceDependency{
+				URI:    "git+" + git.URI,
+				Digest: map[string]string{"gitCommit": sourceRevision.Git.Commit},
+			})
+		}
+	}
+	switch {
+	case build.Spec.Strategy.DockerStrategy != nil:
+		strategy := build.Spec.Strategy.DockerStrategy
+		if strategy.From != nil {
+			externalParameters["from"] = strategy.From.Name
+		}
+		if strategy.DockerfilePath != "" {
+			externalParameters["dockerfilePath"] = strategy.DockerfilePath
+		}
+		if target := buildTarget(); target != "" {
+			externalParameters["target"] = target
+		}
+		if len(strategy.BuildArgs) > 0 {
+			// values which come from secrets or config maps are
+			// only recorded by name
+			buildArgs := make(map[string]string)
+			for _, arg := range strategy.BuildArgs {
+				if arg.ValueFrom == nil {
+					buildArgs[arg.Name] = arg.Value
+				} else {
+					buildArgs[arg.Name] = ""
+				}
+			}
+			externalParameters["buildArgs"] = buildArgs
+		}
+	case build.Spec.Strategy.SourceStrategy != nil:
+		externalParameters["from"] = build.Spec.Strategy.SourceStrategy.From.Name
+	}
+	dependencies = append(dependencies, images...)
+
+	metadata := map[string]string{
+		"invocationId": string(build.UID),
+		"finishedOn":   finishedOn.UTC().Format(time.RFC3339),
+	}
+	for _, stage := range stages {
+		startedOn := stage.StartTime.Time.UTC().Format(time.RFC3339)
+		if metadata["startedOn"] == "" || startedOn < metadata["startedOn"] {
+			metadata["startedOn"] = startedOn
+		}
+	}
+	if metadata["invocationId"] == "" {
+		metadata["invocationId"] = build.Namespace + "/" + build.Name
+	}
+
+	info := version.Get()
+	builderVersion := map[string]string{"openshift-builder": info.GitVersion}
+	if buildahVersion := version.BuildahVersion(); buildahVersion != "" {
+		builderVersion["buildah"] = buildahVersion
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"_type": inTotoStatementType,
+		"subject": []map[string]interface{}{{
+			"name":   reference.TrimNamed(named).String(),
+			"digest": map[string]string{pushedDigest.Algorithm().String(): pushedDigest.Encoded()},
+		}},
+		"predicateType": slsaProvenancePredicateType,
+		"predicate": map[string]interface{}{
+			"buildDefinition": map[string]interface{}{
+				"buildType":            provenanceBuildType,
+				"externalParameters":   externalParameters,
+				"resolvedDependencies": dependencies,
+			},
+			"runDetails": map[string]interface{}{
+				"builder": map[string]interface{}{
+					"id":      provenanceBuilderID,
+					"version": builderVersion,
+				},
+				"metadata": metadata,
+			},
+		},
+	})
+}
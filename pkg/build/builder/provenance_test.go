@@ -0,0 +1,144 @@
+package builder
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	buildapiv1 "github.com/openshift/api/build/v1"
+)
+
+func TestResolveImageDependencies(t *testing.T) {
+	baseDigest := "sha256:" + "1111111111111111111111111111111111111111111111111111111111111111"
+	mirrorDigest := "sha256:" + "2222222222222222222222222222222222222222222222222222222222222222"
+	client := NewFakeDockerClient()
+	client.inspectImageFunc = func(name string) (*docker.Image, error) {
+		switch name {
+		case "registry.example.com/base:latest":
+			return &docker.Image{RepoDigests: []string{
+				"mirror.example.com/base@" + mirrorDigest,
+				"registry.example.com/base@" + baseDigest,
+			}}, nil
+		case "localhost/built":
+			return &docker.Image{RepoDigests: []string{}}, nil
+		}
+		return nil, docker.ErrNoSuchImage
+	}
+
+	actual := resolveImageDependencies(client, []string{"registry.example.com/base:latest", "scratch", "localhost/built", "missing"})
+	expected := []provenanceDependency{{
+		URI:    "oci://registry.example.com/base",
+		Name:   "registry.example.com/base:latest",
+		Digest: map[string]string{"sha256": "1111111111111111111111111111111111111111111111111111111111111111"},
+	}}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %#v, got %#v", expected, actual)
+	}
+}
+
+func TestNewProvenanceStatement(t *testing.T) {
+	build := &buildapiv1.Build{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        "app-1",
+			UID:         "0f1e2d3c",
+			Annotations: map[string]string{buildapiv1.BuildConfigAnnotation: "app"},
+		},
+		Spec: buildapiv1.BuildSpec{
+			CommonSpec: buildapiv1.CommonSpec{
+				Source: buildapiv1.BuildSource{
+					Git: &buildapiv1.GitBuildSource{URI: "https://git.example.com/app.git", Ref: "main"},
+				},
+				Strategy: buildapiv1.BuildStrategy{
+					Type: buildapiv1.DockerBuildStrategyType,
+					DockerStrategy: &buildapiv1.DockerBuildStrategy{
+						DockerfilePath: "build/Dockerfile",
+						BuildArgs: []corev1.EnvVar{
+							{Name: "VERSION", Value: "1.2"},
+							{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{Key: "token"}}},
+						},
+					},
+				},
+			},
+		},
+	}
+	revision := &buildapiv1.SourceRevision{Git: &buildapiv1.GitSourceRevision{Commit: "abc123"}}
+	images := []provenanceDependency{{URI: "oci://registry.example.com/base", Digest: map[string]string{"sha256": "1111"}}}
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	stages := []buildapiv1.StageInfo{
+		{Name: buildapiv1.StageBuild, StartTime: metav1.NewTime(started.Add(time.Minute))},
+		{Name: buildapiv1.StagePullImages, StartTime: metav1.NewTime(started)},
+	}
+	imageDigest := "sha256:" + "3333333333333333333333333333333333333333333333333333333333333333"
+
+	data, err := newProvenanceStatement(build, revision, "registry.example.com/ns/app:latest", imageDigest, images, stages, started.Add(5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statement struct {
+		Type    string `json:"_type"`
+		Subject []struct {
+			Name   string            `json:"name"`
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+		PredicateType string `json:"predicateType"`
+		Predicate     struct {
+			BuildDefinition struct {
+				BuildType            string                 `json:"buildType"`
+				ExternalParameters   map[string]interface{} `json:"externalParameters"`
+				ResolvedDependencies []provenanceDependency `json:"resolvedDependencies"`
+			} `json:"buildDefinition"`
+			RunDetails struct {
+				Builder struct {
+					ID string `json:"id"`
+				} `json:"builder"`
+				Metadata map[string]string `json:"metadata"`
+			} `json:"runDetails"`
+		} `json:"predicate"`
+	}
+	if err := json.Unmarshal(data, &statement); err != nil {
+		t.Fatal(err)
+	}
+
+	if statement.Type != inTotoStatementType || statement.PredicateType != slsaProvenancePredicateType {
+		t.Errorf("unexpected statement type %q with predicate type %q", statement.Type, statement.PredicateType)
+	}
+	if len(statement.Subject) != 1 || statement.Subject[0].Name != "registry.example.com/ns/app" || statement.Subject[0].Digest["sha256"] != "3333333333333333333333333333333333333333333333333333333333333333" {
+		t.Errorf("expected the pushed image to be the subject, got %+v", statement.Subject)
+	}
+	parameters := statement.Predicate.BuildDefinition.ExternalParameters
+	if parameters["buildConfig"] != "app" || parameters["dockerfilePath"] != "build/Dockerfile" || parameters["strategy"] != "Docker" {
+		t.Errorf("unexpected external parameters %v", parameters)
+	}
+	if buildArgs := parameters["buildArgs"]; !reflect.DeepEqual(buildArgs, map[string]interface{}{"VERSION": "1.2", "TOKEN": ""}) {
+		t.Errorf("expected build args which come from secrets to be recorded without their values, got %v", buildArgs)
+	}
+	expectedDependencies := []provenanceDependency{
+		{URI: "git+https://git.example.com/app.git", Digest: map[string]string{"gitCommit": "abc123"}},
+		images[0],
+	}
+	if !reflect.DeepEqual(expectedDependencies, statement.Predicate.BuildDefinition.ResolvedDependencies) {
+		t.Errorf("expected dependencies %v, got %v", expectedDependencies, statement.Predicate.BuildDefinition.ResolvedDependencies)
+	}
+	expectedMetadata := map[string]string{
+		"invocationId": "0f1e2d3c",
+		"startedOn":    "2024-01-02T03:04:05Z",
+		"finishedOn":   "2024-01-02T03:09:05Z",
+	}
+	if !reflect.DeepEqual(expectedMetadata, statement.Predicate.RunDetails.Metadata) {
+		t.Errorf("expected metadata %v, got %v", expectedMetadata, statement.Predicate.RunDetails.Metadata)
+	}
+	if statement.Predicate.RunDetails.Builder.ID != provenanceBuilderID {
+		t.Errorf("unexpected builder %q", statement.Predicate.RunDetails.Builder.ID)
+	}
+
+	if _, err := newProvenanceStatement(build, nil, "registry.example.com/ns/app:latest", "latest", nil, nil, started); err == nil {
+		t.Errorf("expected an error for an invalid digest")
+	}
+}
@@ -0,0 +1,85 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	buildapiv1 "github.com/openshift/api/build/v1"
+
+	"github.com/openshift/builder/pkg/build/builder/timing"
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// defaultPullConcurrency is the number of images which are pulled at the same
+// time, unless the build sets a different number.
+const defaultPullConcurrency = 4
+
+// timingLock serializes the timing steps that are recorded by pulls which
+// run at the same time.
+var timingLock sync.Mutex
+
+// pullConcurrency returns the number of images which should be pulled at the
+// same time.
+func pullConcurrency() int {
+	value, ok := os.LookupEnv(builderutil.BuildPullConcurrency)
+	if !ok || value == "" {
+		return defaultPullConcurrency
+	}
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		log.V(0).Infof("Warning: ignoring invalid %s %q, pulling %d images at a time.", builderutil.BuildPullConcurrency, value, defaultPullConcurrency)
+		return defaultPullConcurrency
+	}
+	return concurrency
+}
+
+// pullImagesInParallel calls pull for each of the images, with no more than
+// concurrency calls running at the same time, and records a timing step for
+// each of them in ctx.  Layers which are shared by the images are reused from
+// the blob cache by each pull that finds them there.  Pulls which haven't
+// started when ctx is cancelled aren't started.  If any of the pulls fail,
+// the returned error lists every image that couldn't be pulled.
+func pullImagesInParallel(ctx context.Context, images []string, concurrency int, stepName buildapiv1.StepName, pull func(image string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	errs := make([]error, len(images))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, image := range images {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			errs[i] = fmt.Errorf("%s: %v", image, err)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, image string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			startTime := metav1.Now()
+			err := pull(image)
+			endTime := metav1.Now()
+
+			timingLock.Lock()
+			timing.RecordNewStep(ctx, buildapiv1.StagePullImages, stepName, startTime, endTime)
+			timingLock.Unlock()
+
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %v", image, err)
+			}
+		}(i, image)
+	}
+	wg.Wait()
+	return kerrors.NewAggregate(errs)
+}
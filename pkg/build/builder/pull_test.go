@@ -0,0 +1,132 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	buildapiv1 "github.com/openshift/api/build/v1"
+
+	"github.com/openshift/builder/pkg/build/builder/timing"
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestPullImagesInParallel(t *testing.T) {
+	ctx := timing.NewContext(context.Background())
+	images := []string{"a", "b", "c", "d", "e", "f", "g"}
+	failures := map[string]bool{"b": true, "f": true}
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	pulled := make(map[string]bool)
+	err := pullImagesInParallel(ctx, images, 3, buildapiv1.StepPullBaseImage, func(image string) error {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		pulled[image] = true
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		if failures[image] {
+			return errors.New("not found")
+		}
+		return nil
+	})
+
+	if maxRunning > 3 {
+		t.Errorf("expected no more than 3 pulls at a time, got %d", maxRunning)
+	}
+	if len(pulled) != len(images) {
+		t.Errorf("expected every image to be pulled, pulled %v", pulled)
+	}
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for image := range failures {
+		if !strings.Contains(err.Error(), image+": not found") {
+			t.Errorf("expected the error to report %q, got %v", image, err)
+		}
+	}
+
+	stages := timing.GetStages(ctx)
+	if len(stages) != 1 || stages[0].Name != buildapiv1.StagePullImages {
+		t.Fatalf("expected a single %s stage, got %v", buildapiv1.StagePullImages, stages)
+	}
+	if len(stages[0].Steps) != len(images) {
+		t.Errorf("expected a step for each of the %d images, got %d", len(images), len(stages[0].Steps))
+	}
+}
+
+func TestPullImagesInParallelCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(timing.NewContext(context.Background()))
+	images := []string{"a", "b", "c", "d"}
+
+	var lock sync.Mutex
+	pulled := make(map[string]bool)
+	err := pullImagesInParallel(ctx, images, 1, buildapiv1.StepPullBaseImage, func(image string) error {
+		lock.Lock()
+		pulled[image] = true
+		lock.Unlock()
+		// the build is cancelled while the first image is being pulled
+		cancel()
+		return ctx.Err()
+	})
+
+	if len(pulled) != 1 {
+		t.Errorf("expected no pulls to start after the build was cancelled, pulled %v", pulled)
+	}
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, image := range images {
+		if !strings.Contains(err.Error(), image+": context canceled") {
+			t.Errorf("expected the error to report %q, got %v", image, err)
+		}
+	}
+}
+
+func TestPullImagesInParallelSucceeds(t *testing.T) {
+	ctx := timing.NewContext(context.Background())
+	if err := pullImagesInParallel(ctx, []string{"a", "b"}, 1, buildapiv1.StepPullInputImage, func(string) error { return nil }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := pullImagesInParallel(ctx, nil, 1, buildapiv1.StepPullInputImage, func(string) error { return nil }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPullConcurrency(t *testing.T) {
+	tests := map[string]int{
+		"":     defaultPullConcurrency,
+		"1":    1,
+		"8":    8,
+		"0":    defaultPullConcurrency,
+		"-2":   defaultPullConcurrency,
+		"many": defaultPullConcurrency,
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildPullConcurrency)
+	for input, expected := range tests {
+		if err := os.Setenv(builderutil.BuildPullConcurrency, input); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		if actual := pullConcurrency(); actual != expected {
+			t.Errorf("%q: expected %d, got %d", input, expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildPullConcurrency, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildPullConcurrency)
+	}
+}
@@ -0,0 +1,246 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+
+	"github.com/openshift/imagebuilder"
+	dockercmd "github.com/openshift/imagebuilder/dockerfile/command"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// resourceOptions are the resource limits and scratch space which are given
+// to the containers that a build runs.
+type resourceOptions struct {
+	// Ulimits override the default process limits, in the form
+	// "type=soft[:hard]".
+	Ulimits []string
+	// ShmSize is the size of the tmpfs mounted at /dev/shm, in bytes, or
+	// "" to use the default size.
+	ShmSize string
+	// Tmpfs are the tmpfs filesystems which are mounted in containers.
+	Tmpfs []tmpfsMount
+}
+
+// tmpfsMount is a tmpfs filesystem which is mounted at Destination.  Each
+// container gets a tmpfs of its own.
+type tmpfsMount struct {
+	Destination string
+	// Options are mount options for the filesystem, like "size=64m",
+	// "mode=1777", or "noexec".
+	Options []string
+}
+
+// runMountFlag returns the RUN --mount flag which gives an instruction a
+// tmpfs of its own for the mount.
+func (m tmpfsMount) runMountFlag() string {
+	args := []string{"type=tmpfs", "target=" + m.Destination}
+	for _, option := range m.Options {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "size":
+			args = append(args, "tmpfs-size="+value)
+		case "mode":
+			args = append(args, "tmpfs-mode="+value)
+		case "ro", "noexec", "nosuid", "nodev":
+			args = append(args, name)
+		}
+		// "rw", "exec", "suid", and "dev" are the defaults
+	}
+	return "--mount=" + strings.Join(args, ",")
+}
+
+// resourceOptionsFromEnv reads and validates the resource options for a
+// build from the environment.
+func resourceOptionsFromEnv() (resourceOptions, error) {
+	var resources resourceOptions
+	var err error
+	if resources.Ulimits, err = parseUlimits(os.Getenv(builderutil.BuildUlimits)); err != nil {
+		return resourceOptions{}, err
+	}
+	if resources.ShmSize, err = parseShmSize(os.Getenv(builderutil.BuildShmSize)); err != nil {
+		return resourceOptions{}, err
+	}
+	if resources.Tmpfs, err = parseTmpfsMounts(os.Getenv(builderutil.BuildTmpfs)); err != nil {
+		return resourceOptions{}, err
+	}
+	return resources, nil
+}
+
+// parseUlimits parses a comma-separated list of process limits, each in the
+// form "type=soft[:hard]", where -1 means that there is no limit.
+func parseUlimits(spec string) ([]string, error) {
+	var ulimits []string
+	seen := make(map[string]bool)
+	for _, value := range strings.Split(spec, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", builderutil.BuildUlimits, err)
+		}
+		if seen[ulimit.Name] {
+			return nil, fmt.Errorf("error parsing %s: %q is limited more than once", builderutil.BuildUlimits, ulimit.Name)
+		}
+		seen[ulimit.Name] = true
+		ulimits = append(ulimits, fmt.Sprintf("%s=%d:%d", ulimit.Name, ulimit.Soft, ulimit.Hard))
+	}
+	return ulimits, nil
+}
+
+// checkUlimits checks that none of the process limits are higher than the
+// hard limits that the builder itself runs with, which containers can't be
+// given more than.  hardLimit returns the builder's hard limit for a type of
+// resource, or -1 if it's unlimited.
+func checkUlimits(ulimits []string, hardLimit func(resource int) (int64, error)) error {
+	for _, value := range ulimits {
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", builderutil.BuildUlimits, err)
+		}
+		rlimit, err := ulimit.GetRlimit()
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %v", builderutil.BuildUlimits, err)
+		}
+		limit, err := hardLimit(rlimit.Type)
+		if err != nil {
+			return fmt.Errorf("error reading the builder's limit on %q: %v", ulimit.Name, err)
+		}
+		if limit < 0 {
+			continue
+		}
+		if ulimit.Hard < 0 || ulimit.Hard > limit {
+			return fmt.Errorf("error in %s: the hard limit for %q can't be higher than the builder's own hard limit of %d", builderutil.BuildUlimits, ulimit.Name, limit)
+		}
+	}
+	return nil
+}
+
+// parseShmSize parses the size of /dev/shm, like "256m" or "1g", and returns
+// it in bytes.
+func parseShmSize(spec string) (string, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return "", nil
+	}
+	size, err := units.RAMInBytes(spec)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s %q: %v", builderutil.BuildShmSize, spec, err)
+	}
+	if size <= 0 {
+		return "", fmt.Errorf("error parsing %s %q: size must be greater than 0", builderutil.BuildShmSize, spec)
+	}
+	return strconv.FormatInt(size, 10), nil
+}
+
+// parseTmpfsMounts parses a whitespace-separated list of tmpfs mounts, each in
+// the form "destination[:option,...]".
+func parseTmpfsMounts(spec string) ([]tmpfsMount, error) {
+	var mounts []tmpfsMount
+	seen := make(map[string]bool)
+	for _, value := range strings.Fields(spec) {
+		parts := strings.SplitN(value, ":", 2)
+		destination := filepath.Clean(parts[0])
+		if !filepath.IsAbs(parts[0]) || destination == "/" {
+			return nil, fmt.Errorf("error parsing %s: tmpfs destination %q must be an absolute path below /", builderutil.BuildTmpfs, parts[0])
+		}
+		if seen[destination] {
+			return nil, fmt.Errorf("error parsing %s: more than one tmpfs is mounted at %q", builderutil.BuildTmpfs, destination)
+		}
+		seen[destination] = true
+		mount := tmpfsMount{Destination: destination}
+		if len(parts) > 1 {
+			for _, option := range strings.Split(parts[1], ",") {
+				if err := validateTmpfsOption(option); err != nil {
+					return nil, fmt.Errorf("error parsing %s: tmpfs at %q: %v", builderutil.BuildTmpfs, destination, err)
+				}
+				mount.Options = append(mount.Options, option)
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// validateTmpfsOption checks that option is a mount option which we know how
+// to apply to a tmpfs.
+func validateTmpfsOption(option string) error {
+	name, value, hasValue := strings.Cut(option, "=")
+	switch name {
+	case "ro", "rw", "exec", "noexec", "suid", "nosuid", "dev", "nodev":
+		if hasValue {
+			return fmt.Errorf("option %q does not take a value", name)
+		}
+	case "size":
+		if size, err := units.RAMInBytes(value); err != nil || size <= 0 {
+			return fmt.Errorf("invalid size %q", value)
+		}
+	case "mode":
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+			return fmt.Errorf("invalid mode %q", value)
+		}
+	default:
+		return fmt.Errorf("unsupported option %q", option)
+	}
+	return nil
+}
+
+// addTmpfsRunMounts adds a --mount flag for each of the mounts to every RUN
+// instruction in dockerfile, so that each instruction gets new tmpfs
+// filesystems of its own.  The flags are added to the lines which the
+// instructions start on, and the rest of the Dockerfile is left as it was.
+func addTmpfsRunMounts(dockerfile []byte, mounts []tmpfsMount) ([]byte, error) {
+	if len(mounts) == 0 {
+		return dockerfile, nil
+	}
+	node, err := imagebuilder.ParseDockerfile(bytes.NewReader(dockerfile))
+	if err != nil {
+		return nil, err
+	}
+	flags := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		flags = append(flags, mount.runMountFlag())
+	}
+	lines := strings.SplitAfter(string(dockerfile), "\n")
+	for _, child := range node.Children {
+		if child.Value != dockercmd.Run {
+			continue
+		}
+		i := child.StartLine - 1
+		if i < 0 || i >= len(lines) {
+			return nil, fmt.Errorf("unable to find the RUN instruction on line %d", child.StartLine)
+		}
+		instruction := strings.TrimLeft(lines[i], " \t")
+		indent := lines[i][:len(lines[i])-len(instruction)]
+		if len(instruction) < len(dockercmd.Run) || !strings.EqualFold(instruction[:len(dockercmd.Run)], dockercmd.Run) {
+			return nil, fmt.Errorf("unable to find the RUN instruction on line %d", child.StartLine)
+		}
+		lines[i] = indent + instruction[:len(dockercmd.Run)] + " " + strings.Join(flags, " ") + instruction[len(dockercmd.Run):]
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// ulimitsWithDefaults returns the default process limits, with any limits
+// that were set for the build in place of the defaults of the same type.
+func (r resourceOptions) ulimitsWithDefaults(defaults []string) []string {
+	overridden := make(map[string]bool)
+	for _, ulimit := range r.Ulimits {
+		overridden[strings.SplitN(ulimit, "=", 2)[0]] = true
+	}
+	var ulimits []string
+	for _, ulimit := range defaults {
+		if !overridden[strings.SplitN(ulimit, "=", 2)[0]] {
+			ulimits = append(ulimits, ulimit)
+		}
+	}
+	return append(ulimits, r.Ulimits...)
+}
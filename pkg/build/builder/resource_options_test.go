@@ -0,0 +1,191 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc"
+	units "github.com/docker/go-units"
+)
+
+func TestParseUlimits(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  []string
+		expectErr bool
+	}{
+		{input: ""},
+		{input: "nproc=4096", expected: []string{"nproc=4096:4096"}},
+		{input: "nofile=1024:2048, nproc=-1", expected: []string{"nofile=1024:2048", "nproc=-1:-1"}},
+		{input: "nproc=4096,nproc=512", expectErr: true},
+		{input: "nofile=2048:1024", expectErr: true},
+		{input: "processes=10", expectErr: true},
+		{input: "nproc", expectErr: true},
+	}
+	for _, test := range tests {
+		actual, err := parseUlimits(test.input)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("%q: expected %v, got %v", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestParseShmSize(t *testing.T) {
+	tests := map[string]string{
+		"":      "",
+		"64m":   "67108864",
+		" 1g ":  "1073741824",
+		"1024":  "1024",
+		"0":     "error",
+		"lots":  "error",
+		"-512m": "error",
+	}
+	for input, expected := range tests {
+		actual, err := parseShmSize(input)
+		if expected == "error" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestParseTmpfsMounts(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  []tmpfsMount
+		expectErr bool
+	}{
+		{input: ""},
+		{
+			input:    "/scratch",
+			expected: []tmpfsMount{{Destination: "/scratch"}},
+		},
+		{
+			input: "/scratch:size=1g,mode=1777\n  /var/cache/build/:noexec,nosuid",
+			expected: []tmpfsMount{
+				{Destination: "/scratch", Options: []string{"size=1g", "mode=1777"}},
+				{Destination: "/var/cache/build", Options: []string{"noexec", "nosuid"}},
+			},
+		},
+		{input: "scratch", expectErr: true},
+		{input: "/", expectErr: true},
+		{input: "/scratch /scratch/", expectErr: true},
+		{input: "/scratch:size=big", expectErr: true},
+		{input: "/scratch:mode=999", expectErr: true},
+		{input: "/scratch:noexec=true", expectErr: true},
+		{input: "/scratch:uid=0", expectErr: true},
+		{input: "/scratch:nr_inodes=1000", expectErr: true},
+	}
+	for _, test := range tests {
+		actual, err := parseTmpfsMounts(test.input)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("%q: expected %v, got %v", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestCheckUlimits(t *testing.T) {
+	core, err := (&units.Ulimit{Name: "core"}).GetRlimit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardLimit := func(resource int) (int64, error) {
+		if resource == core.Type {
+			return -1, nil
+		}
+		return 4096, nil
+	}
+	tests := map[string]bool{
+		"nproc=1024:4096":  false,
+		"core=-1":          false,
+		"nofile=1024:8192": true,
+		"nofile=-1":        true,
+	}
+	for input, expectErr := range tests {
+		ulimits, err := parseUlimits(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		err = checkUlimits(ulimits, hardLimit)
+		if expectErr && err == nil {
+			t.Errorf("%q: expected an error", input)
+		} else if !expectErr && err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+}
+
+func TestAddTmpfsRunMounts(t *testing.T) {
+	mounts := []tmpfsMount{
+		{Destination: "/scratch", Options: []string{"size=1g", "mode=1777", "rw", "noexec"}},
+		{Destination: "/cache"},
+	}
+	flags := "--mount=type=tmpfs,target=/scratch,tmpfs-size=1g,tmpfs-mode=1777,noexec --mount=type=tmpfs,target=/cache"
+	dockerfile := heredoc.Doc(`
+		FROM busybox
+		# RUN is left alone in comments
+		  run echo one && \
+		    echo two
+		RUN --mount=type=cache,target=/root/.cache echo three
+		COPY . /src
+		`)
+	expected := heredoc.Doc(`
+		FROM busybox
+		# RUN is left alone in comments
+		  run ` + flags + ` echo one && \
+		    echo two
+		RUN ` + flags + ` --mount=type=cache,target=/root/.cache echo three
+		COPY . /src
+		`)
+	actual, err := addTmpfsRunMounts([]byte(dockerfile), mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+	if actual, err := addTmpfsRunMounts([]byte(dockerfile), nil); err != nil || string(actual) != dockerfile {
+		t.Errorf("expected the Dockerfile to be unchanged without mounts, got %v:\n%s", err, actual)
+	}
+}
+
+func TestUlimitsWithDefaults(t *testing.T) {
+	defaults := []string{"nofile=1048576:1048576", "nproc=1048576:1048576"}
+	resources := resourceOptions{Ulimits: []string{"nproc=512:512", "core=0:0"}}
+	expected := []string{"nofile=1048576:1048576", "nproc=512:512", "core=0:0"}
+	if actual := resources.ulimitsWithDefaults(defaults); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if actual := (resourceOptions{}).ulimitsWithDefaults(defaults); !reflect.DeepEqual(defaults, actual) {
+		t.Errorf("expected the defaults %v, got %v", defaults, actual)
+	}
+}
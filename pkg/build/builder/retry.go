@@ -0,0 +1,268 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	idocker "github.com/containers/image/v5/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	docker "github.com/fsouza/go-dockerclient"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+var (
+	// DefaultPushOrPullRetryMaxDelay is the longest time to wait before
+	// triggering a push or pull retry
+	DefaultPushOrPullRetryMaxDelay = time.Minute
+
+	// httpStatusPattern matches the HTTP status codes which registries
+	// responded with, in the errors which only include them in their text.
+	httpStatusPattern = regexp.MustCompile(`(?:invalid status code from registry|unexpected HTTP status:|StatusCode:|status code) (\d{3})\b`)
+)
+
+// retryPolicy controls how many times, and how often, an action which pushes
+// or pulls an image is retried.  Failures which won't go away by themselves,
+// like being unauthorized, aren't retried.
+type retryPolicy struct {
+	// MaxRetries is the number of times an action is retried.
+	MaxRetries int
+	// InitialDelay is how long to wait before the first retry.  It doubles
+	// with each retry after that.
+	InitialDelay time.Duration
+	// MaxDelay is the longest to wait before a retry.
+	MaxDelay time.Duration
+}
+
+// retryPolicyFromEnv returns the retry policy that the build has configured,
+// using the defaults for anything that it hasn't.
+func retryPolicyFromEnv() retryPolicy {
+	policy := retryPolicy{
+		MaxRetries:   DefaultPushOrPullRetryCount,
+		InitialDelay: DefaultPushOrPullRetryDelay,
+		MaxDelay:     DefaultPushOrPullRetryMaxDelay,
+	}
+	if value := os.Getenv(builderutil.BuildPushPullRetries); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			log.V(0).Infof("Warning: ignoring invalid %s %q, retrying %d times.", builderutil.BuildPushPullRetries, value, policy.MaxRetries)
+		} else {
+			policy.MaxRetries = retries
+		}
+	}
+	if value := os.Getenv(builderutil.BuildPushPullRetryDelay); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			log.V(0).Infof("Warning: ignoring invalid %s %q, waiting %s before retrying.", builderutil.BuildPushPullRetryDelay, value, policy.InitialDelay)
+		} else {
+			policy.InitialDelay = delay
+		}
+	}
+	if value := os.Getenv(builderutil.BuildPushPullRetryMaxDelay); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			log.V(0).Infof("Warning: ignoring invalid %s %q, waiting at most %s before retrying.", builderutil.BuildPushPullRetryMaxDelay, value, policy.MaxDelay)
+		} else {
+			policy.MaxDelay = delay
+		}
+	}
+	if policy.MaxDelay < policy.InitialDelay {
+		policy.MaxDelay = policy.InitialDelay
+	}
+	return policy
+}
+
+// retryPolicyHolder is implemented by DockerClients which read the build's
+// retry policy when they were created, so that it's only read once.
+type retryPolicyHolder interface {
+	pushPullRetryPolicy() retryPolicy
+}
+
+// clientRetryPolicy returns the retry policy which client read when it was
+// created, or reads it if the client didn't.
+func clientRetryPolicy(client DockerClient) retryPolicy {
+	if holder, ok := client.(retryPolicyHolder); ok {
+		return holder.pushPullRetryPolicy()
+	}
+	return retryPolicyFromEnv()
+}
+
+// delay returns how long to wait before the retry following the attempt,
+// counting from 0.  The delay grows exponentially, and is jittered so that
+// builds which fail at the same time don't all retry at the same time.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 0; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	// wait somewhere between half of the delay and all of it
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retry calls action until it succeeds, it fails in a way that retrying won't
+// fix, it has been retried as many times as the policy allows, or ctx is
+// cancelled.
+func (p retryPolicy) retry(ctx context.Context, actionName string, action func() error) error {
+	var err error
+	attempt := 0
+retries:
+	for ; ; attempt++ {
+		err = action()
+		if err == nil {
+			return nil
+		}
+		retryable, reason := classifyError(err)
+		if !retryable {
+			log.V(0).Infof("Warning: %s failed on attempt %d, not retrying: %s", actionName, attempt+1, reason)
+			break
+		}
+		if attempt >= p.MaxRetries {
+			log.V(0).Infof("Warning: %s failed on attempt %d: %s", actionName, attempt+1, reason)
+			break
+		}
+		delay := p.delay(attempt)
+		log.V(0).Infof("Warning: %s failed on attempt %d: %s, retrying in %s ...", actionName, attempt+1, reason, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.V(0).Infof("Warning: %s was cancelled, not retrying", actionName)
+			break retries
+		}
+	}
+
+	var errs errcode.Errors
+	var unauthorized idocker.ErrUnauthorizedForCredentials
+	if errors.As(err, &errs) {
+		// if this error is a group of errors, process them all in turn
+		for i := range errs {
+			if errors.As(errs[i], &unauthorized) {
+				// this is the error we actually care about
+				err = errs[i]
+				break
+			}
+		}
+	}
+	// unwrap the error if it's an "unauthorized" error -- those wrappers
+	// mainly add the image name as their added context, which just
+	// duplicates information that we're already supplying ourselves
+	if errors.As(err, &unauthorized) {
+		err = unauthorized.Err
+	}
+
+	if attempt == 0 {
+		return fmt.Errorf("%s image failed due to error: %v", actionName, err)
+	}
+	return fmt.Errorf("After retrying %d times, %s image still failed due to error: %v", attempt, actionName, err)
+}
+
+// classifyError returns whether an action which failed with err might
+// succeed if it's tried again, and why.  Errors which aren't recognized are
+// assumed to be worth retrying.
+func classifyError(err error) (bool, string) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, "cancelled"
+	}
+	var unauthorized idocker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauthorized) {
+		return false, "unauthorized"
+	}
+	if errors.Is(err, idocker.ErrTooManyRequests) {
+		return true, "too many requests"
+	}
+
+	var codes []errcode.ErrorCode
+	var errs errcode.Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			var coded errcode.ErrorCoder
+			if errors.As(e, &coded) {
+				codes = append(codes, coded.ErrorCode())
+			}
+		}
+	}
+	var coded errcode.ErrorCoder
+	if errors.As(err, &coded) {
+		codes = append(codes, coded.ErrorCode())
+	}
+	for _, code := range codes {
+		switch code {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied, v2.ErrorCodeNameUnknown, v2.ErrorCodeNameInvalid, v2.ErrorCodeManifestUnknown:
+			return false, code.Message()
+		case errcode.ErrorCodeUnavailable, errcode.ErrorCodeTooManyRequests:
+			return true, code.Message()
+		}
+		if status := code.Descriptor().HTTPStatusCode; status != 0 {
+			return classifyHTTPStatus(status)
+		}
+	}
+
+	var dockerErr *docker.Error
+	if errors.As(err, &dockerErr) {
+		return classifyHTTPStatus(dockerErr.Status)
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true, "connection reset"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true, "connection refused"
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, "unexpected EOF"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, "timed out"
+	}
+
+	// many errors only keep the text of what caused them
+	message := err.Error()
+	if match := httpStatusPattern.FindStringSubmatch(message); match != nil {
+		if status, err := strconv.Atoi(match[1]); err == nil {
+			return classifyHTTPStatus(status)
+		}
+	}
+	for _, text := range []string{"connection reset", "connection refused", "TLS handshake timeout", "i/o timeout", "unexpected EOF"} {
+		if strings.Contains(message, text) {
+			return true, text
+		}
+	}
+	for _, text := range []string{"context canceled", "unauthorized", "denied", "name unknown", "manifest unknown"} {
+		if strings.Contains(message, text) {
+			return false, text
+		}
+	}
+	return true, message
+}
+
+// classifyHTTPStatus returns whether a request which a registry responded to
+// with the status might succeed if it's made again, and why.
+func classifyHTTPStatus(status int) (bool, string) {
+	reason := fmt.Sprintf("HTTP status %d (%s)", status, http.StatusText(status))
+	switch {
+	case status == http.StatusTooManyRequests, status == http.StatusRequestTimeout, status >= 500:
+		return true, reason
+	case status >= 400:
+		return false, reason
+	}
+	return true, reason
+}
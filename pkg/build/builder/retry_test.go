@@ -0,0 +1,190 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	idocker "github.com/containers/image/v5/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	docker "github.com/fsouza/go-dockerclient"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: idocker.ErrUnauthorizedForCredentials{Err: errors.New("bad password")}, retryable: false},
+		{err: fmt.Errorf("pulling: %w", idocker.ErrTooManyRequests), retryable: true},
+		{err: errcode.Errors{v2.ErrorCodeNameUnknown.WithMessage("repository name not known to registry")}, retryable: false},
+		{err: fmt.Errorf("reading manifest: %w", v2.ErrorCodeManifestUnknown.WithDetail("latest")), retryable: false},
+		{err: errcode.ErrorCodeDenied.WithMessage("requested access to the resource is denied"), retryable: false},
+		{err: errcode.ErrorCodeUnavailable.WithMessage("service unavailable"), retryable: true},
+		{err: &docker.Error{Status: 503}, retryable: true},
+		{err: &docker.Error{Status: 403}, retryable: false},
+		{err: fmt.Errorf("writing blob: %w", &net.OpError{Op: "read", Err: syscall.ECONNRESET}), retryable: true},
+		{err: errors.New("Get \"https://registry.example.com/v2/\": net/http: TLS handshake timeout"), retryable: true},
+		{err: errors.New("reading manifest latest: invalid status code from registry 502 (Bad Gateway)"), retryable: true},
+		{err: errors.New("fetching blob: StatusCode: 401, \"unauthorized\""), retryable: false},
+		{err: errors.New("received unexpected HTTP status: 500 Internal Server Error"), retryable: true},
+		{err: fmt.Errorf("pulling: %w", context.Canceled), retryable: false},
+		{err: errors.New("something unexpected happened"), retryable: true},
+	}
+	for _, test := range tests {
+		if retryable, reason := classifyError(test.err); retryable != test.retryable {
+			t.Errorf("%v: expected retryable to be %t, got %t (%s)", test.err, test.retryable, retryable, reason)
+		}
+	}
+}
+
+func TestRetryPolicyRetry(t *testing.T) {
+	policy := retryPolicy{MaxRetries: 3, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	attempts := 0
+	err := policy.retry(context.Background(), "Pull", func() error {
+		attempts++
+		return errors.New("read: connection reset by peer")
+	})
+	if err == nil || attempts != 4 {
+		t.Errorf("expected a retryable error to be tried 4 times and fail, got %d attempts and %v", attempts, err)
+	}
+
+	attempts = 0
+	err = policy.retry(context.Background(), "Pull", func() error {
+		attempts++
+		return idocker.ErrUnauthorizedForCredentials{Err: errors.New("bad password")}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("expected a terminal error to be tried once and fail, got %d attempts and %v", attempts, err)
+	}
+	if err != nil && err.Error() != "Pull image failed due to error: bad password" {
+		t.Errorf("unexpected error %q", err.Error())
+	}
+
+	attempts = 0
+	err = policy.retry(context.Background(), "Push", func() error {
+		attempts++
+		if attempts < 3 {
+			return &docker.Error{Status: 500}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected to succeed on the third attempt, got %d attempts and %v", attempts, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts = 0
+	err = retryPolicy{MaxRetries: 3, InitialDelay: time.Hour, MaxDelay: time.Hour}.retry(ctx, "Pull", func() error {
+		attempts++
+		cancel()
+		return &docker.Error{Status: 500}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("expected not to retry after being cancelled, got %d attempts and %v", attempts, err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{MaxRetries: 10, InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		for i := 0; i < 10; i++ {
+			if delay := policy.delay(attempt); delay < max/2 || delay > max {
+				t.Errorf("attempt %d: expected a delay between %s and %s, got %s", attempt, max/2, max, delay)
+			}
+		}
+	}
+	if delay := (retryPolicy{}).delay(3); delay != 0 {
+		t.Errorf("expected no delay, got %s", delay)
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	tests := []struct {
+		env      map[string]string
+		expected retryPolicy
+	}{
+		{
+			env:      map[string]string{},
+			expected: retryPolicy{MaxRetries: DefaultPushOrPullRetryCount, InitialDelay: DefaultPushOrPullRetryDelay, MaxDelay: DefaultPushOrPullRetryMaxDelay},
+		},
+		{
+			env: map[string]string{
+				builderutil.BuildPushPullRetries:       "5",
+				builderutil.BuildPushPullRetryDelay:    "2s",
+				builderutil.BuildPushPullRetryMaxDelay: "30s",
+			},
+			expected: retryPolicy{MaxRetries: 5, InitialDelay: 2 * time.Second, MaxDelay: 30 * time.Second},
+		},
+		{
+			env: map[string]string{
+				builderutil.BuildPushPullRetries:       "-1",
+				builderutil.BuildPushPullRetryDelay:    "soon",
+				builderutil.BuildPushPullRetryMaxDelay: "0s",
+			},
+			expected: retryPolicy{MaxRetries: DefaultPushOrPullRetryCount, InitialDelay: DefaultPushOrPullRetryDelay, MaxDelay: DefaultPushOrPullRetryDelay},
+		},
+	}
+	keys := []string{builderutil.BuildPushPullRetries, builderutil.BuildPushPullRetryDelay, builderutil.BuildPushPullRetryMaxDelay}
+	preserveEnv := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := os.LookupEnv(key); ok {
+			preserveEnv[key] = value
+		}
+	}
+	for i, test := range tests {
+		for _, key := range keys {
+			os.Unsetenv(key)
+			if value, ok := test.env[key]; ok {
+				os.Setenv(key, value)
+			}
+		}
+		if actual := retryPolicyFromEnv(); actual != test.expected {
+			t.Errorf("%d: expected %+v, got %+v", i, test.expected, actual)
+		}
+	}
+	for _, key := range keys {
+		if value, ok := preserveEnv[key]; ok {
+			os.Setenv(key, value)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// fakeRetryPolicyDocker is a FakeDocker which read a retry policy when it
+// was created.
+type fakeRetryPolicyDocker struct {
+	*FakeDocker
+	policy retryPolicy
+}
+
+func (d *fakeRetryPolicyDocker) pushPullRetryPolicy() retryPolicy {
+	return d.policy
+}
+
+func TestClientRetryPolicy(t *testing.T) {
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildPushPullRetries)
+	os.Setenv(builderutil.BuildPushPullRetries, "7")
+	policy := retryPolicy{MaxRetries: 3, InitialDelay: time.Second, MaxDelay: time.Minute}
+	if actual := clientRetryPolicy(&fakeRetryPolicyDocker{FakeDocker: NewFakeDockerClient(), policy: policy}); actual != policy {
+		t.Errorf("expected the client's policy %+v, got %+v", policy, actual)
+	}
+	if actual := clientRetryPolicy(NewFakeDockerClient()); actual.MaxRetries != 7 {
+		t.Errorf("expected the policy to be read from the environment, got %+v", actual)
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildPushPullRetries, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildPushPullRetries)
+	}
+}
@@ -0,0 +1,538 @@
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/mod/modfile"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+const (
+	// sbomFormatSPDX writes SBOMs as SPDX 2.3 JSON documents.
+	sbomFormatSPDX = "spdx"
+	// sbomFormatCycloneDX writes SBOMs as CycloneDX 1.5 JSON documents.
+	sbomFormatCycloneDX = "cyclonedx"
+
+	sbomMediaTypeSPDX      = "application/spdx+json"
+	sbomMediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+
+	// sbomToolName is the tool which SBOMs say created them.
+	sbomToolName = "openshift-builder"
+
+	// sbomDigestLabel is the image label which records the digest of the
+	// image's SBOM.
+	sbomDigestLabel = builderutil.DefaultDockerLabelNamespace + "build.sbom.digest"
+	// sbomMediaTypeLabel is the image label which records the media type of
+	// the image's SBOM.
+	sbomMediaTypeLabel = builderutil.DefaultDockerLabelNamespace + "build.sbom.mediatype"
+)
+
+var (
+	// rpmDatabasePaths are the locations, inside of an image, where the RPM
+	// database may be found.
+	rpmDatabasePaths = []string{"/var/lib/rpm", "/usr/lib/sysimage/rpm"}
+	// sbomSkippedDirs are directories which are not searched for lockfiles.
+	sbomSkippedDirs = map[string]bool{"/proc": true, "/sys": true, "/dev": true}
+)
+
+// sbomPackage is a package which was found in an image.
+type sbomPackage struct {
+	Name    string
+	Version string
+	// PURL is the package URL which identifies the package.
+	PURL string
+	// Source is the file which the package was found in.
+	Source string
+}
+
+// sbomDocument is an SBOM which describes an image.
+type sbomDocument struct {
+	MediaType string
+	Data      []byte
+	Digest    digest.Digest
+}
+
+// sbomFormatFromEnv returns the format that SBOMs should be generated in, or
+// "" if they shouldn't be generated.
+func sbomFormatFromEnv() (string, error) {
+	format := strings.ToLower(strings.TrimSpace(os.Getenv(builderutil.BuildSBOM)))
+	switch format {
+	case "", sbomFormatSPDX, sbomFormatCycloneDX:
+		return format, nil
+	}
+	return "", fmt.Errorf("unrecognized %s %q, expected %q or %q", builderutil.BuildSBOM, format, sbomFormatSPDX, sbomFormatCycloneDX)
+}
+
+// scanRootfs finds the packages which are installed in the filesystem at
+// root, using the RPM, dpkg, and apk databases, and the dependencies that are
+// listed in npm, pip, and Go lockfiles.
+func scanRootfs(root string) ([]sbomPackage, error) {
+	distro := osReleaseID(root)
+	var packages []sbomPackage
+	for _, dbPath := range rpmDatabasePaths {
+		resolved, err := securejoin.SecureJoin(root, dbPath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(resolved); err != nil {
+			continue
+		}
+		out, err := exec.Command("rpm", "--dbpath", resolved, "-qa", "--qf", "%{NAME}\\t%{EPOCHNUM}\\t%{VERSION}\\t%{RELEASE}\\t%{ARCH}\\n").Output()
+		if err != nil {
+			log.V(0).Infof("Warning: unable to read the RPM database at %s: %v", dbPath, err)
+			continue
+		}
+		packages = append(packages, parseRPMPackages(string(out), distro, dbPath)...)
+		break
+	}
+	for _, db := range []struct {
+		path  string
+		parse func(data, distro, source string) []sbomPackage
+	}{
+		{path: "/var/lib/dpkg/status", parse: parseDpkgPackages},
+		{path: "/lib/apk/db/installed", parse: parseApkPackages},
+	} {
+		resolved, err := securejoin.SecureJoin(root, db.path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(resolved)
+		if err != nil {
+			continue
+		}
+		packages = append(packages, db.parse(string(data), distro, db.path)...)
+	}
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// skip anything that we can't read
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		imagePath := filepath.Clean("/" + rel)
+		if entry.IsDir() {
+			if sbomSkippedDirs[imagePath] || entry.Name() == "node_modules" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		var parse func(data []byte, source string) []sbomPackage
+		switch entry.Name() {
+		case "package-lock.json":
+			parse = parseNpmLockfile
+		case "requirements.txt":
+			parse = parsePipRequirements
+		case "go.mod":
+			parse = parseGoModule
+		default:
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		packages = append(packages, parse(data, imagePath)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uniquePackages(packages), nil
+}
+
+// osReleaseID returns the ID of the distribution that the filesystem at root
+// contains, if it has an os-release file.
+func osReleaseID(root string) string {
+	for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		resolved, err := securejoin.SecureJoin(root, path)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(resolved)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "ID="); ok {
+				return strings.Trim(value, `"'`)
+			}
+		}
+	}
+	return ""
+}
+
+// purl formats a package URL.  The name may include a namespace, separated by
+// a "/", and qualifiers with empty values are omitted.
+func purl(packageType, name, version string, qualifiers ...string) string {
+	segments := strings.Split(name, "/")
+	for i := range segments {
+		// "@" separates the version, so it can't appear unescaped
+		segments[i] = strings.ReplaceAll(url.PathEscape(segments[i]), "@", "%40")
+	}
+	p := fmt.Sprintf("pkg:%s/%s", packageType, strings.Join(segments, "/"))
+	if version != "" {
+		p += "@" + url.PathEscape(version)
+	}
+	var query []string
+	for i := 0; i+1 < len(qualifiers); i += 2 {
+		if qualifiers[i+1] != "" {
+			query = append(query, qualifiers[i]+"="+url.QueryEscape(qualifiers[i+1]))
+		}
+	}
+	if len(query) > 0 {
+		p += "?" + strings.Join(query, "&")
+	}
+	return p
+}
+
+// parseRPMPackages parses the packages listed by "rpm -qa", as tab-separated
+// names, epochs, versions, releases, and architectures.
+func parseRPMPackages(data, distro, source string) []sbomPackage {
+	var packages []sbomPackage
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		name, epoch, version, release, arch := fields[0], fields[1], fields[2], fields[3], fields[4]
+		if epoch == "0" || epoch == "(none)" {
+			epoch = ""
+		}
+		if arch == "(none)" {
+			arch = ""
+		}
+		packages = append(packages, sbomPackage{
+			Name:    name,
+			Version: version + "-" + release,
+			PURL:    purl("rpm", namespaced(distro, name), version+"-"+release, "arch", arch, "epoch", epoch),
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// parseDpkgPackages parses the packages which are installed according to a
+// dpkg status file.
+func parseDpkgPackages(data, distro, source string) []sbomPackage {
+	var packages []sbomPackage
+	for _, paragraph := range strings.Split(data, "\n\n") {
+		fields := make(map[string]string)
+		for _, line := range strings.Split(paragraph, "\n") {
+			if key, value, ok := strings.Cut(line, ": "); ok && !strings.HasPrefix(line, " ") {
+				fields[key] = strings.TrimSpace(value)
+			}
+		}
+		if fields["Package"] == "" || !strings.HasSuffix(fields["Status"], " installed") {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			PURL:    purl("deb", namespaced(distro, fields["Package"]), fields["Version"], "arch", fields["Architecture"]),
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// parseApkPackages parses the packages which are installed according to an
+// apk database.
+func parseApkPackages(data, distro, source string) []sbomPackage {
+	var packages []sbomPackage
+	for _, paragraph := range strings.Split(data, "\n\n") {
+		fields := make(map[string]string)
+		for _, line := range strings.Split(paragraph, "\n") {
+			if key, value, ok := strings.Cut(line, ":"); ok && len(key) == 1 {
+				fields[key] = value
+			}
+		}
+		if fields["P"] == "" {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Name:    fields["P"],
+			Version: fields["V"],
+			PURL:    purl("apk", namespaced(distro, fields["P"]), fields["V"], "arch", fields["A"]),
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// parseNpmLockfile parses the dependencies which are listed in an npm
+// package-lock.json file.
+func parseNpmLockfile(data []byte, source string) []sbomPackage {
+	var lockfile struct {
+		Packages map[string]struct {
+			Version string `json:"version"`
+			Link    bool   `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lockfile); err != nil {
+		log.V(2).Infof("Skipping %s: %v", source, err)
+		return nil
+	}
+	versions := make(map[string]string)
+	if len(lockfile.Packages) > 0 {
+		// lockfileVersion 2 and later list every installed package
+		// by the path it's installed at
+		for path, pkg := range lockfile.Packages {
+			index := strings.LastIndex(path, "node_modules/")
+			if index < 0 || pkg.Link || pkg.Version == "" {
+				continue
+			}
+			versions[path[index+len("node_modules/"):]+"@"+pkg.Version] = pkg.Version
+		}
+	} else {
+		for name, pkg := range lockfile.Dependencies {
+			versions[name+"@"+pkg.Version] = pkg.Version
+		}
+	}
+	var packages []sbomPackage
+	for key, version := range versions {
+		name := strings.TrimSuffix(key, "@"+version)
+		packages = append(packages, sbomPackage{
+			Name:    name,
+			Version: version,
+			PURL:    purl("npm", name, version),
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// parsePipRequirements parses the pinned requirements in a pip
+// requirements.txt file.
+func parsePipRequirements(data []byte, source string) []sbomPackage {
+	var packages []sbomPackage
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line, _, _ = strings.Cut(line, ";")
+		name, version, ok := strings.Cut(line, "==")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "[")
+		name = strings.TrimSpace(name)
+		version, _, _ = strings.Cut(strings.TrimSpace(version), " ")
+		if name == "" || version == "" || strings.HasPrefix(name, "-") {
+			continue
+		}
+		// PyPI names are case-insensitive, and treat "_" like "-"
+		normalized := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		packages = append(packages, sbomPackage{
+			Name:    name,
+			Version: version,
+			PURL:    purl("pypi", normalized, version),
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// parseGoModule parses the modules which are required by a go.mod file.
+func parseGoModule(data []byte, source string) []sbomPackage {
+	file, err := modfile.ParseLax(source, data, nil)
+	if err != nil {
+		log.V(2).Infof("Skipping %s: %v", source, err)
+		return nil
+	}
+	var packages []sbomPackage
+	for _, require := range file.Require {
+		packages = append(packages, sbomPackage{
+			Name:    require.Mod.Path,
+			Version: require.Mod.Version,
+			PURL:    purl("golang", require.Mod.Path, require.Mod.Version),
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// namespaced prefixes name with a namespace, if there is one.
+func namespaced(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// uniquePackages sorts packages by their package URLs, and drops any which
+// were found more than once.
+func uniquePackages(packages []sbomPackage) []sbomPackage {
+	sort.SliceStable(packages, func(i, j int) bool {
+		return packages[i].PURL < packages[j].PURL
+	})
+	var unique []sbomPackage
+	for i, pkg := range packages {
+		if i > 0 && pkg.PURL == packages[i-1].PURL {
+			continue
+		}
+		unique = append(unique, pkg)
+	}
+	return unique
+}
+
+// newSBOMDocument writes an SBOM in the format which lists the packages in
+// the image called imageName.  Its identifiers are derived from its contents,
+// so that the same packages always produce the same document.
+func newSBOMDocument(format, imageName string, packages []sbomPackage, created time.Time) (sbomDocument, error) {
+	hash := sha256.New()
+	fmt.Fprintln(hash, imageName)
+	for _, pkg := range packages {
+		fmt.Fprintln(hash, pkg.PURL, pkg.Source)
+	}
+	sum := hash.Sum(nil)
+	timestamp := created.UTC().Format(time.RFC3339)
+
+	var document interface{}
+	var mediaType string
+	switch format {
+	case sbomFormatSPDX:
+		mediaType = sbomMediaTypeSPDX
+		document = spdxDocument(imageName, fmt.Sprintf("https://openshift.io/spdx/%x", sum), timestamp, packages)
+	case sbomFormatCycloneDX:
+		mediaType = sbomMediaTypeCycloneDX
+		serial := fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+		document = cycloneDXDocument(imageName, serial, timestamp, packages)
+	default:
+		return sbomDocument{}, fmt.Errorf("unrecognized SBOM format %q", format)
+	}
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return sbomDocument{}, err
+	}
+	return sbomDocument{
+		MediaType: mediaType,
+		Data:      data,
+		Digest:    digest.FromBytes(data),
+	}, nil
+}
+
+// spdxDocument returns an SPDX 2.3 document which says that the image
+// contains the packages.
+func spdxDocument(imageName, namespace, created string, packages []sbomPackage) map[string]interface{} {
+	type externalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		SourceInfo       string        `json:"sourceInfo,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+	}
+	type relationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+	spdxPackages := []spdxPackage{{
+		SPDXID:           "SPDXRef-Image",
+		Name:             imageName,
+		DownloadLocation: "NOASSERTION",
+	}}
+	relationships := []relationship{{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: "SPDXRef-Image",
+	}}
+	for i, pkg := range packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		spdxPackages = append(spdxPackages, spdxPackage{
+			SPDXID:           id,
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			SourceInfo:       "found in " + pkg.Source,
+			ExternalRefs: []externalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.PURL,
+			}},
+		})
+		relationships = append(relationships, relationship{
+			SPDXElementID:      "SPDXRef-Image",
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              imageName,
+		"documentNamespace": namespace,
+		"creationInfo": map[string]interface{}{
+			"created":  created,
+			"creators": []string{"Tool: " + sbomToolName},
+		},
+		"packages":      spdxPackages,
+		"relationships": relationships,
+	}
+}
+
+// cycloneDXDocument returns a CycloneDX 1.5 document whose components are the
+// packages in the image.
+func cycloneDXDocument(imageName, serialNumber, created string, packages []sbomPackage) map[string]interface{} {
+	type component struct {
+		Type    string `json:"type"`
+		BOMRef  string `json:"bom-ref,omitempty"`
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+		PURL    string `json:"purl,omitempty"`
+	}
+	components := []component{}
+	for _, pkg := range packages {
+		components = append(components, component{
+			Type:    "library",
+			BOMRef:  pkg.PURL,
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    pkg.PURL,
+		})
+	}
+	return map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": serialNumber,
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": created,
+			"tools": map[string]interface{}{
+				"components": []component{{Type: "application", Name: sbomToolName}},
+			},
+			"component": component{Type: "container", Name: imageName},
+		},
+		"components": components,
+	}
+}
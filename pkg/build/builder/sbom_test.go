@@ -0,0 +1,223 @@
+package builder
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestSBOMFormatFromEnv(t *testing.T) {
+	tests := map[string]string{
+		"":          "",
+		"spdx":      sbomFormatSPDX,
+		"SPDX":      sbomFormatSPDX,
+		"cyclonedx": sbomFormatCycloneDX,
+		"syft":      "error",
+	}
+	preserveEnv, preserveSet := os.LookupEnv(builderutil.BuildSBOM)
+	for input, expected := range tests {
+		if err := os.Setenv(builderutil.BuildSBOM, input); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		actual, err := sbomFormatFromEnv()
+		if expected == "error" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, actual)
+		}
+	}
+	if preserveSet {
+		os.Setenv(builderutil.BuildSBOM, preserveEnv)
+	} else {
+		os.Unsetenv(builderutil.BuildSBOM)
+	}
+}
+
+func TestParsePackageDatabases(t *testing.T) {
+	rpms := "bash\t0\t5.1.8\t9.el9\tx86_64\ngpg-pubkey\t0\tfd431d51\t4ae0493b\t(none)\nshadow-utils\t2\t4.9\t8.el9\tx86_64\n"
+	dpkgStatus := `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.36-9
+Description: GNU C Library
+ continued description
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+`
+	apkInstalled := "C:Q1abc=\nP:musl\nV:1.2.4-r2\nA:x86_64\n\nP:busybox\nV:1.36.1-r5\nA:x86_64\n"
+	tests := []struct {
+		name     string
+		actual   []sbomPackage
+		expected []string
+	}{
+		{
+			name:     "rpm",
+			actual:   parseRPMPackages(rpms, "rhel", "/var/lib/rpm"),
+			expected: []string{"pkg:rpm/rhel/bash@5.1.8-9.el9?arch=x86_64", "pkg:rpm/rhel/shadow-utils@4.9-8.el9?arch=x86_64&epoch=2"},
+		},
+		{
+			name:     "dpkg",
+			actual:   parseDpkgPackages(dpkgStatus, "debian", "/var/lib/dpkg/status"),
+			expected: []string{"pkg:deb/debian/libc6@2.36-9?arch=amd64"},
+		},
+		{
+			name:     "apk",
+			actual:   parseApkPackages(apkInstalled, "alpine", "/lib/apk/db/installed"),
+			expected: []string{"pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64", "pkg:apk/alpine/busybox@1.36.1-r5?arch=x86_64"},
+		},
+		{
+			name: "npm",
+			actual: uniquePackages(parseNpmLockfile([]byte(`{"lockfileVersion": 3, "packages": {
+				"": {"name": "app"},
+				"node_modules/@babel/core": {"version": "7.23.0"},
+				"node_modules/left-pad/node_modules/ms": {"version": "2.1.3"},
+				"node_modules/local": {"link": true}
+			}}`), "/app/package-lock.json")),
+			expected: []string{"pkg:npm/%40babel/core@7.23.0", "pkg:npm/ms@2.1.3"},
+		},
+		{
+			name:     "npm v1",
+			actual:   parseNpmLockfile([]byte(`{"lockfileVersion": 1, "dependencies": {"ms": {"version": "2.0.0"}}}`), "/app/package-lock.json"),
+			expected: []string{"pkg:npm/ms@2.0.0"},
+		},
+		{
+			name:     "pip",
+			actual:   parsePipRequirements([]byte("# pinned\nRequests[socks]==2.31.0 ; python_version > '3'\nflask>=2\n-r other.txt\nPyYAML == 6.0.1  # yaml\n"), "/app/requirements.txt"),
+			expected: []string{"pkg:pypi/requests@2.31.0", "pkg:pypi/pyyaml@6.0.1"},
+		},
+		{
+			name:     "go",
+			actual:   parseGoModule([]byte("module example.com/app\n\ngo 1.21\n\nrequire (\n\tgithub.com/spf13/cobra v1.8.0\n\tgolang.org/x/sys v0.15.0 // indirect\n)\n"), "/src/go.mod"),
+			expected: []string{"pkg:golang/github.com/spf13/cobra@v1.8.0", "pkg:golang/golang.org/x/sys@v0.15.0"},
+		},
+	}
+	for _, test := range tests {
+		var actual []string
+		for _, pkg := range test.actual {
+			actual = append(actual, pkg.PURL)
+		}
+		if !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestScanRootfs(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"etc/os-release":                      "NAME=\"Debian GNU/Linux\"\nID=debian\n",
+		"var/lib/dpkg/status":                 "Package: bash\nStatus: install ok installed\nVersion: 5.2.15-2\nArchitecture: amd64\n",
+		"app/requirements.txt":                "flask==3.0.0\n",
+		"app/node_modules/x/requirements.txt": "ignored==1.0\n",
+		"proc/requirements.txt":               "ignored==1.0\n",
+		"srv/a/requirements.txt":              "flask==3.0.0\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packages, err := scanRootfs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sbomPackage{
+		{Name: "bash", Version: "5.2.15-2", PURL: "pkg:deb/debian/bash@5.2.15-2?arch=amd64", Source: "/var/lib/dpkg/status"},
+		{Name: "flask", Version: "3.0.0", PURL: "pkg:pypi/flask@3.0.0", Source: "/app/requirements.txt"},
+	}
+	if !reflect.DeepEqual(expected, packages) {
+		t.Errorf("expected %#v, got %#v", expected, packages)
+	}
+}
+
+func TestNewSBOMDocument(t *testing.T) {
+	packages := []sbomPackage{
+		{Name: "bash", Version: "5.2.15-2", PURL: "pkg:deb/debian/bash@5.2.15-2?arch=amd64", Source: "/var/lib/dpkg/status"},
+		{Name: "flask", Version: "3.0.0", PURL: "pkg:pypi/flask@3.0.0", Source: "/app/requirements.txt"},
+	}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	spdx, err := newSBOMDocument(sbomFormatSPDX, "registry.example.com/ns/app:latest", packages, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := newSBOMDocument(sbomFormatSPDX, "registry.example.com/ns/app:latest", packages, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spdx.Digest != again.Digest || spdx.MediaType != sbomMediaTypeSPDX {
+		t.Errorf("expected the same packages to produce the same %s document, got %s and %s", spdx.MediaType, spdx.Digest, again.Digest)
+	}
+	var spdxDoc struct {
+		SPDXVersion  string `json:"spdxVersion"`
+		CreationInfo struct {
+			Created string `json:"created"`
+		} `json:"creationInfo"`
+		Packages []struct {
+			Name         string `json:"name"`
+			ExternalRefs []struct {
+				ReferenceLocator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+		Relationships []struct {
+			RelationshipType string `json:"relationshipType"`
+		} `json:"relationships"`
+	}
+	if err := json.Unmarshal(spdx.Data, &spdxDoc); err != nil {
+		t.Fatal(err)
+	}
+	if spdxDoc.SPDXVersion != "SPDX-2.3" || spdxDoc.CreationInfo.Created != "2024-01-02T03:04:05Z" {
+		t.Errorf("unexpected SPDX document %s", spdx.Data)
+	}
+	if len(spdxDoc.Packages) != 3 || spdxDoc.Packages[0].Name != "registry.example.com/ns/app:latest" || spdxDoc.Packages[2].ExternalRefs[0].ReferenceLocator != "pkg:pypi/flask@3.0.0" {
+		t.Errorf("expected the image and its packages, got %s", spdx.Data)
+	}
+	if len(spdxDoc.Relationships) != 3 || spdxDoc.Relationships[0].RelationshipType != "DESCRIBES" || spdxDoc.Relationships[1].RelationshipType != "CONTAINS" {
+		t.Errorf("expected the document to describe the image, which contains the packages, got %s", spdx.Data)
+	}
+
+	cyclonedx, err := newSBOMDocument(sbomFormatCycloneDX, "registry.example.com/ns/app:latest", packages, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cyclonedxDoc struct {
+		BOMFormat    string `json:"bomFormat"`
+		SerialNumber string `json:"serialNumber"`
+		Components   []struct {
+			PURL string `json:"purl"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(cyclonedx.Data, &cyclonedxDoc); err != nil {
+		t.Fatal(err)
+	}
+	if cyclonedx.MediaType != sbomMediaTypeCycloneDX || cyclonedxDoc.BOMFormat != "CycloneDX" || len(cyclonedxDoc.SerialNumber) != len("urn:uuid:00000000-0000-0000-0000-000000000000") {
+		t.Errorf("unexpected CycloneDX document %s", cyclonedx.Data)
+	}
+	if len(cyclonedxDoc.Components) != 2 || cyclonedxDoc.Components[0].PURL != packages[0].PURL {
+		t.Errorf("expected a component for each package, got %s", cyclonedx.Data)
+	}
+
+	if _, err := newSBOMDocument("syft", "app", packages, created); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
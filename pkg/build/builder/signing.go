@@ -0,0 +1,407 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	cp "github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/signature/signer"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/containers/image/v5/types"
+	"github.com/secure-systems-lab/go-securesystemslib/encrypted"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+const (
+	// signingFormatSigstore signs images with a sigstore private key, and
+	// attaches the signatures to the image in the registry.
+	signingFormatSigstore = "sigstore"
+	// signingFormatSimple signs images with a GPG key, and stores the
+	// signatures wherever registries.d says to, or in the registry if it
+	// supports the signature extension API.
+	signingFormatSimple = "simple"
+
+	// defaultRegistriesDirPath is where registries.d configuration is read
+	// from when the system context doesn't say otherwise.
+	defaultRegistriesDirPath = "/etc/containers/registries.d"
+	// sigstoreRegistriesFileName is the registries.d file which turns on
+	// sigstore attachments for the repository that we sign images in.
+	sigstoreRegistriesFileName = "zz-openshift-builder-sigstore.yaml"
+)
+
+// imageSigning is the key which pushed images are signed with.
+type imageSigning struct {
+	// Format is either signingFormatSigstore or signingFormatSimple.
+	Format string
+	// KeyFile is a sigstore private key, or an armored GPG secret key.
+	KeyFile string
+	// Passphrase unlocks the key.  It is empty, but never nil, if the key
+	// doesn't need one.
+	Passphrase []byte
+}
+
+// imageSigningFromEnv reads the key which pushed images should be signed
+// with from the environment, and returns nil if images should not be signed.
+func imageSigningFromEnv() (*imageSigning, error) {
+	keyFile := os.Getenv(builderutil.BuildSigningKey)
+	format := strings.ToLower(strings.TrimSpace(os.Getenv(builderutil.BuildSigningFormat)))
+	if keyFile == "" {
+		if format != "" {
+			return nil, fmt.Errorf("%s is set, but %s is not", builderutil.BuildSigningFormat, builderutil.BuildSigningKey)
+		}
+		return nil, nil
+	}
+	switch format {
+	case "":
+		format = signingFormatSigstore
+	case signingFormatSigstore, signingFormatSimple:
+	default:
+		return nil, fmt.Errorf("unrecognized %s %q, expected %q or %q", builderutil.BuildSigningFormat, format, signingFormatSigstore, signingFormatSimple)
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	signing := &imageSigning{
+		Format:     format,
+		KeyFile:    keyFile,
+		Passphrase: []byte{},
+	}
+	if passphraseFile := os.Getenv(builderutil.BuildSigningPassphraseFile); passphraseFile != "" {
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key passphrase: %v", err)
+		}
+		signing.Passphrase = bytes.TrimRight(passphrase, "\r\n")
+	}
+	return signing, nil
+}
+
+// sign signs the image at ref, which it expects to be identity, with the key.
+func (s *imageSigning) sign(ctx context.Context, sc *types.SystemContext, ref types.ImageReference, identity reference.Named) error {
+	switch s.Format {
+	case signingFormatSigstore:
+		signers, release, err := s.signers()
+		if err != nil {
+			return err
+		}
+		defer release()
+		return signImage(ctx, sc, ref, ref, identity, signers)
+	case signingFormatSimple:
+		gpgHome, fingerprint, err := importSigningKey(s.KeyFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			exec.Command("gpgconf", "--homedir", gpgHome, "--kill", "gpg-agent").Run()
+			os.RemoveAll(gpgHome)
+		}()
+		mech := &gpgSigningMechanism{homeDir: gpgHome}
+		return signImageSimple(ctx, sc, ref, ref, identity, mech, fingerprint, string(s.Passphrase))
+	}
+	return fmt.Errorf("unrecognized signing format %q", s.Format)
+}
+
+// signers returns the signers for a sigstore key, and a function which
+// releases them.
+func (s *imageSigning) signers() ([]*signer.Signer, func(), error) {
+	if s.Format != signingFormatSigstore {
+		return nil, nil, fmt.Errorf("signing format %q doesn't use signers", s.Format)
+	}
+	sigstoreSigner, err := sigstore.NewSigner(sigstore.WithPrivateKeyFile(s.KeyFile, s.Passphrase))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading sigstore signing key: %v", err)
+	}
+	return []*signer.Signer{sigstoreSigner}, func() { sigstoreSigner.Close() }, nil
+}
+
+// gpgSigningMechanism creates simple signatures by running gpg with a home
+// directory of its own.  The signing mechanisms in containers/image only look
+// for keys in $GNUPGHOME, which we'd have to change for the whole process.
+type gpgSigningMechanism struct {
+	homeDir string
+}
+
+func (m *gpgSigningMechanism) Close() error {
+	return nil
+}
+
+func (m *gpgSigningMechanism) SupportsSigning() error {
+	return nil
+}
+
+func (m *gpgSigningMechanism) Sign(input []byte, keyIdentity string) ([]byte, error) {
+	return m.SignWithPassphrase(input, keyIdentity, "")
+}
+
+// SignWithPassphrase creates a signature of input, which includes input, using
+// the key with the fingerprint keyIdentity, which passphrase unlocks.
+func (m *gpgSigningMechanism) SignWithPassphrase(input []byte, keyIdentity string, passphrase string) ([]byte, error) {
+	// pass the passphrase through a pipe, so that it's not on the command line
+	passphraseReader, passphraseWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer passphraseReader.Close()
+	_, err = passphraseWriter.Write([]byte(passphrase))
+	passphraseWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("gpg", "--homedir", m.homeDir, "--batch", "--no-tty", "--pinentry-mode", "loopback", "--passphrase-fd", "3", "--local-user", keyIdentity, "--sign")
+	cmd.ExtraFiles = []*os.File{passphraseReader}
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	signature, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error signing with key %s: %v: %s", keyIdentity, err, strings.TrimSpace(stderr.String()))
+	}
+	return signature, nil
+}
+
+func (m *gpgSigningMechanism) Verify(unverifiedSignature []byte) ([]byte, string, error) {
+	return nil, "", errors.New("verifying signatures is not supported")
+}
+
+func (m *gpgSigningMechanism) UntrustedSignatureContents(untrustedSignature []byte) ([]byte, string, error) {
+	return nil, "", errors.New("reading signatures is not supported")
+}
+
+// signEnvelope signs the payload, which has the type payloadType, and returns
+// a DSSE envelope which holds both of them.  Only sigstore keys can sign
+// envelopes, so it returns nil if the key is of another kind.
+func (s *imageSigning) signEnvelope(payloadType string, payload []byte) ([]byte, error) {
+	if s.Format != signingFormatSigstore {
+		return nil, nil
+	}
+	key, err := loadSigstorePrivateKey(s.KeyFile, s.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	// DSSE signs the "pre-authentication encoding" of the payload,
+	// which includes its type
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+	var sig []byte
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, pae, crypto.Hash(0))
+	} else {
+		sum := sha256.Sum256(pae)
+		sig, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing %s: %v", payloadType, err)
+	}
+	type envelopeSignature struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	}
+	return json.Marshal(struct {
+		PayloadType string              `json:"payloadType"`
+		Payload     string              `json:"payload"`
+		Signatures  []envelopeSignature `json:"signatures"`
+	}{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []envelopeSignature{{Sig: base64.StdEncoding.EncodeToString(sig)}},
+	})
+}
+
+// loadSigstorePrivateKey decrypts a sigstore, or cosign, private key.
+func loadSigstorePrivateKey(keyFile string, passphrase []byte) (crypto.Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || (block.Type != "ENCRYPTED SIGSTORE PRIVATE KEY" && block.Type != "ENCRYPTED COSIGN PRIVATE KEY") {
+		return nil, fmt.Errorf("%s is not a sigstore private key", keyFile)
+	}
+	der, err := encrypted.Decrypt(block.Bytes, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting signing key: %v", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key: %v", err)
+	}
+	privateKey, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return privateKey, nil
+}
+
+// signatureLocation describes where the signature of the image was stored.
+func (s *imageSigning) signatureLocation(image reference.Canonical) string {
+	if s.Format == signingFormatSigstore {
+		// the tag that sigstore attachments are stored under
+		return fmt.Sprintf("%s:%s-%s.sig", image.Name(), image.Digest().Algorithm(), image.Digest().Encoded())
+	}
+	return image.String()
+}
+
+// importSigningKey imports a GPG secret key into a new GPG home directory, and
+// returns the directory and the fingerprint of the key.
+func importSigningKey(keyFile string) (string, string, error) {
+	gpgHome, err := os.MkdirTemp("", "gnupg")
+	if err != nil {
+		return "", "", err
+	}
+	if out, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--import", keyFile).CombinedOutput(); err != nil {
+		os.RemoveAll(gpgHome)
+		return "", "", fmt.Errorf("error importing signing key: %v: %s", err, out)
+	}
+	out, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--with-colons", "--list-secret-keys").Output()
+	if err != nil {
+		os.RemoveAll(gpgHome)
+		return "", "", fmt.Errorf("error listing imported signing key: %v", err)
+	}
+	fingerprint := secretKeyFingerprint(string(out))
+	if fingerprint == "" {
+		os.RemoveAll(gpgHome)
+		return "", "", fmt.Errorf("no GPG secret key was found in %s", keyFile)
+	}
+	return gpgHome, fingerprint, nil
+}
+
+// secretKeyFingerprint returns the fingerprint of the first secret key in the
+// output of "gpg --with-colons --list-secret-keys".
+func secretKeyFingerprint(listing string) string {
+	inSecretKey := false
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "sec":
+			inSecretKey = true
+		case "ssb", "pub", "sub":
+			inSecretKey = false
+		case "fpr":
+			if inSecretKey && len(fields) > 9 && fields[9] != "" {
+				return fields[9]
+			}
+		}
+	}
+	return ""
+}
+
+// sigstoreRegistriesDir returns a new registries.d directory with the
+// configuration in registriesDir, which tells containers/image to read and
+// write sigstore attachments for repository.  The caller should remove it.
+func sigstoreRegistriesDir(registriesDir, repository string) (string, error) {
+	dir, err := os.MkdirTemp("", "registries.d")
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(registriesDir)
+	if err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("error reading %s: %v", registriesDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(registriesDir, entry.Name()))
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("error reading %s: %v", registriesDir, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, entry.Name()), data, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	config := fmt.Sprintf("docker:\n  %q:\n    use-sigstore-attachments: true\n", repository)
+	if err := os.WriteFile(filepath.Join(dir, sigstoreRegistriesFileName), []byte(config), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// signImage copies the image at src to dest without changing it, adding
+// signatures which say that it is identity.  When src and dest are the same
+// image in a registry, this signs the image in place.
+func signImage(ctx context.Context, sc *types.SystemContext, src, dest types.ImageReference, identity reference.Named, signers []*signer.Signer) error {
+	// We only read back the image that we just pushed, so there's nothing
+	// for a signature policy to protect us from.
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{
+		Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	_, err = cp.Image(ctx, policyContext, dest, src, &cp.Options{
+		SourceCtx:          sc,
+		DestinationCtx:     sc,
+		Signers:            signers,
+		SignIdentity:       identity,
+		ImageListSelection: cp.CopyAllImages,
+		PreserveDigests:    true,
+	})
+	if err != nil {
+		return fmt.Errorf("error signing image: %v", err)
+	}
+	return nil
+}
+
+// signImageSimple copies the manifest of the image at src to dest, along with
+// its simple signatures and a new one, which mech creates with the key
+// keyIdentity, saying that it is identity.  When src and dest are the same
+// image in a registry, this signs the image in place.
+func signImageSimple(ctx context.Context, sc *types.SystemContext, src, dest types.ImageReference, identity reference.Named, mech signature.SigningMechanism, keyIdentity, passphrase string) error {
+	source, err := src.NewImageSource(ctx, sc)
+	if err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+	defer source.Close()
+	manifestBytes, _, err := source.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error reading image manifest: %v", err)
+	}
+	signatures, err := source.GetSignatures(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error reading image signatures: %v", err)
+	}
+	sig, err := signature.SignDockerManifestWithOptions(manifestBytes, identity.String(), mech, keyIdentity, &signature.SignOptions{Passphrase: passphrase})
+	if err != nil {
+		return fmt.Errorf("error signing image: %v", err)
+	}
+
+	destination, err := dest.NewImageDestination(ctx, sc)
+	if err != nil {
+		return fmt.Errorf("error writing image: %v", err)
+	}
+	defer destination.Close()
+	// signatures can only be written along with the manifest that they sign
+	if err := destination.PutManifest(ctx, manifestBytes, nil); err != nil {
+		return fmt.Errorf("error writing image manifest: %v", err)
+	}
+	if err := destination.PutSignatures(ctx, append(signatures, sig), nil); err != nil {
+		return fmt.Errorf("error writing image signature: %v", err)
+	}
+	if err := destination.Commit(ctx, image.UnparsedInstance(source, nil)); err != nil {
+		return fmt.Errorf("error writing image signature: %v", err)
+	}
+	return nil
+}
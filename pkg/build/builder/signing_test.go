@@ -0,0 +1,442 @@
+package builder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+func TestImageSigningFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		key        string
+		format     string
+		passphrase string
+		expected   *imageSigning
+		expectErr  bool
+	}{
+		{name: "unset"},
+		{name: "format without key", format: "simple", expectErr: true},
+		{
+			name:     "default format",
+			key:      keyFile,
+			expected: &imageSigning{Format: signingFormatSigstore, KeyFile: keyFile, Passphrase: []byte{}},
+		},
+		{
+			name:       "simple with passphrase",
+			key:        keyFile,
+			format:     "Simple",
+			passphrase: passphraseFile,
+			expected:   &imageSigning{Format: signingFormatSimple, KeyFile: keyFile, Passphrase: []byte("secret")},
+		},
+		{name: "unknown format", key: keyFile, format: "cosign", expectErr: true},
+		{name: "missing key", key: filepath.Join(dir, "missing"), expectErr: true},
+		{name: "missing passphrase", key: keyFile, passphrase: filepath.Join(dir, "missing"), expectErr: true},
+	}
+	vars := []string{builderutil.BuildSigningKey, builderutil.BuildSigningFormat, builderutil.BuildSigningPassphraseFile}
+	preserveEnv := make(map[string]*string)
+	for _, name := range vars {
+		if value, ok := os.LookupEnv(name); ok {
+			preserveEnv[name] = &value
+		}
+	}
+	for _, test := range tests {
+		os.Setenv(builderutil.BuildSigningKey, test.key)
+		os.Setenv(builderutil.BuildSigningFormat, test.format)
+		os.Setenv(builderutil.BuildSigningPassphraseFile, test.passphrase)
+		actual, err := imageSigningFromEnv()
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", test.name, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.expected == nil {
+			if actual != nil {
+				t.Errorf("%s: expected no signing, got %#v", test.name, actual)
+			}
+			continue
+		}
+		if actual == nil || actual.Format != test.expected.Format || actual.KeyFile != test.expected.KeyFile || string(actual.Passphrase) != string(test.expected.Passphrase) || actual.Passphrase == nil {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.expected, actual)
+		}
+	}
+	for _, name := range vars {
+		if value := preserveEnv[name]; value != nil {
+			os.Setenv(name, *value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestSecretKeyFingerprint(t *testing.T) {
+	listing := strings.Join([]string{
+		"sec:u:255:22:0123456789ABCDEF:1700000000:::u:::scESC:::+:::ed25519:::0:",
+		"fpr:::::::::AAAABBBBCCCCDDDDEEEEFFFF0123456789ABCDEF:",
+		"grp:::::::::0000000000000000000000000000000000000000:",
+		"uid:u::::1700000000::0000000000000000000000000000000000000000::Builder <builder@example.com>::::::::::0:",
+		"ssb:u:255:18:FEDCBA9876543210:1700000000::::::e:::+:::cv25519::",
+		"fpr:::::::::1111222233334444555566667777888899990000:",
+	}, "\n")
+	if actual := secretKeyFingerprint(listing); actual != "AAAABBBBCCCCDDDDEEEEFFFF0123456789ABCDEF" {
+		t.Errorf("expected the primary key's fingerprint, got %q", actual)
+	}
+	if actual := secretKeyFingerprint(""); actual != "" {
+		t.Errorf("expected no fingerprint, got %q", actual)
+	}
+}
+
+func TestImportSigningKey(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	dir := t.TempDir()
+	gpgHome := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(gpgHome, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer exec.Command("gpgconf", "--homedir", gpgHome, "--kill", "gpg-agent").Run()
+	if out, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--passphrase", "", "--quick-gen-key", "Builder <builder@example.com>", "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Fatalf("error generating a key: %v: %s", err, out)
+	}
+	key, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--armor", "--export-secret-keys").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--with-colons", "--list-secret-keys").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.asc")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	importedHome, fingerprint, err := importSigningKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importedHome)
+	defer exec.Command("gpgconf", "--homedir", importedHome, "--kill", "gpg-agent").Run()
+	if expected := secretKeyFingerprint(string(listing)); fingerprint == "" || fingerprint != expected {
+		t.Errorf("expected fingerprint %q, got %q", expected, fingerprint)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if home, _, err := importSigningKey(keyFile); err == nil {
+		os.RemoveAll(home)
+		t.Errorf("expected an error importing something that isn't a key")
+	}
+}
+
+func TestSigstoreRegistriesDir(t *testing.T) {
+	registriesDir := t.TempDir()
+	existing := "docker:\n  registry.example.com:\n    lookaside: https://sigs.example.com\n"
+	if err := os.WriteFile(filepath.Join(registriesDir, "default.yaml"), []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(registriesDir, "README"), []byte("not configuration"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := sigstoreRegistriesDir(registriesDir, "registry.example.com:5000/ns/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	copied, err := os.ReadFile(filepath.Join(dir, "default.yaml"))
+	if err != nil || string(copied) != existing {
+		t.Errorf("expected the existing configuration to be copied, got %q: %v", copied, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "README")); !os.IsNotExist(err) {
+		t.Errorf("expected only configuration files to be copied: %v", err)
+	}
+	added, err := os.ReadFile(filepath.Join(dir, sigstoreRegistriesFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(added), `"registry.example.com:5000/ns/app":`) || !strings.Contains(string(added), "use-sigstore-attachments: true") {
+		t.Errorf("expected sigstore attachments to be turned on for the repository, got %q", added)
+	}
+
+	missing, err := sigstoreRegistriesDir(filepath.Join(registriesDir, "missing"), "registry.example.com/ns/app")
+	if err != nil {
+		t.Errorf("expected a missing registries.d to be ignored: %v", err)
+	}
+	os.RemoveAll(missing)
+}
+
+func TestSignatureLocation(t *testing.T) {
+	named, err := reference.ParseNormalizedNamed("registry.example.com/ns/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical, err := reference.WithDigest(named, digest.FromString("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigstoreLocation := (&imageSigning{Format: signingFormatSigstore}).signatureLocation(canonical)
+	if expected := "registry.example.com/ns/app:sha256-" + digest.FromString("manifest").Encoded() + ".sig"; sigstoreLocation != expected {
+		t.Errorf("expected %q, got %q", expected, sigstoreLocation)
+	}
+	if simpleLocation := (&imageSigning{Format: signingFormatSimple}).signatureLocation(canonical); simpleLocation != canonical.String() {
+		t.Errorf("expected %q, got %q", canonical.String(), simpleLocation)
+	}
+}
+
+// writeDirImage writes an image with no layers in the layout of the dir:
+// transport.
+func writeDirImage(t *testing.T, dir string) {
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDigest := digest.FromBytes(config)
+	manifest, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config: imgspecv1.Descriptor{
+			MediaType: imgspecv1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+		Layers: []imgspecv1.Descriptor{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"version":              []byte("Directory Transport Version: 1.1\n"),
+		configDigest.Encoded(): config,
+		"manifest.json":        manifest,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSignImageSigstore(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := []byte("passphrase")
+	keys, err := sigstore.GenerateKeyPair(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "cosign.key")
+	if err := os.WriteFile(keyFile, keys.PrivateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srcDir, destDir := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for _, d := range []string{srcDir, destDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDirImage(t, srcDir)
+	src, err := directory.NewReference(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := directory.NewReference(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := reference.ParseNormalizedNamed("registry.example.com/ns/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signing := &imageSigning{Format: signingFormatSigstore, KeyFile: keyFile, Passphrase: []byte("wrong")}
+	if _, _, err := signing.signers(); err == nil {
+		t.Errorf("expected the wrong passphrase to be rejected")
+	}
+	signing.Passphrase = passphrase
+	signers, release, err := signing.signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if err := signImage(context.Background(), nil, src, dest, identity, signers); err != nil {
+		t.Fatal(err)
+	}
+	srcManifest, err := os.ReadFile(filepath.Join(srcDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	destManifest, err := os.ReadFile(filepath.Join(destDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(srcManifest) != string(destManifest) {
+		t.Errorf("expected signing to leave the manifest unchanged, got %s", destManifest)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "signature-1")); err != nil {
+		t.Errorf("expected a signature to be written: %v", err)
+	}
+}
+
+func TestSignImageSimple(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	dir := t.TempDir()
+	gpgHome := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(gpgHome, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer exec.Command("gpgconf", "--homedir", gpgHome, "--kill", "gpg-agent").Run()
+	if out, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--pinentry-mode", "loopback", "--passphrase", "passphrase", "--quick-gen-key", "Builder <builder@example.com>", "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Fatalf("error generating a key: %v: %s", err, out)
+	}
+	key, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--pinentry-mode", "loopback", "--passphrase", "passphrase", "--armor", "--export-secret-keys").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.asc")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	importedHome, fingerprint, err := importSigningKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importedHome)
+	defer exec.Command("gpgconf", "--homedir", importedHome, "--kill", "gpg-agent").Run()
+
+	srcDir, destDir := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	for _, d := range []string{srcDir, destDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDirImage(t, srcDir)
+	src, err := directory.NewReference(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := directory.NewReference(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := reference.ParseNormalizedNamed("registry.example.com/ns/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mech := &gpgSigningMechanism{homeDir: importedHome}
+	if err := signImageSimple(context.Background(), nil, src, dest, identity, mech, fingerprint, "wrong"); err == nil {
+		t.Errorf("expected the wrong passphrase to be rejected")
+	}
+	if err := signImageSimple(context.Background(), nil, src, dest, identity, mech, fingerprint, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	srcManifest, err := os.ReadFile(filepath.Join(srcDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	destManifest, err := os.ReadFile(filepath.Join(destDir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(srcManifest) != string(destManifest) {
+		t.Errorf("expected signing to leave the manifest unchanged, got %s", destManifest)
+	}
+	contents, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--decrypt", filepath.Join(destDir, "signature-1")).Output()
+	if err != nil {
+		t.Fatalf("expected a valid signature to be written: %v", err)
+	}
+	if !strings.Contains(string(contents), identity.String()) {
+		t.Errorf("expected the signature to be for %s, got %s", identity, contents)
+	}
+}
+
+func TestSignEnvelope(t *testing.T) {
+	passphrase := []byte("passphrase")
+	keys, err := sigstore.GenerateKeyPair(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "cosign.key")
+	if err := os.WriteFile(keyFile, keys.PrivateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signing := &imageSigning{Format: signingFormatSimple, KeyFile: keyFile, Passphrase: passphrase}
+	if envelope, err := signing.signEnvelope(inTotoMediaType, []byte("{}")); err != nil || envelope != nil {
+		t.Errorf("expected simple signing keys not to sign envelopes, got %s, %v", envelope, err)
+	}
+
+	signing.Format = signingFormatSigstore
+	payload := []byte(`{"_type":"https://in-toto.io/Statement/v1"}`)
+	data, err := signing.signEnvelope(inTotoMediaType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope struct {
+		PayloadType string `json:"payloadType"`
+		Payload     []byte `json:"payload"`
+		Signatures  []struct {
+			Sig []byte `json:"sig"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.PayloadType != inTotoMediaType || string(envelope.Payload) != string(payload) || len(envelope.Signatures) != 1 {
+		t.Fatalf("unexpected envelope %s", data)
+	}
+
+	block, _ := pem.Decode(keys.PublicKey)
+	if block == nil {
+		t.Fatalf("unexpected public key %s", keys.PublicKey)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		t.Fatalf("expected an ECDSA key, got %T", publicKey)
+	}
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(inTotoMediaType), inTotoMediaType, len(payload), payload)
+	sum := sha256.Sum256([]byte(pae))
+	if !ecdsa.VerifyASN1(ecdsaKey, sum[:], envelope.Signatures[0].Sig) {
+		t.Errorf("expected the signature to verify against the public key")
+	}
+}
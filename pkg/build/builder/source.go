@@ -20,7 +20,6 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	restclient "k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
 	buildapiv1 "github.com/openshift/api/build/v1"
@@ -103,20 +102,15 @@ func GitClone(ctx context.Context, gitClient GitClient, gitSource *buildapiv1.Gi
 // in the working directory (accounting for contextdir+dockerfilepath)
 // with new FROM image information based on the imagestream/imagetrigger
 // and also adds some env and label values to the dockerfile based on
-// the build information.
-func ManageDockerfile(dir string, build *buildapiv1.Build) error {
+// the build information.  The build's status is updated using buildsClient,
+// unless it's nil.
+func ManageDockerfile(dir string, build *buildapiv1.Build, buildsClient buildclientv1.BuildInterface) error {
 	ctx := timing.NewContext(context.Background())
 	defer func() {
 		build.Status.Stages = timing.GetStages(ctx)
-		clientConfig, err := restclient.InClusterConfig()
-		if err != nil {
-			return
-		}
-		buildsClient, err := buildclientv1.NewForConfig(clientConfig)
-		if err != nil {
-			return
+		if buildsClient != nil {
+			HandleBuildStatusUpdate(build, buildsClient, nil)
 		}
-		HandleBuildStatusUpdate(build, buildsClient.Builds(build.Namespace), nil)
 	}()
 	os.MkdirAll(dir, 0777)
 	log.V(5).Infof("Checking for presence of a Dockerfile")
@@ -155,7 +149,7 @@ func ManageDockerfile(dir string, build *buildapiv1.Build) error {
 	return nil
 }
 
-func ExtractImageContent(ctx context.Context, dockerClient DockerClient, store storage.Store, dir string, build *buildapiv1.Build, blobCacheDirectory string) error {
+func ExtractImageContent(ctx context.Context, dockerClient DockerClient, store storage.Store, dir string, build *buildapiv1.Build, blobCache *BlobCache) error {
 	os.MkdirAll(dir, 0777)
 	forcePull := false
 	switch {
@@ -166,16 +160,37 @@ func ExtractImageContent(ctx context.Context, dockerClient DockerClient, store s
 	case build.Spec.Strategy.CustomStrategy != nil:
 		forcePull = build.Spec.Strategy.CustomStrategy.ForcePull
 	}
-	// extract source from an Image if specified
+	// pull the images that source is extracted from in parallel, and
+	// then extract it from each of them in order
+	policy := clientRetryPolicy(dockerClient)
+	var pulls []string
+	imageSecretIndexes := make(map[string]int)
 	for i, image := range build.Spec.Source.Images {
 		if len(image.Paths) == 0 {
 			continue
 		}
+		if _, ok := imageSecretIndexes[image.From.Name]; ok {
+			continue
+		}
 		imageSecretIndex := i
 		if image.PullSecret == nil {
 			imageSecretIndex = -1
 		}
-		err := extractSourceFromImage(ctx, dockerClient, store, image.From.Name, dir, imageSecretIndex, image.Paths, forcePull, blobCacheDirectory)
+		imageSecretIndexes[image.From.Name] = imageSecretIndex
+		pulls = append(pulls, image.From.Name)
+	}
+	err := pullImagesInParallel(ctx, pulls, pullConcurrency(), buildapiv1.StepPullInputImage, func(image string) error {
+		log.V(0).Infof("Pulling image %s ...", image)
+		return pullSourceImage(ctx, store, policy, image, imageSecretIndexes[image], forcePull, blobCache)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull images: %v", err)
+	}
+	for _, image := range build.Spec.Source.Images {
+		if len(image.Paths) == 0 {
+			continue
+		}
+		err := extractSourceFromImage(ctx, dockerClient, store, policy, image.From.Name, dir, imageSecretIndexes[image.From.Name], image.Paths, false, blobCache)
 		if err != nil {
 			return err
 		}
@@ -187,8 +202,9 @@ func ExtractImageContent(ctx context.Context, dockerClient DockerClient, store s
 // when the remote repository not found and GitAuthenticationError when the
 // remote repository failed to authenticate.
 // Since this is calling the 'git' binary, the proxy settings should be
-// available for this command.
-func checkRemoteGit(gitClient GitClient, url string, initialTimeout time.Duration) error {
+// available for this command.  It stops waiting for the server if ctx is
+// cancelled.
+func checkRemoteGit(ctx context.Context, gitClient GitClient, url string, initialTimeout time.Duration) error {
 
 	var (
 		out    string
@@ -208,6 +224,9 @@ func checkRemoteGit(gitClient GitClient, url string, initialTimeout time.Duratio
 		}
 		if err != nil {
 			if _, ok := err.(*git.TimeoutError); ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				timeout = timeout * timeoutIncrementFactor
 				log.Infof("WARNING: timed out waiting for git server, will wait %s", timeout)
 				continue
@@ -229,12 +248,12 @@ func checkRemoteGit(gitClient GitClient, url string, initialTimeout time.Duratio
 
 // checkSourceURI performs a check on the URI associated with the build
 // to make sure that it is valid.
-func checkSourceURI(gitClient GitClient, rawurl string, timeout time.Duration) error {
+func checkSourceURI(ctx context.Context, gitClient GitClient, rawurl string, timeout time.Duration) error {
 	_, err := s2igit.Parse(rawurl)
 	if err != nil {
 		return fmt.Errorf("Invalid git source url %q: %v", rawurl, err)
 	}
-	return checkRemoteGit(gitClient, rawurl, timeout)
+	return checkRemoteGit(ctx, gitClient, rawurl, timeout)
 }
 
 // ExtractInputBinary processes the provided input stream as directed by BinaryBuildSource
@@ -289,7 +308,10 @@ func extractGitSource(ctx context.Context, gitClient GitClient, gitSource *build
 	log.V(0).Infof("Cloning %q ...", gitSource.URI)
 
 	// Check source URI by trying to connect to the server
-	if err := checkSourceURI(gitClient, gitSource.URI, timeout); err != nil {
+	if err := checkSourceURI(ctx, gitClient, gitSource.URI, timeout); err != nil {
+		return true, err
+	}
+	if err := ctx.Err(); err != nil {
 		return true, err
 	}
 
@@ -316,6 +338,9 @@ func extractGitSource(ctx context.Context, gitClient GitClient, gitSource *build
 	}
 
 	timing.RecordNewStep(ctx, buildapiv1.StageFetchInputs, buildapiv1.StepFetchGitSource, startTime, metav1.Now())
+	if err := ctx.Err(); err != nil {
+		return true, err
+	}
 
 	// if we specify a commit, ref, or branch to checkout, do so, and update submodules
 	if usingRef {
@@ -378,23 +403,12 @@ func copyImageSourceFromFilesytem(sourceDir, destDir string) error {
 	return nil
 }
 
-func extractSourceFromImage(ctx context.Context, dockerClient DockerClient, store storage.Store, image, buildDir string, imageSecretIndex int, paths []buildapiv1.ImageSourcePath, forcePull bool, blobCacheDirectory string) error {
-	log.V(4).Infof("Extracting image source from image %s", image)
-
-	pullPolicy := buildah.PullIfMissing
-	if forcePull {
-		pullPolicy = buildah.PullAlways
-	}
-
-	/*
-		storeOptions := storage.DefaultStoreOptions
-		storeOptions.GraphDriverName = "overlay"
-		store, err := storage.GetStore(storeOptions)
-		if err != nil {
-			return err
-		}
-	*/
-
+// sourceImageSystemContext returns a SystemContext which holds the node's
+// credentials, and those from the pull secret for the image source at
+// imageSecretIndex, if it isn't -1.  The credentials are written to a file of
+// their own, which the returned function removes, so that several images can
+// be pulled at the same time.
+func sourceImageSystemContext(imageSecretIndex int) (*types.SystemContext, func(), error) {
 	auths, err := GetDockerAuthConfiguration(nodeCredentialsFile)
 	if err != nil {
 		klog.V(2).Infof("proceeding without node credentials: %v", err)
@@ -408,7 +422,7 @@ func extractSourceFromImage(ctx context.Context, dockerClient DockerClient, stor
 		if len(pullSecretPath) > 0 {
 			secretAuths, err := GetDockerAuthConfiguration(pullSecretPath)
 			if err != nil {
-				return fmt.Errorf("error reading docker auth configuration: %v", err)
+				return nil, nil, fmt.Errorf("error reading docker auth configuration: %v", err)
 			}
 
 			for reg, auth := range secretAuths.Configs {
@@ -417,21 +431,93 @@ func extractSourceFromImage(ctx context.Context, dockerClient DockerClient, stor
 		}
 	}
 
+	authDir, err := os.MkdirTemp("", "auth")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating tmp credentials directory: %v", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(authDir); err != nil {
+			log.V(2).Infof("unable to remove tmp credentials directory: %v", err)
+		}
+	}
+
 	var systemContext types.SystemContext
-	systemContext.AuthFilePath = "/tmp/config.json"
+	systemContext.AuthFilePath = filepath.Join(authDir, "config.json")
 
 	for registry, ac := range auths.Configs {
 		normalizedRegistry := normalizeRegistryLocation(registry)
 		log.V(5).Infof("Setting authentication for registry %q (originally %q) at %q.", normalizedRegistry, registry, ac.ServerAddress)
 		if err := config.SetAuthentication(&systemContext, registry, ac.Username, ac.Password); err != nil {
-			return err
+			cleanup()
+			return nil, nil, err
 		}
 		if normalizedServerAddress := normalizeRegistryLocation(ac.ServerAddress); normalizedServerAddress != normalizedRegistry {
 			if err := config.SetAuthentication(&systemContext, normalizedServerAddress, ac.Username, ac.Password); err != nil {
-				return err
+				cleanup()
+				return nil, nil, err
 			}
 		}
 	}
+	return &systemContext, cleanup, nil
+}
+
+// pullSourceImage pulls an image that source is extracted from, using the
+// credentials for the image source at imageSecretIndex, and retrying failed
+// pulls using the policy.
+func pullSourceImage(ctx context.Context, store storage.Store, policy retryPolicy, image string, imageSecretIndex int, forcePull bool, blobCache *BlobCache) error {
+	pullPolicy := buildah.PullIfMissing
+	if forcePull {
+		pullPolicy = buildah.PullAlways
+	}
+
+	systemContext, cleanup, err := sourceImageSystemContext(imageSecretIndex)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	options := buildah.PullOptions{
+		ReportWriter:  os.Stdout,
+		Store:         store,
+		SystemContext: systemContext,
+		BlobDirectory: blobCache.Directory(),
+		PullPolicy:    pullPolicy,
+	}
+	return blobCache.Use(store, "pull", func() ([]string, error) {
+		var imageID string
+		err := policy.retry(ctx, "Pull", func() (pullErr error) {
+			imageID, pullErr = buildah.Pull(ctx, image, options)
+			return pullErr
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []string{imageID}, nil
+	})
+}
+
+func extractSourceFromImage(ctx context.Context, dockerClient DockerClient, store storage.Store, policy retryPolicy, image, buildDir string, imageSecretIndex int, paths []buildapiv1.ImageSourcePath, forcePull bool, blobCache *BlobCache) error {
+	log.V(4).Infof("Extracting image source from image %s", image)
+
+	pullPolicy := buildah.PullIfMissing
+	if forcePull {
+		pullPolicy = buildah.PullAlways
+	}
+
+	/*
+		storeOptions := storage.DefaultStoreOptions
+		storeOptions.GraphDriverName = "overlay"
+		store, err := storage.GetStore(storeOptions)
+		if err != nil {
+			return err
+		}
+	*/
+
+	systemContext, cleanup, err := sourceImageSystemContext(imageSecretIndex)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
 	defaultContainerConfig, err := cconfig.Default()
 	if err != nil {
@@ -446,20 +532,35 @@ func extractSourceFromImage(ctx context.Context, dockerClient DockerClient, stor
 		FromImage:     image,
 		PullPolicy:    pullPolicy,
 		ReportWriter:  os.Stdout,
-		SystemContext: &systemContext,
+		SystemContext: systemContext,
 		Capabilities:  capabilities,
 		CommonBuildOpts: &buildah.CommonBuildOptions{
 			HTTPProxy: true,
 		},
-		MaxPullRetries: DefaultPushOrPullRetryCount,
-		PullRetryDelay: DefaultPushOrPullRetryDelay,
+		BlobDirectory: blobCache.Directory(),
 	}
 
-	builder, err := buildah.NewBuilder(ctx, store, builderOptions)
+	var builder *buildah.Builder
+	err = blobCache.Use(store, "pull", func() ([]string, error) {
+		err := policy.retry(ctx, "Pull", func() (pullErr error) {
+			builder, pullErr = buildah.NewBuilder(ctx, store, builderOptions)
+			return pullErr
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []string{builder.FromImageID}, nil
+	})
 	if err != nil {
 		return fmt.Errorf("error creating buildah builder: %v", err)
 	}
 
+	defer func() {
+		if err := builder.Delete(); err != nil {
+			klog.Errorf("failed to remove the container for image %s: %v", image, err)
+		}
+	}()
+
 	mountPath, err := builder.Mount("")
 	defer func() {
 		err := builder.Unmount()
@@ -472,6 +573,9 @@ func extractSourceFromImage(ctx context.Context, dockerClient DockerClient, stor
 	}
 
 	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		destPath := filepath.Join(buildDir, path.DestinationDir)
 		// Paths ending with "/." are truncated by filepath.Join
 		// Add it back to preserve copy behavior per docs:
@@ -28,14 +28,14 @@ func TestCheckRemoteGit(t *testing.T) {
 	gitRepo := git.NewRepositoryWithEnv([]string{"GIT_ASKPASS=true", fmt.Sprintf("HOME=%s", os.TempDir())})
 
 	var err error
-	err = checkRemoteGit(gitRepo, server.URL, 10*time.Second)
+	err = checkRemoteGit(context.Background(), gitRepo, server.URL, 10*time.Second)
 	switch v := err.(type) {
 	case gitAuthError:
 	default:
 		t.Errorf("expected gitAuthError, got %q", v)
 	}
 
-	err = checkRemoteGit(gitRepo, "https://github.com/openshift/origin", 10*time.Second)
+	err = checkRemoteGit(context.Background(), gitRepo, "https://github.com/openshift/origin", 10*time.Second)
 	if err != nil {
 		t.Errorf("unexpected error %q", err)
 	}
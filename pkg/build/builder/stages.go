@@ -0,0 +1,322 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/imagebuilder"
+	dockercmd "github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+
+	"github.com/openshift/builder/pkg/build/builder/util/dockerfile"
+)
+
+// dockerfileStage is one of the stages of a multi-stage Dockerfile.
+type dockerfileStage struct {
+	// name is the stage's canonical name, or "" if it doesn't have one.
+	name string
+	// nodes are the stage's instructions, starting with its FROM.
+	nodes []*parser.Node
+	// uses are the indexes of the earlier stages which the stage is
+	// built on, or copies or mounts content from.
+	uses []int
+}
+
+// dockerfileStages is a multi-stage Dockerfile, split into stages which can
+// be built one at a time.  The text of instructions which don't refer to other
+// stages is kept as it was written, so that heredocs and comments survive.
+type dockerfileStages struct {
+	// path is where the Dockerfile was read from.
+	path   string
+	lines  []string
+	header []string
+	stages []dockerfileStage
+	args   []string
+}
+
+// splitDockerfileStages splits a Dockerfile into its stages, working out
+// which earlier stages each of them uses, with the build arguments in args.
+func splitDockerfileStages(in []byte, args map[string]string) (*dockerfileStages, error) {
+	node, err := imagebuilder.ParseDockerfile(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	buildArgs := make(map[string]string)
+	for _, arg := range dockerfile.HeaderArgs(node) {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+			buildArgs[kv[0]] = kv[1]
+		}
+	}
+	for name, value := range args {
+		buildArgs[name] = value
+	}
+
+	s := &dockerfileStages{
+		lines: strings.SplitAfter(string(in), "\n"),
+		args:  argsAsSlice(buildArgs),
+	}
+	// keep the parser directives and comments at the top
+	if len(node.Children) > 0 && node.Children[0].StartLine > 1 && node.Children[0].StartLine <= len(s.lines) {
+		s.header = append(s.header, s.lines[:node.Children[0].StartLine-1]...)
+	}
+	for _, child := range node.Children {
+		if child.Value == dockercmd.From {
+			s.stages = append(s.stages, dockerfileStage{name: stageName(child)})
+		}
+		if len(s.stages) == 0 {
+			s.header = append(s.header, s.nodeLines(child)...)
+			continue
+		}
+		stage := &s.stages[len(s.stages)-1]
+		stage.nodes = append(stage.nodes, child)
+	}
+	for i := range s.stages {
+		for _, child := range s.stages[i].nodes {
+			for _, ref := range nodeStageRefs(child) {
+				used, err := s.stageIndex(ref, i)
+				if err != nil {
+					return nil, err
+				}
+				if used >= 0 {
+					s.stages[i].uses = append(s.stages[i].uses, used)
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// nodeLines returns the lines of the Dockerfile which hold the instruction,
+// including the content of any heredocs that it has.
+func (s *dockerfileStages) nodeLines(node *parser.Node) []string {
+	start, end := node.StartLine-1, node.EndLine
+	if start < 0 || end > len(s.lines) || start >= end {
+		return []string{string(dockerfile.Write(node))}
+	}
+	return s.lines[start:end]
+}
+
+// nodeStageRefs returns the values of the places where an instruction could
+// refer to an earlier stage: a FROM's base image, a COPY's --from flag, and
+// the from option of a RUN's --mount flags.
+func nodeStageRefs(node *parser.Node) []string {
+	var refs []string
+	switch node.Value {
+	case dockercmd.From:
+		if node.Next != nil {
+			refs = append(refs, node.Next.Value)
+		}
+	case dockercmd.Copy:
+		if ref, ok := nodeHasFromRef(node); ok && len(ref) > 0 {
+			refs = append(refs, ref)
+		}
+	case dockercmd.Run:
+		for _, flag := range node.Flags {
+			if !strings.HasPrefix(flag, "--mount=") {
+				continue
+			}
+			for _, option := range strings.Split(strings.TrimPrefix(flag, "--mount="), ",") {
+				if strings.HasPrefix(option, "from=") {
+					refs = append(refs, strings.TrimPrefix(option, "from="))
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// stageIndex returns the index of the stage which ref names, by its name or by
+// its index, out of the stages before the one with the index before, or -1 if
+// ref names an image instead.
+func (s *dockerfileStages) stageIndex(ref string, before int) (int, error) {
+	value, err := imagebuilder.ProcessWord(ref, s.args)
+	if err != nil {
+		return -1, err
+	}
+	name := canonicalStageName(value)
+	for i := 0; i < before; i++ {
+		if s.stages[i].name != "" && s.stages[i].name == name {
+			return i, nil
+		}
+	}
+	if i, err := strconv.Atoi(value); err == nil && i >= 0 && i < before {
+		return i, nil
+	}
+	return -1, nil
+}
+
+// plan returns the index of the stage which produces the image, which is the
+// target stage if there is one, and the indexes of the stages to build, in
+// the order to build them.  Without a target, every stage is built, and the
+// last one produces the image.  With one, only the stages that it uses are.
+func (s *dockerfileStages) plan(target string) (final int, build []int, err error) {
+	final = len(s.stages) - 1
+	if target == "" {
+		for i := range s.stages {
+			build = append(build, i)
+		}
+		return final, build, nil
+	}
+	final = -1
+	for i, stage := range s.stages {
+		if stage.name == canonicalStageName(target) {
+			final = i
+			break
+		}
+	}
+	if final < 0 {
+		return -1, nil, fmt.Errorf("the target stage %q was not found in the Dockerfile", target)
+	}
+	needed := map[int]bool{final: true}
+	for i := final; i >= 0; i-- {
+		if !needed[i] {
+			continue
+		}
+		for _, used := range s.stages[i].uses {
+			needed[used] = true
+		}
+	}
+	for i := 0; i <= final; i++ {
+		if needed[i] {
+			build = append(build, i)
+		}
+	}
+	return final, build, nil
+}
+
+// stillUsed returns the IDs of the images which have been built for stages
+// that stages which haven't been built yet still use.
+func (s *dockerfileStages) stillUsed(imageIDs map[int]string, build []int) map[string]bool {
+	used := make(map[string]bool)
+	for _, i := range build {
+		if _, built := imageIDs[i]; built {
+			continue
+		}
+		for _, u := range s.stages[i].uses {
+			if id, ok := imageIDs[u]; ok {
+				used[id] = true
+			}
+		}
+	}
+	return used
+}
+
+// stageDockerfile returns a Dockerfile which builds only the stage with the
+// index, using the images in imageIDs, which were built for the stages that
+// it uses, in place of those stages.  Arguments declared before the first
+// stage are declared in it, too.
+func (s *dockerfileStages) stageDockerfile(index int, imageIDs map[int]string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	for _, line := range s.header {
+		out.WriteString(line)
+	}
+	for _, child := range s.stages[index].nodes {
+		replaced, err := s.replaceStageRefs(child, index, imageIDs)
+		if err != nil {
+			return nil, err
+		}
+		if replaced == nil {
+			for _, line := range s.nodeLines(child) {
+				out.WriteString(line)
+			}
+			continue
+		}
+		// only the instruction changes, any heredocs that follow it
+		// are kept as they were
+		lines := s.nodeLines(child)
+		heredocLines := 0
+		for _, heredoc := range child.Heredocs {
+			heredocLines += strings.Count(heredoc.Content, "\n") + 1
+		}
+		out.Write(dockerfile.Write(replaced))
+		if heredocLines > 0 && heredocLines < len(lines) {
+			for _, line := range lines[len(lines)-heredocLines:] {
+				out.WriteString(line)
+			}
+		}
+	}
+	if b := out.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		out.WriteString("\n")
+	}
+	return out.Bytes(), nil
+}
+
+// replaceStageRefs returns a copy of the instruction with its references to
+// earlier stages replaced by the IDs of the images which were built for them,
+// or nil if it doesn't refer to any.  The instruction itself isn't changed, so
+// that it can be used again for another platform.
+func (s *dockerfileStages) replaceStageRefs(node *parser.Node, index int, imageIDs map[int]string) (*parser.Node, error) {
+	imageID := func(ref string) (string, bool, error) {
+		used, err := s.stageIndex(ref, index)
+		if err != nil || used < 0 {
+			return "", false, err
+		}
+		id, ok := imageIDs[used]
+		if !ok {
+			return "", false, fmt.Errorf("stage %d uses stage %d, which hasn't been built", index, used)
+		}
+		return id, true, nil
+	}
+	replaced := false
+	copied := *node
+	node = &copied
+	node.Flags = append([]string(nil), node.Flags...)
+	if node.Next != nil {
+		next := *node.Next
+		node.Next = &next
+	}
+	switch node.Value {
+	case dockercmd.From:
+		if node.Next == nil {
+			break
+		}
+		id, ok, err := imageID(node.Next.Value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			node.Next.Value = id
+			replaced = true
+		}
+	case dockercmd.Copy:
+		ref, ok := nodeHasFromRef(node)
+		if !ok || len(ref) == 0 {
+			break
+		}
+		id, ok, err := imageID(ref)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			nodeReplaceFromRef(node, id)
+			replaced = true
+		}
+	case dockercmd.Run:
+		for i, flag := range node.Flags {
+			if !strings.HasPrefix(flag, "--mount=") {
+				continue
+			}
+			options := strings.Split(strings.TrimPrefix(flag, "--mount="), ",")
+			for j, option := range options {
+				if !strings.HasPrefix(option, "from=") {
+					continue
+				}
+				id, ok, err := imageID(strings.TrimPrefix(option, "from="))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					options[j] = "from=" + id
+					replaced = true
+				}
+			}
+			node.Flags[i] = "--mount=" + strings.Join(options, ",")
+		}
+	}
+	if !replaced {
+		return nil, nil
+	}
+	return node, nil
+}
@@ -0,0 +1,132 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc"
+)
+
+func TestSplitDockerfileStages(t *testing.T) {
+	in := heredoc.Doc(`
+		# escape=\
+		ARG BASE=registry.example.com/base:1
+		FROM ${BASE} AS Builder
+		RUN make
+		FROM registry.example.com/tools AS tools
+		FROM builder AS test
+		RUN --mount=type=bind,from=Tools,source=/bin/lint,target=/lint /lint
+		FROM registry.example.com/runtime
+		COPY --from=0 /out /out
+		RUN <<EOF
+		echo --from=builder
+		EOF
+	`)
+	stages, err := splitDockerfileStages([]byte(in), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uses [][]int
+	for _, stage := range stages.stages {
+		uses = append(uses, stage.uses)
+	}
+	if expected := [][]int{nil, nil, {0, 1}, {0}}; !reflect.DeepEqual(uses, expected) {
+		t.Errorf("expected stages to use %v, got %v", expected, uses)
+	}
+
+	final, build, err := stages.plan("")
+	if err != nil || final != 3 || !reflect.DeepEqual(build, []int{0, 1, 2, 3}) {
+		t.Errorf("expected to build every stage for stage 3, got %v, %v, %v", build, final, err)
+	}
+	final, build, err = stages.plan("TEST")
+	if err != nil || final != 2 || !reflect.DeepEqual(build, []int{0, 1, 2}) {
+		t.Errorf("expected to build stages 0-2 for the test stage, got %v, %v, %v", build, final, err)
+	}
+	if _, _, err = stages.plan("missing"); err == nil {
+		t.Errorf("expected an error for a missing target")
+	}
+
+	imageIDs := map[int]string{0: "builder-id", 1: "tools-id"}
+	if used := stages.stillUsed(imageIDs, []int{0, 1, 2, 3}); !reflect.DeepEqual(used, map[string]bool{"builder-id": true, "tools-id": true}) {
+		t.Errorf("expected the builder and tools images to still be used, got %v", used)
+	}
+	imageIDs[2] = "test-id"
+	if used := stages.stillUsed(imageIDs, []int{0, 1, 2, 3}); !reflect.DeepEqual(used, map[string]bool{"builder-id": true}) {
+		t.Errorf("expected only the builder image to still be used, got %v", used)
+	}
+
+	out, err := stages.stageDockerfile(0, imageIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := heredoc.Doc(`
+		# escape=\
+		ARG BASE=registry.example.com/base:1
+		FROM ${BASE} AS Builder
+		RUN make
+	`); string(out) != expected {
+		t.Errorf("expected stage 0 to be\n%s\ngot\n%s", expected, out)
+	}
+	out, err = stages.stageDockerfile(2, imageIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := heredoc.Doc(`
+		# escape=\
+		ARG BASE=registry.example.com/base:1
+		FROM builder-id AS test
+		RUN --mount=type=bind,from=tools-id,source=/bin/lint,target=/lint /lint
+	`); string(out) != expected {
+		t.Errorf("expected stage 2 to be\n%s\ngot\n%s", expected, out)
+	}
+	out, err = stages.stageDockerfile(3, imageIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := heredoc.Doc(`
+		# escape=\
+		ARG BASE=registry.example.com/base:1
+		FROM registry.example.com/runtime
+		COPY --from=builder-id /out /out
+		RUN <<EOF
+		echo --from=builder
+		EOF
+	`); string(out) != expected {
+		t.Errorf("expected stage 3 to be\n%s\ngot\n%s", expected, out)
+	}
+
+	// the stages are left alone, so that they can be built again for
+	// another platform
+	out, err = stages.stageDockerfile(2, map[int]string{0: "other-builder-id", 1: "other-tools-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := heredoc.Doc(`
+		# escape=\
+		ARG BASE=registry.example.com/base:1
+		FROM other-builder-id AS test
+		RUN --mount=type=bind,from=other-tools-id,source=/bin/lint,target=/lint /lint
+	`); string(out) != expected {
+		t.Errorf("expected stage 2 to be\n%s\ngot\n%s", expected, out)
+	}
+	if _, err := stages.stageDockerfile(3, map[int]string{}); err == nil {
+		t.Errorf("expected an error for a stage which uses one that hasn't been built")
+	}
+}
+
+func TestSplitDockerfileStagesArgs(t *testing.T) {
+	in := heredoc.Doc(`
+		ARG STAGE=builder
+		FROM registry.example.com/base AS builder
+		FROM registry.example.com/base AS other
+		FROM registry.example.com/runtime
+		COPY --from=${STAGE} /out /out
+	`)
+	stages, err := splitDockerfileStages([]byte(in), map[string]string{"STAGE": "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses := stages.stages[2].uses; !reflect.DeepEqual(uses, []int{1}) {
+		t.Errorf("expected the last stage to use the stage named by the build argument, got %v", uses)
+	}
+}
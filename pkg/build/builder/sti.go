@@ -78,6 +78,7 @@ type S2IBuilder struct {
 	build        *buildapiv1.Build
 	client       buildclientv1.BuildInterface
 	cgLimits     *s2iapi.CGroupLimits
+	retryPolicy  retryPolicy
 }
 
 // NewS2IBuilder creates a new STIBuilder instance
@@ -99,6 +100,7 @@ func newS2IBuilder(dockerClient DockerClient, dockerSocket string, buildsClient
 		build:        build,
 		client:       buildsClient,
 		cgLimits:     cgLimits,
+		retryPolicy:  clientRetryPolicy(dockerClient),
 	}
 }
 
@@ -130,10 +132,10 @@ func makeVolumeSpec(src localObjectBuildSource, mountPath string) s2iapi.VolumeS
 }
 
 // Build executes S2I build based on configured builder, S2I builder factory
-// and S2I config validator
-func (s *S2IBuilder) Build() error {
+// and S2I config validator, stopping early if ctx is cancelled
+func (s *S2IBuilder) Build(ctx context.Context) error {
 	var err error
-	ctx := timing.NewContext(context.Background())
+	ctx = timing.NewContext(ctx)
 	defer func() {
 		s.build.Status.Stages = timing.AppendStageAndStepInfo(s.build.Status.Stages, timing.GetStages(ctx))
 		HandleBuildStatusUpdate(s.build, s.client, nil)
@@ -161,6 +163,18 @@ func (s *S2IBuilder) Build() error {
 	if sourceInfo != nil {
 		s2iSourceInfo = toS2ISourceInfo(sourceInfo)
 	}
+	var destinations []pushDestination
+	if push {
+		destinations, err = additionalDestinations(pushTag, buildInfo(s.build, sourceInfo))
+		if err != nil {
+			return err
+		}
+	}
+	exportTo, err := exportDestinationFromEnv()
+	if err != nil {
+		return err
+	}
+
 	injections := s2iapi.VolumeList{}
 	injections = append(injections, injectSecrets(s.build.Spec.Source.Secrets)...)
 	injections = append(injections, injectConfigMaps(s.build.Spec.Source.ConfigMaps)...)
@@ -226,15 +240,40 @@ func (s *S2IBuilder) Build() error {
 	// If DockerCfgPath is provided in buildapiv1.Config, then attempt to read the
 	// dockercfg file and get the authentication for pulling the images.
 
+	if err := checkBaseImagePolicy([]string{config.BuilderImage}); err != nil {
+		SetFailedStatus(ctx, s.build, builderutil.StatusReasonBaseImagePolicyViolation, builderutil.StatusMessageBaseImagePolicyViolation)
+		HandleBuildStatusUpdate(s.build, s.client, nil)
+		return err
+	}
+
+	pinned := make(map[string]string)
 	if s.build.Spec.Strategy.SourceStrategy.ForcePull || !isImagePresent(s.dockerClient, config.BuilderImage) {
 		startTime := metav1.Now()
 		searchPaths := dockercfg.NewHelper().GetDockerAuthSearchPaths(dockercfg.PullAuthType)
-		err = s.pullImage(config.BuilderImage, searchPaths)
+		if pinImagesEnabled() {
+			// pull the builder image by digest, so that the build uses it
+			// even if it's retagged while the build runs
+			pinned = resolveImages(ctx, s.dockerClient, []string{config.BuilderImage}, searchPaths)
+		}
+		if err := checkStorage(ctx, s.dockerClient, pinnedImageNames([]string{config.BuilderImage}, pinned), searchPaths); err != nil {
+			SetFailedStatus(ctx, s.build, builderutil.StatusReasonInsufficientStorage, builderutil.StatusMessageInsufficientStorage)
+			HandleBuildStatusUpdate(s.build, s.client, nil)
+			return err
+		}
+		err = s.pullImage(ctx, pinnedImageNames([]string{config.BuilderImage}, pinned)[0], searchPaths)
 		timing.RecordNewStep(ctx, buildapiv1.StagePullImages, buildapiv1.StepPullBaseImage, startTime, metav1.Now())
 		if err != nil {
 			return err
 		}
 	}
+	if pinImagesEnabled() {
+		pinLocalImages(s.dockerClient, []string{config.BuilderImage}, pinned)
+		if pinnedName, ok := pinned[config.BuilderImage]; ok {
+			logPinnedImages(pinned)
+			config.Labels[pinnedImagesLabel] = pinnedImagesLabelValue(pinned)
+			config.BuilderImage = pinnedName
+		}
+	}
 
 	if config.Incremental {
 		if s.build.Spec.Strategy.SourceStrategy.ForcePull || !isImagePresent(s.dockerClient, config.IncrementalFromTag) {
@@ -242,7 +281,7 @@ func (s *S2IBuilder) Build() error {
 			// we used to push the image previously.
 			searchPaths := dockercfg.NewHelper().GetDockerAuthSearchPaths(dockercfg.PushAuthType)
 			startTime := metav1.Now()
-			err = s.pullImage(config.IncrementalFromTag, searchPaths)
+			err = s.pullImage(ctx, config.IncrementalFromTag, searchPaths)
 			timing.RecordNewStep(ctx, buildapiv1.StagePullImages, buildapiv1.StepPullInputImage, startTime, metav1.Now())
 			// If there was an error, the incremental image may not exist. Treat the build as a normal s2i build.
 			if err != nil {
@@ -309,11 +348,11 @@ func (s *S2IBuilder) Build() error {
 	}
 	builder, buildInfo, err := s.builder.Builder(config, s2ibuild.Overrides{Downloader: nil})
 	if err != nil {
-		s.build.Status.Phase = buildapiv1.BuildPhaseFailed
-		s.build.Status.Reason, s.build.Status.Message = convertS2IFailureType(
+		reason, message := convertS2IFailureType(
 			buildInfo.FailureReason.Reason,
 			buildInfo.FailureReason.Message,
 		)
+		SetFailedStatus(ctx, s.build, reason, message)
 		HandleBuildStatusUpdate(s.build, s.client, nil)
 		return err
 	}
@@ -329,15 +368,14 @@ func (s *S2IBuilder) Build() error {
 	}
 
 	if err != nil {
-		s.build.Status.Phase = buildapiv1.BuildPhaseFailed
 		if result != nil {
-			s.build.Status.Reason, s.build.Status.Message = convertS2IFailureType(
+			reason, message := convertS2IFailureType(
 				result.BuildInfo.FailureReason.Reason,
 				result.BuildInfo.FailureReason.Message,
 			)
+			SetFailedStatus(ctx, s.build, reason, message)
 		} else {
-			s.build.Status.Reason = buildapiv1.StatusReasonGenericBuildFailed
-			s.build.Status.Message = "Generic Build failure - check logs for details."
+			SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonGenericBuildFailed, "Generic Build failure - check logs for details.")
 		}
 
 		HandleBuildStatusUpdate(s.build, s.client, nil)
@@ -381,7 +419,7 @@ func (s *S2IBuilder) Build() error {
 			return err
 		}
 		// Append post commit
-		if err := appendPostCommit(node, buildPostCommit(s.build.Spec.PostCommit)); err != nil {
+		if err := appendPostCommit(node, buildPostCommit(s.build.Spec.PostCommit), ""); err != nil {
 			return err
 		}
 		out := dockerfile.Write(node)
@@ -393,11 +431,17 @@ func (s *S2IBuilder) Build() error {
 	timing.RecordNewStep(ctx, buildapiv1.StageBuild, buildapiv1.StepDockerBuild, startTime, metav1.Now())
 	if err != nil {
 		// TODO: Create new error states
-		s.build.Status.Phase = buildapiv1.BuildPhaseFailed
-		s.build.Status.Reason = buildapiv1.StatusReasonGenericBuildFailed
-		s.build.Status.Message = builderutil.StatusMessageGenericBuildFailed
+		SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonGenericBuildFailed, builderutil.StatusMessageGenericBuildFailed)
 		return err
 	}
+	if exportTo != nil {
+		if err := exportImage(ctx, s.dockerClient, buildTag, exportTo); err != nil {
+			SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonGenericBuildFailed, builderutil.StatusMessageExportImageFailed)
+			HandleBuildStatusUpdate(s.build, s.client, nil)
+			return fmt.Errorf("Failed to export image: %v", err)
+		}
+	}
+
 	if push {
 		if err = tagImage(s.dockerClient, buildTag, pushTag); err != nil {
 			return err
@@ -414,18 +458,34 @@ func (s *S2IBuilder) Build() error {
 		}
 		log.V(0).Infof("\nPushing image %s ...", pushTag)
 		startTime := metav1.Now()
-		digest, err := s.pushImage(pushTag, pushAuthConfig)
+		digest, err := s.pushImage(ctx, pushTag, pushAuthConfig)
 
 		timing.RecordNewStep(ctx, buildapiv1.StagePushImage, buildapiv1.StepPushImage, startTime, metav1.Now())
 
 		if err != nil {
-			s.build.Status.Phase = buildapiv1.BuildPhaseFailed
-			s.build.Status.Reason = buildapiv1.StatusReasonPushImageToRegistryFailed
-			s.build.Status.Message = builderutil.StatusMessagePushImageToRegistryFailed
+			SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessagePushImageToRegistryFailed)
 			HandleBuildStatusUpdate(s.build, s.client, nil)
 			return reportPushFailure(err, authPresent, pushAuthConfig)
 		}
 
+		pushed := []pushedImage{{Name: pushTag, Digest: digest, Auth: pushAuthConfig}}
+		if len(destinations) > 0 {
+			// the build's output isn't reported until it has been pushed
+			// to every destination that it has to be pushed to
+			startTime = metav1.Now()
+			additional, err := pushAdditionalDestinations(ctx, s.dockerClient, pushTag, destinations, s.pushImage)
+
+			timing.RecordNewStep(ctx, buildapiv1.StagePushImage, buildapiv1.StepPushImage, startTime, metav1.Now())
+
+			if err != nil {
+				SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessagePushAdditionalDestinationFailed)
+				HandleBuildStatusUpdate(s.build, s.client, nil)
+				return fmt.Errorf("Failed to push image: %v", err)
+			}
+			pushed = append(pushed, additional...)
+			logPushedImages(pushed)
+		}
+
 		if len(digest) > 0 {
 			s.build.Status.Output.To = &buildapiv1.BuildStatusOutputTo{
 				ImageDigest: digest,
@@ -433,6 +493,25 @@ func (s *S2IBuilder) Build() error {
 			HandleBuildStatusUpdate(s.build, s.client, nil)
 		}
 		log.V(0).Infof("Push successful")
+
+		for i, image := range distinctRepositories(pushed) {
+			signature, err := signPushedImage(ctx, s.dockerClient, s.retryPolicy, image.Name, image.Digest, image.Auth)
+			if err != nil {
+				SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessageSignImageFailed)
+				HandleBuildStatusUpdate(s.build, s.client, nil)
+				return fmt.Errorf("Failed to sign image: %v", err)
+			}
+			if signature != "" && i == 0 {
+				s.build.Status.Message = appendSignatureMessage(s.build.Status.Message, signature)
+				HandleBuildStatusUpdate(s.build, s.client, nil)
+			}
+
+			if err := attachProvenance(ctx, s.dockerClient, s.retryPolicy, s.build, image.Name, image.Digest, []string{config.BuilderImage}, image.Auth); err != nil {
+				SetFailedStatus(ctx, s.build, buildapiv1.StatusReasonPushImageToRegistryFailed, builderutil.StatusMessageAttachProvenanceFailed)
+				HandleBuildStatusUpdate(s.build, s.client, nil)
+				return fmt.Errorf("Failed to attach provenance attestation: %v", err)
+			}
+		}
 	}
 	return nil
 }
@@ -443,10 +522,11 @@ func (s *S2IBuilder) setupPullSecret() *dockerclient.AuthConfigurations {
 	return mergeNodeCredentialsDockerAuth(os.Getenv(dockercfg.PullAuthType))
 }
 
-func (s *S2IBuilder) pullImage(name string, searchPaths []string) error {
+func (s *S2IBuilder) pullImage(ctx context.Context, name string, searchPaths []string) error {
 	log.V(2).Infof("Explicitly pulling image %s", name)
 	repository, tag := dockerclient.ParseRepositoryTag(name)
 	options := dockerclient.PullImageOptions{
+		Context:    ctx,
 		Repository: repository,
 		Tag:        tag,
 	}
@@ -455,20 +535,21 @@ func (s *S2IBuilder) pullImage(name string, searchPaths []string) error {
 		options.Repository = name
 	}
 
-	return retryImageAction("Pull", func() (pullErr error) {
+	return s.retryPolicy.retry(ctx, "Pull", func() (pullErr error) {
 		return s.dockerClient.PullImage(options, searchPaths)
 	})
 }
 
-func (s *S2IBuilder) pushImage(name string, authConfig dockerclient.AuthConfiguration) (string, error) {
+func (s *S2IBuilder) pushImage(ctx context.Context, name string, authConfig dockerclient.AuthConfiguration) (string, error) {
 	repository, tag := dockerclient.ParseRepositoryTag(name)
 	options := dockerclient.PushImageOptions{
-		Name: repository,
-		Tag:  tag,
+		Context: ctx,
+		Name:    repository,
+		Tag:     tag,
 	}
 	var err error
 	sha := ""
-	retryImageAction("Push", func() (pushErr error) {
+	s.retryPolicy.retry(ctx, "Push", func() (pushErr error) {
 		sha, err = s.dockerClient.PushImage(options, authConfig)
 		return err
 	})
@@ -476,7 +557,7 @@ func (s *S2IBuilder) pushImage(name string, authConfig dockerclient.AuthConfigur
 }
 
 // buildEnvVars returns a map with build metadata to be inserted into Docker
-// images produced by build. It transforms the output from buildInfo into the
+// images produced by build. It transforms the output from imageBuildInfo into the
 // input format expected by s2iapi.Config.Environment.
 // Note that using a map has at least two downsides:
 //  1. The order of metadata KeyValue pairs is lost;
@@ -484,7 +565,7 @@ func (s *S2IBuilder) pushImage(name string, authConfig dockerclient.AuthConfigur
 //     instead of deferring what to do with repeated environment variables to the
 //     Docker runtime.
 func buildEnvVars(build *buildapiv1.Build, sourceInfo *git.SourceInfo) s2iapi.EnvironmentList {
-	bi := buildInfo(build, sourceInfo)
+	bi := imageBuildInfo(build, sourceInfo)
 	envVars := &s2iapi.EnvironmentList{}
 	for _, item := range bi {
 		envVars.Set(fmt.Sprintf("%s=%s", item.Key, item.Value))
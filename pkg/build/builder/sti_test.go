@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -133,7 +134,7 @@ func TestDockerBuildError(t *testing.T) {
 	s2iBuilder := newTestS2IBuilder(testS2IBuilderConfig{
 		buildError: expErr,
 	})
-	if err := s2iBuilder.Build(); err != expErr {
+	if err := s2iBuilder.Build(context.Background()); err != expErr {
 		t.Errorf("s2iBuilder.Build() = %v; want %v", err, expErr)
 	}
 }
@@ -143,7 +144,7 @@ func TestPushError(t *testing.T) {
 	s2iBuilder := newTestS2IBuilder(testS2IBuilderConfig{
 		errPushImage: expErr,
 	})
-	if err := s2iBuilder.Build(); !strings.HasSuffix(err.Error(), expErr.Error()) {
+	if err := s2iBuilder.Build(context.Background()); !strings.HasSuffix(err.Error(), expErr.Error()) {
 		t.Errorf("s2iBuilder.Build() = %v; want %v", err, expErr)
 	}
 }
@@ -153,7 +154,7 @@ func TestGetStrategyError(t *testing.T) {
 	s2iBuilder := newTestS2IBuilder(testS2IBuilderConfig{
 		getStrategyErr: expErr,
 	})
-	if err := s2iBuilder.Build(); err != expErr {
+	if err := s2iBuilder.Build(context.Background()); err != expErr {
 		t.Errorf("s2iBuilder.Build() = %v; want %v", err, expErr)
 	}
 }
@@ -331,7 +332,7 @@ func TestIncrementalPullError(t *testing.T) {
 		pullImageFunc:    pullFunc,
 	})
 
-	if err := s2ibuilder.Build(); err != nil {
+	if err := s2ibuilder.Build(context.Background()); err != nil {
 		t.Errorf("unexpected build error: %v", err)
 	}
 }
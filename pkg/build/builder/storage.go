@@ -0,0 +1,237 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+const (
+	// defaultStorageReserve is how much space is left free in the storage
+	// where images are kept, after the images that a build pulls have been
+	// stored there, unless the build sets a different amount.
+	defaultStorageReserve = 512 * units.MiB
+
+	// layerExpansionFactor is how much larger we expect a layer to be once
+	// it's been decompressed and stored, than it is in a registry.
+	layerExpansionFactor = 2
+
+	// storageSampleInterval is how often the space used in the storage
+	// where images are kept is checked, to find the most that was used.
+	storageSampleInterval = 2 * time.Second
+)
+
+// storageChecker is implemented by DockerClients which can tell whether they
+// have room for images before they pull them.
+type storageChecker interface {
+	// CheckStorage returns an insufficientStorageError if the images
+	// named names, which haven't been pulled yet, won't fit in the
+	// storage where the client keeps images.  Credentials for the
+	// registries that they're in are found in searchPaths.
+	CheckStorage(ctx context.Context, names, searchPaths []string) error
+}
+
+// storageReporter is implemented by DockerClients which keep track of how
+// much space they used while a build ran.
+type storageReporter interface {
+	// ReportStorage logs the most space that the client used, and stops
+	// keeping track of it.
+	ReportStorage()
+}
+
+// insufficientStorageError is returned when the storage where images are
+// kept doesn't have room for the images that a build needs to pull.
+type insufficientStorageError struct {
+	Path      string
+	Needed    uint64
+	Reserve   uint64
+	Available uint64
+}
+
+func (e *insufficientStorageError) Error() string {
+	return fmt.Sprintf("not enough space in %s for the images which the build uses: they need about %s, and %s should be kept free, but only %s is available",
+		e.Path, units.BytesSize(float64(e.Needed)), units.BytesSize(float64(e.Reserve)), units.BytesSize(float64(e.Available)))
+}
+
+// storageCheckEnabled returns false if the build has turned off checking for
+// room for the images that it pulls.
+func storageCheckEnabled() bool {
+	check, err := strconv.ParseBool(os.Getenv(builderutil.BuildStorageCheck))
+	return err != nil || check
+}
+
+// storageReserveFromEnv returns how much space should be left free in the
+// storage where images are kept.
+func storageReserveFromEnv() uint64 {
+	value := strings.TrimSpace(os.Getenv(builderutil.BuildStorageReserve))
+	if value == "" {
+		return defaultStorageReserve
+	}
+	reserve, err := units.RAMInBytes(value)
+	if err != nil || reserve < 0 {
+		log.V(0).Infof("Warning: ignoring invalid %s %q, keeping %s free.", builderutil.BuildStorageReserve, value, units.BytesSize(defaultStorageReserve))
+		return defaultStorageReserve
+	}
+	return uint64(reserve)
+}
+
+// estimateImageStorage returns about how much space an image whose layers add
+// up to compressedSize bytes in a registry will take up once it's pulled.
+// If the compressed layers are also kept in a blob cache, they're counted,
+// too.
+func estimateImageStorage(compressedSize int64, blobCache bool) uint64 {
+	if compressedSize <= 0 {
+		return 0
+	}
+	size := uint64(compressedSize) * layerExpansionFactor
+	if blobCache {
+		size += uint64(compressedSize)
+	}
+	return size
+}
+
+// checkStorage returns an insufficientStorageError if the images named names
+// won't fit in the storage where client keeps images, if the client is able
+// to tell.
+func checkStorage(ctx context.Context, client DockerClient, names, searchPaths []string) error {
+	checker, ok := client.(storageChecker)
+	if !ok || len(names) == 0 || !storageCheckEnabled() {
+		return nil
+	}
+	return checker.CheckStorage(ctx, names, searchPaths)
+}
+
+// ReportStorageUse logs the most space that the client used while the build
+// ran, if it kept track of it.
+func ReportStorageUse(client DockerClient) {
+	if reporter, ok := client.(storageReporter); ok {
+		reporter.ReportStorage()
+	}
+}
+
+// storageMonitor keeps track of the space used in the filesystem at path,
+// which holds the storage where images are kept.  The filesystem may hold
+// other things, too, so only the space which it uses beyond what was used
+// when the monitor was created is counted.
+type storageMonitor struct {
+	path string
+	// usage returns the space used in, and available in, the filesystem
+	// at a path.
+	usage func(path string) (used, available uint64, err error)
+
+	lock     sync.Mutex
+	baseline uint64
+	peak     uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newStorageMonitor returns a storageMonitor for the filesystem at path, or
+// nil if the space that's used in it can't be found.  A nil storageMonitor
+// doesn't check anything.
+func newStorageMonitor(path string, usage func(path string) (used, available uint64, err error)) *storageMonitor {
+	used, _, err := usage(path)
+	if err != nil {
+		log.V(2).Infof("Not keeping track of the space used in %s: %v", path, err)
+		return nil
+	}
+	return &storageMonitor{
+		path:     path,
+		usage:    usage,
+		baseline: used,
+		peak:     used,
+		stop:     make(chan struct{}),
+	}
+}
+
+// start checks the space that's used every interval, until the monitor is
+// stopped.
+func (m *storageMonitor) start(interval time.Duration) {
+	if m == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// sample records the space that's used, and returns the space that's
+// available.
+func (m *storageMonitor) sample() (uint64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	used, available, err := m.usage(m.path)
+	if err != nil {
+		return 0, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if used > m.peak {
+		m.peak = used
+	}
+	return available, nil
+}
+
+// peakUse returns the most space that was used since the monitor was
+// created.
+func (m *storageMonitor) peakUse() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.peak < m.baseline {
+		return 0
+	}
+	return m.peak - m.baseline
+}
+
+// check returns an insufficientStorageError if there isn't room for needed
+// bytes, and the space that the build keeps free, in the filesystem.
+func (m *storageMonitor) check(needed uint64) error {
+	if m == nil {
+		return nil
+	}
+	available, err := m.sample()
+	if err != nil {
+		log.V(0).Infof("Warning: unable to check the space available in %s: %v", m.path, err)
+		return nil
+	}
+	reserve := storageReserveFromEnv()
+	log.V(2).Infof("The images which the build pulls need about %s in %s, which has %s available.", units.BytesSize(float64(needed)), m.path, units.BytesSize(float64(available)))
+	if needed+reserve > available {
+		return &insufficientStorageError{Path: m.path, Needed: needed, Reserve: reserve, Available: available}
+	}
+	return nil
+}
+
+// report stops the monitor, and logs the most space that was used.
+func (m *storageMonitor) report() {
+	if m == nil {
+		return
+	}
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	available, err := m.sample()
+	if err != nil {
+		log.V(2).Infof("Unable to check the space used in %s: %v", m.path, err)
+		return
+	}
+	log.V(0).Infof("Peak storage use in %s was %s, %s is still available.", m.path, units.BytesSize(float64(m.peakUse())), units.BytesSize(float64(available)))
+}
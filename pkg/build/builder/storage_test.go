@@ -0,0 +1,132 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	units "github.com/docker/go-units"
+
+	builderutil "github.com/openshift/builder/pkg/build/builder/util"
+)
+
+// fakeStorageDocker is a FakeDocker which has a fixed amount of space for
+// images.
+type fakeStorageDocker struct {
+	*FakeDocker
+	monitor *storageMonitor
+	sizes   map[string]int64
+}
+
+func (d *fakeStorageDocker) CheckStorage(ctx context.Context, names, searchPaths []string) error {
+	var needed uint64
+	for _, name := range names {
+		needed += estimateImageStorage(d.sizes[name], false)
+	}
+	return d.monitor.check(needed)
+}
+
+// fakeUsage returns a usage function for a filesystem which has used and
+// available bytes, or which can't be checked if err is set.
+func fakeUsage(used, available *uint64, err *error) func(string) (uint64, uint64, error) {
+	return func(string) (uint64, uint64, error) {
+		return *used, *available, *err
+	}
+}
+
+func TestStorageMonitor(t *testing.T) {
+	used, available := uint64(10*units.GiB), uint64(5*units.GiB)
+	var usageErr error
+	monitor := newStorageMonitor("/var/lib/containers", fakeUsage(&used, &available, &usageErr))
+	if monitor == nil {
+		t.Fatal("expected a monitor")
+	}
+
+	used, available = 12*units.GiB, 3*units.GiB
+	monitor.sample()
+	used, available = 11*units.GiB, 4*units.GiB
+	monitor.sample()
+	if peak := monitor.peakUse(); peak != 2*units.GiB {
+		t.Errorf("expected a peak of 2GiB, got %s", units.BytesSize(float64(peak)))
+	}
+
+	usageErr = errors.New("no such file or directory")
+	if monitor := newStorageMonitor("/missing", fakeUsage(&used, &available, &usageErr)); monitor != nil {
+		t.Errorf("expected no monitor for a filesystem that can't be checked")
+	}
+	if err := monitor.check(100 * units.GiB); err != nil {
+		t.Errorf("expected no error when the space available can't be checked, got %v", err)
+	}
+	var nilMonitor *storageMonitor
+	if err := nilMonitor.check(100 * units.GiB); err != nil {
+		t.Errorf("expected a nil monitor not to check anything, got %v", err)
+	}
+	nilMonitor.report()
+	monitor.report()
+	monitor.report()
+}
+
+func TestCheckStorage(t *testing.T) {
+	used, available := uint64(0), uint64(4*units.GiB)
+	var usageErr error
+	client := &fakeStorageDocker{
+		FakeDocker: NewFakeDockerClient(),
+		monitor:    newStorageMonitor("/var/lib/containers", fakeUsage(&used, &available, &usageErr)),
+		sizes:      map[string]int64{"small": 500 * units.MiB, "large": 1600 * units.MiB},
+	}
+	tests := []struct {
+		names   []string
+		reserve string
+		check   string
+		err     bool
+	}{
+		{names: []string{"small"}},
+		{names: []string{"small", "large"}, err: true},
+		{names: []string{"large"}},
+		{names: []string{"large"}, reserve: "1g", err: true},
+		{names: []string{"large"}, reserve: "lots"},
+		{names: []string{"small", "large"}, check: "false"},
+	}
+	keys := []string{builderutil.BuildStorageReserve, builderutil.BuildStorageCheck}
+	preserveEnv := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := os.LookupEnv(key); ok {
+			preserveEnv[key] = value
+		}
+	}
+	for i, test := range tests {
+		os.Setenv(builderutil.BuildStorageReserve, test.reserve)
+		os.Setenv(builderutil.BuildStorageCheck, test.check)
+		err := checkStorage(context.Background(), client, test.names, nil)
+		var insufficient *insufficientStorageError
+		if test.err && !errors.As(err, &insufficient) {
+			t.Errorf("%d: expected an insufficient storage error, got %v", i, err)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+	if err := checkStorage(context.Background(), NewFakeDockerClient(), []string{"large"}, nil); err != nil {
+		t.Errorf("expected clients which can't check storage not to, got %v", err)
+	}
+	for _, key := range keys {
+		if value, ok := preserveEnv[key]; ok {
+			os.Setenv(key, value)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestEstimateImageStorage(t *testing.T) {
+	if size := estimateImageStorage(100, false); size != 200 {
+		t.Errorf("expected 200, got %d", size)
+	}
+	if size := estimateImageStorage(100, true); size != 300 {
+		t.Errorf("expected 300 when the blob cache keeps compressed layers, got %d", size)
+	}
+	if size := estimateImageStorage(-1, true); size != 0 {
+		t.Errorf("expected an unknown size to be 0, got %d", size)
+	}
+}
@@ -81,6 +81,10 @@ func reportPushFailure(err error, authPresent bool, pushAuthConfig docker.AuthCo
 // addBuildLabels adds some common image labels describing the build that produced
 // this image.
 func addBuildLabels(labels map[string]string, build *buildapiv1.Build) {
+	if reproducibleBuild() {
+		// these change every time the build runs
+		return
+	}
 	labels[builderutil.DefaultDockerLabelNamespace+"build.name"] = build.Name
 	labels[builderutil.DefaultDockerLabelNamespace+"build.namespace"] = build.Namespace
 }
@@ -167,6 +171,19 @@ func PathForBuildVolume(objName string) string {
 	return filepath.Join(buildVolumeMountPath, NameForBuildVolume(objName))
 }
 
+// PathForBuildVolumeSource returns the path in the builder container where the
+// source of the build volume is mounted.  Secrets and config maps are mounted
+// once for each of them that the build's volumes use.
+func PathForBuildVolumeSource(bv buildapiv1.BuildVolume) string {
+	switch bv.Source.Type {
+	case buildapiv1.BuildVolumeSourceTypeSecret:
+		return PathForBuildVolume(bv.Source.Secret.SecretName)
+	case buildapiv1.BuildVolumeSourceTypeConfigMap:
+		return PathForBuildVolume(bv.Source.ConfigMap.Name)
+	}
+	return PathForBuildVolume(bv.Name)
+}
+
 // normalizeRegistryLocation munges a registry location that's mistakenly been
 // provided in the old http/https URL format, which containers/image now
 // rejects, into a proper location prefix.  Locations which don't look like
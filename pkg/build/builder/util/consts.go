@@ -1,5 +1,9 @@
 package util
 
+import (
+	buildapiv1 "github.com/openshift/api/build/v1"
+)
+
 const (
 
 	// AllowedUIDs is an environment variable that contains ranges of UIDs that are allowed in
@@ -8,10 +12,135 @@ const (
 	// DropCapabilities is an environment variable that contains a list of capabilities to drop when
 	// executing a Source build
 	DropCapabilities = "DROP_CAPS"
+	// BuildPlatforms is an environment variable that contains a comma-separated list of
+	// os/arch[/variant] platforms that a build should produce images for
+	BuildPlatforms = "BUILD_PLATFORMS"
+	// BuildImageFormat is an environment variable that selects the manifest format, either
+	// "oci" or "docker", of the images that a build produces and pushes
+	BuildImageFormat = "BUILD_IMAGE_FORMAT"
+	// BuildPushCompression is an environment variable that contains a comma-separated list of
+	// compression algorithms (gzip, zstd, zstd:chunked) to use for layers when pushing an image.
+	// The first is used for the image itself, and any others are pushed as additional variants.
+	// Variants are listed in a manifest list, so giving more than one algorithm makes a build
+	// push a manifest list, even if it only builds an image for a single platform
+	BuildPushCompression = "BUILD_PUSH_COMPRESSION"
+	// BuildCacheFrom is an environment variable that contains a comma-separated list of
+	// repositories that cached intermediate layers can be imported from during a build
+	BuildCacheFrom = "BUILD_CACHE_FROM"
+	// BuildCacheTo is an environment variable that contains a comma-separated list of
+	// repositories that intermediate layers created during a build should be exported to.
+	// Each layer is exported as soon as it is committed, so layers are exported even if a
+	// later instruction makes the build fail
+	BuildCacheTo = "BUILD_CACHE_TO"
+	// BuildCacheTTL is an environment variable that contains the maximum age, as a duration,
+	// of imported cached layers that a build will use
+	BuildCacheTTL = "BUILD_CACHE_TTL"
+	// BuildReproducible is an environment variable that, when set to "true", makes a build use
+	// the date of the commit being built for timestamps in the image, so that builds of the same
+	// inputs produce identical images.  The build's name and namespace are left out of the
+	// image's labels and environment, since they change every time the build runs
+	BuildReproducible = "BUILD_REPRODUCIBLE"
+	// SourceDateEpoch is an environment variable that contains an explicit time, in seconds
+	// since the epoch, to use for timestamps in the image.  Setting it implies BuildReproducible
+	SourceDateEpoch = "SOURCE_DATE_EPOCH"
+	// BuildSquashAll is an environment variable that, when set to "true", squashes the image
+	// produced by a build, including the contents of its base image, into a single layer
+	BuildSquashAll = "BUILD_SQUASH_ALL"
+	// BuildSecretMounts is an environment variable that, when set to "true", makes secrets
+	// listed as build sources available only to RUN --mount=type=secret instructions, instead
+	// of copying them into the build context
+	BuildSecretMounts = "BUILD_SECRET_MOUNTS"
+	// BuildSSHForward is an environment variable that, when set to "true", makes the private
+	// key in the build's source secret available to RUN --mount=type=ssh instructions through
+	// an SSH agent.  The clone step skips host key checking when the secret has no known_hosts
+	// file, but instructions use ssh's own settings, so they need to mount the secret's
+	// known_hosts file with RUN --mount=type=secret,id=known_hosts and point ssh at it, or
+	// otherwise trust the hosts they connect to
+	BuildSSHForward = "BUILD_SSH_FORWARD"
+	// BuildNetwork is an environment variable that selects the network access which RUN
+	// instructions have: "host" (the default), "private", or "none"
+	BuildNetwork = "BUILD_NETWORK"
+	// BuildUlimits is an environment variable that holds a comma-separated list of process
+	// limits for build containers, each in the form "type=soft[:hard]", like "nproc=4096".
+	// Limits which aren't listed are the ones that the builder runs with, and no hard limit
+	// can be higher than the builder's own
+	BuildUlimits = "BUILD_ULIMITS"
+	// BuildShmSize is an environment variable that sets the size of /dev/shm in build
+	// containers, like "256m" or "1g"
+	BuildShmSize = "BUILD_SHM_SIZE"
+	// BuildTmpfs is an environment variable that holds a whitespace-separated list of tmpfs
+	// filesystems to mount in build containers, each in the form "destination[:option,...]",
+	// like "/scratch:size=1g,mode=1777".  Each RUN instruction gets new, empty filesystems
+	BuildTmpfs = "BUILD_TMPFS"
+	// BuildTarget is an environment variable that names the stage of a multi-stage
+	// Dockerfile which a Docker build should build, instead of the last one
+	BuildTarget = "BUILD_TARGET"
+	// BuildPullConcurrency is an environment variable that sets the number of images which
+	// are pulled at the same time before a build starts
+	BuildPullConcurrency = "BUILD_PULL_CONCURRENCY"
+	// BuildPushPullRetries is an environment variable that sets the number of times that a
+	// build retries pushing or pulling an image after a failure which might not happen again
+	BuildPushPullRetries = "BUILD_PUSH_PULL_RETRIES"
+	// BuildPushPullRetryDelay is an environment variable that sets how long, as a duration, a
+	// build waits before it first retries pushing or pulling an image.  The wait doubles with
+	// each retry
+	BuildPushPullRetryDelay = "BUILD_PUSH_PULL_RETRY_DELAY"
+	// BuildPushPullRetryMaxDelay is an environment variable that sets the longest that a build
+	// waits, as a duration, before it retries pushing or pulling an image
+	BuildPushPullRetryMaxDelay = "BUILD_PUSH_PULL_RETRY_MAX_DELAY"
+	// BuildSigningKey is an environment variable that holds the path of a private key, usually
+	// in a mounted secret, which images are signed with after they are pushed
+	BuildSigningKey = "BUILD_SIGNING_KEY"
+	// BuildSigningFormat is an environment variable that selects the kind of signature which
+	// is created with the BuildSigningKey: "sigstore" (the default), which expects a sigstore
+	// private key, or "simple", which expects an armored GPG secret key
+	BuildSigningFormat = "BUILD_SIGNING_FORMAT"
+	// BuildSigningPassphraseFile is an environment variable that holds the path of a file
+	// containing the passphrase of the BuildSigningKey
+	BuildSigningPassphraseFile = "BUILD_SIGNING_PASSPHRASE_FILE"
+	// BuildSBOM is an environment variable that, when set to "spdx" or "cyclonedx", generates
+	// an SBOM in that format for the built image, records its digest in the image's labels,
+	// and attaches it to the image when the image is pushed
+	BuildSBOM = "BUILD_SBOM"
+	// BuildProvenance is an environment variable that, when set to "true", attaches a SLSA
+	// provenance attestation to the pushed image, which is signed if BuildSigningKey is a
+	// sigstore key
+	BuildProvenance = "BUILD_PROVENANCE"
+	// BuildAdditionalDestinations is an environment variable that holds a whitespace-separated
+	// list of images, other than the build's output image, which the build's output is also
+	// pushed to.  Each is either a tag, like ":latest", for the output image's repository, or
+	// a full image reference, and can use build variables like ${OPENSHIFT_BUILD_COMMIT}.  The
+	// build fails if it can't push to one of them, unless it ends in ";optional"
+	BuildAdditionalDestinations = "BUILD_ADDITIONAL_DESTINATIONS"
+	// BuildExport is an environment variable that names a file or directory, usually on a
+	// mounted build volume, which the built image is written to, whether or not it is also
+	// pushed: "oci:/path" for an OCI layout, "oci-archive:/path" or "docker-archive:/path"
+	BuildExport = "BUILD_EXPORT"
+	// BuildPinImages is an environment variable that, when set to "false", stops a build from
+	// resolving the images that it uses to digests, rewriting its Dockerfile or builder image
+	// to use those digests, and recording them in the image's labels
+	BuildPinImages = "BUILD_PIN_IMAGES"
+	// BuildBaseImagePolicyPath is an environment variable that contains the path of a JSON
+	// file with rules that allow or deny the images a build uses, by registry and repository,
+	// and which can require that they be referenced by digest.  The build fails if it's set
+	// and the file can't be read
+	BuildBaseImagePolicyPath = "BUILD_BASE_IMAGE_POLICY_PATH"
+	// BuildStorageCheck is an environment variable that, when set to "false", stops a build
+	// from estimating how much space the images it pulls will take up, and failing before it
+	// pulls them if the storage where it keeps images can't hold them
+	BuildStorageCheck = "BUILD_STORAGE_CHECK"
+	// BuildStorageReserve is an environment variable that sets how much space, like "1g",
+	// should be left free in the storage where a build keeps images, after the images that
+	// it pulls have been stored there
+	BuildStorageReserve = "BUILD_STORAGE_RESERVE"
 
 	// DefaultDockerLabelNamespace is the key of a Build label, whose values are build metadata.
 	DefaultDockerLabelNamespace = "io.openshift."
 
+	// SSHKnownHostsFileName is the name of the file in a source secret which lists the SSH
+	// host keys that the build trusts.
+	SSHKnownHostsFileName = "known_hosts"
+
 	StatusMessageCannotCreateBuildPodSpec        = "Failed to create pod spec."
 	StatusMessageCannotCreateBuildPod            = "Failed creating build pod."
 	StatusMessageInvalidOutputRef                = "Output image could not be resolved."
@@ -35,4 +164,20 @@ const (
 	StatusMessageGenericBuildFailed              = "Generic Build failure - check logs for details."
 	StatusMessageUnresolvableEnvironmentVariable = "Unable to resolve build environment variable reference."
 	StatusMessageCannotRetrieveServiceAccount    = "Unable to look up the service account associated with this build."
+	StatusMessageSkipLayersWarning               = "Layers created by this build were squashed into a single layer, and were not cached."
+	StatusMessageSignImageFailed                 = "Failed to sign the image pushed to the registry."
+	StatusMessageAttachProvenanceFailed          = "Failed to attach a provenance attestation to the image pushed to the registry."
+	StatusMessagePushAdditionalDestinationFailed = "Failed to push the image to one of its additional destinations."
+	StatusMessageExportImageFailed               = "Failed to export the image."
+	StatusMessageBaseImagePolicyViolation        = "The build uses images which the base image policy does not allow."
+	StatusMessageInsufficientStorage             = "There is not enough storage space for the images which the build uses."
 )
+
+// StatusReasonBaseImagePolicyViolation is the reason a build fails when it uses an image
+// that the base image policy doesn't allow.  The build API doesn't have a reason for it.
+const StatusReasonBaseImagePolicyViolation buildapiv1.StatusReason = "BaseImagePolicyViolation"
+
+// StatusReasonInsufficientStorage is the reason a build fails when the storage where it
+// keeps images doesn't have room for the images that it needs to pull.  The build API
+// doesn't have a reason for it.
+const StatusReasonInsufficientStorage buildapiv1.StatusReason = "InsufficientStorage"